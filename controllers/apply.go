@@ -1,19 +1,19 @@
 package controllers
 
 import (
+	"bytes"
 	"encoding/json"
 	"image"
-	"image/draw"
 	"image/gif"
+	"io"
 	"log"
-	"math"
 	"net/http"
 	"time"
 
+	"github.com/timendus/pixelbox/graphics"
 	"github.com/timendus/pixelbox/models"
 	"github.com/timendus/pixelbox/protocol"
 	"github.com/timendus/pixelbox/server"
-	xdraw "golang.org/x/image/draw"
 )
 
 func init() {
@@ -22,6 +22,7 @@ func init() {
 	router.HandleFunc("POST /preview", preview)
 	router.HandleFunc("POST /image", showImage)
 	router.HandleFunc("POST /gif", showGif)
+	router.HandleFunc("POST /icon/{name}", showIcon)
 	server.RegisterRouter("/apply", router)
 }
 
@@ -41,7 +42,7 @@ func preview(res http.ResponseWriter, req *http.Request) {
 		return
 	}
 
-	err = server.GetConnection().Send(message)
+	err = display.show(nil, message)
 	if err != nil {
 		http.Error(res, "could not apply scene: "+err.Error(), http.StatusInternalServerError)
 		return
@@ -61,36 +62,38 @@ func syncTime(res http.ResponseWriter, req *http.Request) {
 	res.WriteHeader(http.StatusOK)
 }
 
+// POST /apply/image?save=name
+//
+// Shows the uploaded image and keeps it in the asset library. With `save`, it
+// is also stored as an image scene with that name.
 func showImage(res http.ResponseWriter, req *http.Request) {
-	// Limit size defensively (example: 10 MB)
-	req.Body = http.MaxBytesReader(res, req.Body, 10<<20)
-
-	if err := req.ParseMultipartForm(10 << 20); err != nil {
-		http.Error(res, err.Error(), http.StatusBadRequest)
+	data, asset, ok := readUpload(res, req)
+	if !ok {
 		return
 	}
 
-	file, _, err := req.FormFile("file")
+	img, _, err := image.Decode(bytes.NewReader(data))
 	if err != nil {
-		http.Error(res, err.Error(), http.StatusBadRequest)
+		http.Error(res, "invalid image", http.StatusBadRequest)
 		return
 	}
-	defer file.Close()
 
-	img, _, err := image.Decode(file)
-	if err != nil {
-		http.Error(res, "invalid image", http.StatusBadRequest)
+	scene, ok := saveUpload(res, req, asset, func(scene *models.Scene) {
+		scene.SceneType = "image"
+		scene.Image = models.Image{Asset: asset.Hash}
+	})
+	if !ok {
 		return
 	}
 
-	message, err := protocol.ShowImage(toScaledRGBA(img))
+	message, err := protocol.ShowImage(graphics.ToScaledRGBA(img))
 	if err != nil {
 		log.Println("could not show image:", err)
 		res.WriteHeader(http.StatusBadRequest)
 		return
 	}
 
-	err = server.GetConnection().Send(message)
+	err = display.show(scene, message)
 	if err != nil {
 		log.Println("could not send message:", err)
 		res.WriteHeader(http.StatusInternalServerError)
@@ -98,142 +101,132 @@ func showImage(res http.ResponseWriter, req *http.Request) {
 	}
 
 	// log.Println("Outgoing:", message)
+	if scene != nil {
+		http.Redirect(res, req, "/scene/"+scene.Uuid.String(), http.StatusSeeOther)
+		return
+	}
 	http.Redirect(res, req, "/", http.StatusSeeOther)
 }
 
+// POST /apply/gif?save=name
+//
+// Shows the uploaded GIF, fitted within the animation budget, and keeps it in
+// the asset library. With `save`, all of its frames are also stored as an
+// animation scene with that name. Animation scenes are fitted within the budget
+// from config.json when they are compiled, so the scene can keep every frame.
 func showGif(res http.ResponseWriter, req *http.Request) {
-	// Limit size defensively (example: 10 MB)
-	req.Body = http.MaxBytesReader(res, req.Body, 10<<20)
-
-	if err := req.ParseMultipartForm(10 << 20); err != nil {
-		http.Error(res, err.Error(), http.StatusBadRequest)
+	data, asset, ok := readUpload(res, req)
+	if !ok {
 		return
 	}
 
-	file, _, err := req.FormFile("file")
+	img, err := gif.DecodeAll(bytes.NewReader(data))
 	if err != nil {
-		http.Error(res, err.Error(), http.StatusBadRequest)
+		http.Error(res, "invalid animation", http.StatusBadRequest)
 		return
 	}
-	defer file.Close()
 
-	img, err := gif.DecodeAll(file)
+	budget, err := budgetFromRequest(req)
 	if err != nil {
-		http.Error(res, "invalid animation", http.StatusBadRequest)
+		http.Error(res, err.Error(), http.StatusBadRequest)
 		return
 	}
 
-	frames := extractFullGIFFrames(img)
+	frames := graphics.GIFFrames(img)
+	durations := make([]int, len(frames))
 
 	for i, frame := range frames {
-		frames[i] = toScaledRGBA(frame)
-		img.Delay[i] *= 10 // convert to ms
+		frames[i] = graphics.ToScaledRGBA(frame)
+		durations[i] = img.Delay[i] * 10 // convert to ms
 	}
 
-	message, err := protocol.ShowAnimation(frames, img.Delay)
+	message, report, err := protocol.FitAnimation(frames, durations, budget)
 	if err != nil {
 		log.Println("could not show image:", err)
 		res.WriteHeader(http.StatusBadRequest)
 		return
 	}
 
-	err = server.GetConnection().Send(message)
+	scene, ok := saveUpload(res, req, asset, func(scene *models.Scene) {
+		scene.SceneType = "animation"
+		scene.Animation = models.Animation{Asset: asset.Hash}
+	})
+	if !ok {
+		return
+	}
+
+	err = display.show(scene, message)
 	if err != nil {
 		log.Println("could not send message:", err)
 		res.WriteHeader(http.StatusInternalServerError)
 		return
 	}
 
-	// log.Println("Outgoing:", message)
-	http.Redirect(res, req, "/", http.StatusSeeOther)
+	if scene != nil {
+		http.Redirect(res, req, "/scene/"+scene.Uuid.String(), http.StatusSeeOther)
+		return
+	}
+	res.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(res).Encode(report)
 }
 
-func extractFullGIFFrames(g *gif.GIF) []*image.RGBA {
-	bounds := image.Rect(0, 0, g.Config.Width, g.Config.Height)
-	canvas := image.NewRGBA(bounds)
-
-	var frames []*image.RGBA
-
-	for i, frame := range g.Image {
-		// Save a copy of the canvas *before* drawing the frame
-		prev := image.NewRGBA(bounds)
-		draw.Draw(prev, bounds, canvas, image.Point{}, draw.Src)
+// readUpload reads the `file` of the multipart form and keeps it in the asset
+// library. If it can't be kept, the asset is nil, but the upload can still be
+// shown.
+func readUpload(res http.ResponseWriter, req *http.Request) ([]byte, *models.Asset, bool) {
+	// Limit size defensively (example: 10 MB)
+	req.Body = http.MaxBytesReader(res, req.Body, 10<<20)
 
-		// Draw frame onto canvas
-		draw.Draw(canvas, frame.Bounds(), frame, image.Point{}, draw.Over)
+	if err := req.ParseMultipartForm(10 << 20); err != nil {
+		http.Error(res, err.Error(), http.StatusBadRequest)
+		return nil, nil, false
+	}
 
-		// Capture the composited frame
-		out := image.NewRGBA(bounds)
-		draw.Draw(out, bounds, canvas, image.Point{}, draw.Src)
-		frames = append(frames, out)
+	file, header, err := req.FormFile("file")
+	if err != nil {
+		http.Error(res, err.Error(), http.StatusBadRequest)
+		return nil, nil, false
+	}
+	defer file.Close()
 
-		// Handle disposal
-		switch g.Disposal[i] {
-		case gif.DisposalBackground:
-			draw.Draw(canvas, frame.Bounds(), image.Transparent, image.Point{}, draw.Src)
-		case gif.DisposalPrevious:
-			draw.Draw(canvas, bounds, prev, image.Point{}, draw.Src)
-		case gif.DisposalNone:
-			// keep canvas as-is
-		}
+	data, err := io.ReadAll(file)
+	if err != nil {
+		http.Error(res, err.Error(), http.StatusBadRequest)
+		return nil, nil, false
 	}
 
-	return frames
+	asset, err := models.Assets.Add(data, header.Filename)
+	if err != nil {
+		log.Println("could not keep upload in the asset library:", err)
+		return data, nil, true
+	}
+	return data, &asset, true
 }
 
-func toScaledRGBA(img image.Image) *image.RGBA {
-	const target = 16
-
-	src := img.Bounds()
-	sw, sh := src.Dx(), src.Dy()
-
-	// Don't scale the image if it is already the right resolution
-	// (Do we need this? Not for the result, but it is faster...)
-	if sw == 16 && sh == 16 {
-		// Fast path: already RGBA
-		if rgba, ok := img.(*image.RGBA); ok {
-			return rgba
-		}
-
-		rgba := image.NewRGBA(src)
-		// Draw copies pixels and handles colorspace conversion
-		draw.Draw(rgba, src, img, src.Min, draw.Src)
-
-		return rgba
+// saveUpload creates a scene for the uploaded asset if the request has a
+// `save` parameter, and returns it. Otherwise the scene is nil.
+func saveUpload(res http.ResponseWriter, req *http.Request, asset *models.Asset, setup func(*models.Scene)) (*models.Scene, bool) {
+	name := req.FormValue("save")
+	if name == "" {
+		return nil, true
+	}
+	if asset == nil {
+		http.Error(res, "could not keep the upload in the asset library, so it can't be saved", http.StatusInternalServerError)
+		return nil, false
 	}
 
-	// Scale to fit within 16x16, preserving aspect ratio
-	scale := math.Min(
-		float64(target)/float64(sw),
-		float64(target)/float64(sh),
-	)
+	scene := defaultScene()
+	scene.Name = name
+	scene.Id = toId(name)
+	setup(&scene)
 
-	dw := int(math.Round(float64(sw) * scale))
-	dh := int(math.Round(float64(sh) * scale))
-	if dw < 1 {
-		dw = 1
+	err := models.Scenes.Create(&scene)
+	if isInvalid(res, err) {
+		return nil, false
 	}
-	if dh < 1 {
-		dh = 1
+	if err != nil {
+		http.Error(res, "could not create scene: "+err.Error(), http.StatusInternalServerError)
+		return nil, false
 	}
-
-	// 1) Resize into a temporary image of size dw x dh
-	scaled := image.NewRGBA(image.Rect(0, 0, dw, dh))
-	xdraw.CatmullRom.Scale(scaled, scaled.Bounds(), img, src, xdraw.Over, nil)
-
-	// 2) Composite onto a 16x16 canvas, centered (letterbox)
-	out := image.NewRGBA(image.Rect(0, 0, target, target))
-
-	ox := (target - dw) / 2
-	oy := (target - dh) / 2
-
-	draw.Draw(
-		out,
-		image.Rect(ox, oy, ox+dw, oy+dh),
-		scaled,
-		image.Point{},
-		draw.Over,
-	)
-
-	return out
+	return &scene, true
 }
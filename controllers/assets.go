@@ -0,0 +1,118 @@
+package controllers
+
+// The asset library holds the images and GIFs that were uploaded to
+// /apply/image and /apply/gif. Scenes can use them by their hash.
+
+import (
+	"encoding/json"
+	"log"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/google/uuid"
+	"github.com/timendus/pixelbox/models"
+	"github.com/timendus/pixelbox/server"
+)
+
+const assetCollectInterval = 24 * time.Hour
+
+func init() {
+	router := http.NewServeMux()
+	router.HandleFunc("GET /", assetList)
+	router.HandleFunc("GET /{hash}", getAsset)
+	router.HandleFunc("DELETE /{hash}", deleteAsset)
+	router.HandleFunc("POST /collect", collectAssets)
+	server.RegisterRouter("/assets", router)
+}
+
+type assetSummary struct {
+	models.Asset
+	Scenes []uuid.UUID `json:"scenes"` // The scenes that use the asset
+}
+
+// GET /assets/
+//
+// Lists the assets, most recently uploaded first, with the scenes that use them
+func assetList(res http.ResponseWriter, req *http.Request) {
+	users := models.Scenes.ScenesByAsset()
+	assets := models.Assets.All()
+	result := make([]assetSummary, len(assets))
+	for i, asset := range assets {
+		result[i] = assetSummary{asset, make([]uuid.UUID, 0)}
+		for _, scene := range users[asset.Hash] {
+			result[i].Scenes = append(result[i].Scenes, scene.Uuid)
+		}
+	}
+	json.NewEncoder(res).Encode(result)
+}
+
+// GET /assets/{hash}
+//
+// Returns the file as it was uploaded
+func getAsset(res http.ResponseWriter, req *http.Request) {
+	asset, data, err := models.Assets.Read(req.PathValue("hash"))
+	if err != nil {
+		http.Error(res, "Could not find asset with given hash", http.StatusNotFound)
+		return
+	}
+	// The contents of an asset never change
+	res.Header().Set("Content-Type", "image/"+asset.Type)
+	res.Header().Set("Cache-Control", "public, max-age=31536000, immutable")
+	res.Header().Set("Content-Disposition", `inline; filename="`+strings.ReplaceAll(asset.Filename, `"`, "")+`"`)
+	res.Write(data)
+}
+
+// DELETE /assets/{hash}
+//
+// Refuses to delete assets that are still used by a scene, one of its revisions
+// or a scene in the trash
+func deleteAsset(res http.ResponseWriter, req *http.Request) {
+	hash := req.PathValue("hash")
+	if _, err := models.Assets.Find(hash); err != nil {
+		http.Error(res, "Could not find asset with given hash", http.StatusNotFound)
+		return
+	}
+	used, err := models.Scenes.AssetReferences()
+	if err != nil {
+		http.Error(res, "could not check which assets are used: "+err.Error(), http.StatusInternalServerError)
+		return
+	}
+	if used[hash] {
+		http.Error(res, "asset is still used by a scene, one of its revisions or a scene in the trash", http.StatusConflict)
+		return
+	}
+	if err := models.Assets.Delete(hash); err != nil {
+		http.Error(res, "could not delete asset: "+err.Error(), http.StatusInternalServerError)
+		return
+	}
+	http.Redirect(res, req, "/assets/", http.StatusSeeOther)
+}
+
+// POST /assets/collect
+//
+// Runs the daily clean up of unused assets right away, and returns the assets
+// that were removed
+func collectAssets(res http.ResponseWriter, req *http.Request) {
+	removed, err := models.Assets.Collect(models.Scenes)
+	if err != nil {
+		http.Error(res, "could not remove unused assets: "+err.Error(), http.StatusInternalServerError)
+		return
+	}
+	json.NewEncoder(res).Encode(removed)
+}
+
+// StartAssetCollector removes unused assets now, and then once a day
+func StartAssetCollector() {
+	go func() {
+		for {
+			removed, err := models.Assets.Collect(models.Scenes)
+			if err != nil {
+				log.Println("Could not remove unused assets:", err)
+			} else if len(removed) > 0 {
+				log.Printf("Removed %d unused assets\n", len(removed))
+			}
+			time.Sleep(assetCollectInterval)
+		}
+	}()
+}
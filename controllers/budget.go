@@ -0,0 +1,37 @@
+package controllers
+
+// Uploaded animations are fitted within the budget from config.json, see
+// protocol/budget.go. The frame and byte limits can be changed per request.
+
+import (
+	"fmt"
+	"net/http"
+	"strconv"
+
+	"github.com/timendus/pixelbox/models"
+	"github.com/timendus/pixelbox/protocol"
+)
+
+// budgetFromRequest takes the limits from the configuration, allowing the
+// frame and byte limits to be lowered or raised per request using the
+// `maxFrames` and `maxBytes` query parameters.
+func budgetFromRequest(req *http.Request) (protocol.AnimationBudget, error) {
+	budget := models.AnimationBudget.Get()
+
+	query := req.URL.Query()
+	for name, target := range map[string]*int{
+		"maxFrames": &budget.MaxFrames,
+		"maxBytes":  &budget.MaxBytes,
+	} {
+		value := query.Get(name)
+		if value == "" {
+			continue
+		}
+		number, err := strconv.Atoi(value)
+		if err != nil || number < 1 {
+			return budget, fmt.Errorf("%s should be a positive number", name)
+		}
+		*target = number
+	}
+	return budget, nil
+}
@@ -0,0 +1,80 @@
+package controllers
+
+import (
+	"archive/zip"
+	"encoding/json"
+	"log"
+	"net/http"
+	"time"
+
+	"github.com/timendus/pixelbox/models"
+)
+
+// GET /scene/export?scene=clocky&scene=<uuid>
+//
+// Downloads a zip file with the given scenes, by ID or UUID, and the icons
+// they use. Without any `scene` parameters, all scenes are exported.
+func exportScenes(res http.ResponseWriter, req *http.Request) {
+	scenes := models.Scenes.All()
+	if refs := req.URL.Query()["scene"]; len(refs) > 0 {
+		scenes = make([]*models.Scene, 0, len(refs))
+		for _, ref := range refs {
+			scene, err := models.Scenes.Find(ref)
+			if err != nil {
+				http.Error(res, "Could not find scene "+ref, http.StatusNotFound)
+				return
+			}
+			scenes = append(scenes, scene)
+		}
+	}
+
+	filename := "pixelbox-scenes-" + time.Now().Format("20060102-150405") + ".zip"
+	res.Header().Set("Content-Type", "application/zip")
+	res.Header().Set("Content-Disposition", `attachment; filename="`+filename+`"`)
+	if err := models.WriteBundle(res, scenes); err != nil {
+		// Too late for an error response, the download is just cut short
+		log.Println("Could not export scenes:", err)
+	}
+}
+
+// POST /scene/import
+//
+// Expects a multipart form with a bundle from /scene/export in a field called
+// `file`. The optional `conflict` field says what to do with scenes that have
+// the same UUID or ID as an existing scene: `skip` them (the default),
+// `overwrite` the existing scene, or `keep` both by giving the imported scene a
+// new UUID and ID. Returns a report for every scene in the bundle.
+func importScenes(res http.ResponseWriter, req *http.Request) {
+	req.Body = http.MaxBytesReader(res, req.Body, 64<<20) // 64 MB
+
+	if err := req.ParseMultipartForm(64 << 20); err != nil {
+		http.Error(res, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	file, header, err := req.FormFile("file")
+	if err != nil {
+		http.Error(res, err.Error(), http.StatusBadRequest)
+		return
+	}
+	defer file.Close()
+
+	bundle, err := zip.NewReader(file, header.Size)
+	if err != nil {
+		http.Error(res, "invalid zip file: "+err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	policy := req.FormValue("conflict")
+	if policy == "" {
+		policy = models.ConflictSkip
+	}
+	reports, err := models.Scenes.ImportBundle(bundle, policy)
+	if err != nil {
+		http.Error(res, "could not import scenes: "+err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	res.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(res).Encode(reports)
+}
@@ -0,0 +1,121 @@
+package controllers
+
+// The display keeps track of what is currently showing on the device. That way
+// we can temporarily show something else, like a live stream, and return to
+// what was showing before when we're done.
+
+import (
+	"fmt"
+	"sync"
+
+	"github.com/timendus/pixelbox/models"
+	"github.com/timendus/pixelbox/server"
+)
+
+type displayState struct {
+	mu       sync.Mutex
+	scene    *models.Scene
+	message  []byte
+	overlays int
+}
+
+var display displayState
+
+// show sends the message to the device and remembers it as what is showing. If
+// the message was created from a stored scene, pass the scene too, so we can
+// recompile it if it changes in the mean time. Showing something by hand
+// pauses the playlist player and aborts a running sequence.
+func (d *displayState) show(scene *models.Scene, message []byte) error {
+	player.pause()
+	sequencer.cancel()
+	return d.present(scene, message)
+}
+
+// present is show without pausing the playlist player or aborting a sequence,
+// for when they show something themselves. While an overlay is
+// active, the message is only remembered, to be shown when the overlay ends.
+func (d *displayState) present(scene *models.Scene, message []byte) error {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	if d.overlays == 0 {
+		if err := send(message); err != nil {
+			return err
+		}
+	}
+	d.scene = scene
+	d.message = message
+	return nil
+}
+
+// begin hands the display to an overlay, like a notification or a live stream,
+// that talks to the device directly. Call end when the overlay is done.
+func (d *displayState) begin() {
+	d.mu.Lock()
+	d.overlays++
+	d.mu.Unlock()
+}
+
+// end hands the display back after an overlay. Once all overlays are done,
+// whatever should be showing is sent to the device again.
+func (d *displayState) end() error {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	d.overlays--
+	if d.overlays > 0 {
+		return nil
+	}
+	return d.restore()
+}
+
+// refresh recompiles and sends the scene that is showing if it uses the
+// variable, so it shows the new value
+func (d *displayState) refresh(variable string) error {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	if d.scene == nil || d.overlays > 0 {
+		// After an overlay, the scene is recompiled anyway
+		return nil
+	}
+	if current, err := models.Scenes.FindByUUID(d.scene.Uuid); err != nil || !current.Uses(variable) {
+		return nil
+	}
+	return d.restore()
+}
+
+// restore sends whatever was showing last to the device again. The caller
+// should hold the lock.
+func (d *displayState) restore() error {
+	scene, message := d.scene, d.message
+
+	// The scene may have been changed or deleted in the mean time
+	if scene != nil {
+		if current, err := models.Scenes.FindByUUID(scene.Uuid); err == nil {
+			scene = current
+		} else {
+			scene = nil
+		}
+	}
+
+	if scene != nil {
+		var err error
+		message, err = scene.GetMessage()
+		if err != nil {
+			return fmt.Errorf("could not create message from scene: %w", err)
+		}
+	}
+	if message == nil {
+		return nil
+	}
+	return send(message)
+}
+
+// send sends the message to the device straight away. Overlays use it to talk
+// to the device directly.
+func send(message []byte) error {
+	connection := server.GetConnection()
+	if connection == nil {
+		// We're still starting up
+		return fmt.Errorf("device not connected")
+	}
+	return connection.Send(message)
+}
@@ -1,6 +1,7 @@
 package controllers
 
 import (
+	"encoding/json"
 	"fmt"
 	"io"
 	"net/http"
@@ -8,6 +9,7 @@ import (
 	"sync"
 	"time"
 
+	"github.com/timendus/pixelbox/models"
 	"github.com/timendus/pixelbox/server"
 )
 
@@ -19,26 +21,38 @@ func init() {
 	router.HandleFunc("GET /", Events.Handler)
 	server.RegisterRouter("/events", router)
 
+	// Let open editors know when a scene changes, so they can reload it
+	models.RegisterSceneListener(func(change models.SceneChange) {
+		data, _ := json.Marshal(change)
+		Events.BroadcastEvent("scene", string(data))
+	})
+}
+
+// Event is a server-sent event. Events without a name are messages from the
+// device.
+type Event struct {
+	Name string
+	Data string
 }
 
 type SSE struct {
 	mu      sync.Mutex
-	clients map[chan string]struct{}
+	clients map[chan Event]struct{}
 }
 
 func NewSSEHub() *SSE {
-	return &SSE{clients: make(map[chan string]struct{})}
+	return &SSE{clients: make(map[chan Event]struct{})}
 }
 
-func (h *SSE) Subscribe() chan string {
-	ch := make(chan string, 16) // buffered so slow clients don't immediately block broadcasts
+func (h *SSE) Subscribe() chan Event {
+	ch := make(chan Event, 16) // buffered so slow clients don't immediately block broadcasts
 	h.mu.Lock()
 	h.clients[ch] = struct{}{}
 	h.mu.Unlock()
 	return ch
 }
 
-func (h *SSE) Unsubscribe(ch chan string) {
+func (h *SSE) Unsubscribe(ch chan Event) {
 	h.mu.Lock()
 	delete(h.clients, ch)
 	h.mu.Unlock()
@@ -46,11 +60,17 @@ func (h *SSE) Unsubscribe(ch chan string) {
 }
 
 func (h *SSE) Broadcast(msg string) {
+	h.BroadcastEvent("", msg)
+}
+
+// BroadcastEvent sends a named event, which browsers can listen for with
+// `addEventListener(name, ...)`
+func (h *SSE) BroadcastEvent(name, data string) {
 	h.mu.Lock()
 	defer h.mu.Unlock()
 	for ch := range h.clients {
 		select {
-		case ch <- msg:
+		case ch <- Event{name, data}:
 		default:
 			// Drop if the client is too slow (prevents one client from blocking everyone)
 		}
@@ -89,10 +109,13 @@ func (h *SSE) Handler(w http.ResponseWriter, r *http.Request) {
 			_, _ = w.Write([]byte(": ping\n\n"))
 			flusher.Flush()
 
-		case msg := <-ch:
+		case event := <-ch:
 			// Basic SSE format: "data: <line>\n\n"
 			// If msg contains newlines, you must prefix each line with "data: ".
-			writeSSEData(w, msg)
+			if event.Name != "" {
+				fmt.Fprintf(w, "event: %s\n", event.Name)
+			}
+			writeSSEData(w, event.Data)
 			flusher.Flush()
 		}
 	}
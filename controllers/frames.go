@@ -0,0 +1,338 @@
+package controllers
+
+// Endpoints to edit the frames of an animation scene one by one, or all at
+// once, without sending the whole scene back and forth. Frames are numbered
+// from 0. Every change stores the scene and redirects to its frames.
+
+import (
+	"encoding/json"
+	"fmt"
+	"image"
+	"image/png"
+	"net/http"
+	"strconv"
+
+	"github.com/timendus/pixelbox/models"
+)
+
+const maxOnionScale = 32
+
+// GET /scene/{id}/frames
+func frameList(res http.ResponseWriter, req *http.Request) {
+	scene, ok := findAnimation(res, req)
+	if !ok {
+		return
+	}
+	json.NewEncoder(res).Encode(scene.Animation.Frames)
+}
+
+// GET /scene/{id}/frames/{n}
+func getFrame(res http.ResponseWriter, req *http.Request) {
+	scene, ok := findAnimation(res, req)
+	if !ok {
+		return
+	}
+	index, ok := frameIndex(res, req, scene)
+	if !ok {
+		return
+	}
+	json.NewEncoder(res).Encode(scene.Animation.Frames[index])
+}
+
+// PUT /scene/{id}/frames?at=3
+//
+// Inserts the frame in the body before frame `at`, or at the end without it
+func insertFrame(res http.ResponseWriter, req *http.Request) {
+	var frame models.Frame
+	if !readFrame(res, req, &frame) {
+		return
+	}
+	editFrames(res, req, func(frames []models.Frame) ([]models.Frame, error) {
+		at := len(frames)
+		if value := req.URL.Query().Get("at"); value != "" {
+			var err error
+			if at, err = strconv.Atoi(value); err != nil {
+				return nil, fmt.Errorf("at should be a frame number")
+			}
+		}
+		return models.InsertFrame(frames, at, frame)
+	})
+}
+
+// PATCH /scene/{id}/frames/{n}
+//
+// Changes the frame to the `pixels` and `duration` in the body. Leave out the
+// pixels to only change the duration, or the other way around.
+func updateFrame(res http.ResponseWriter, req *http.Request) {
+	var change struct {
+		Duration *int  `json:"duration"`
+		Pixels   []int `json:"pixels"`
+	}
+	if !readFrame(res, req, &change) {
+		return
+	}
+	editFrameAt(res, req, func(frames []models.Frame, index int) ([]models.Frame, error) {
+		result := append([]models.Frame{}, frames...)
+		if change.Duration != nil {
+			result[index].Duration = *change.Duration
+		}
+		if change.Pixels != nil {
+			result[index].Pixels = change.Pixels
+		}
+		return result, nil
+	})
+}
+
+// DELETE /scene/{id}/frames/{n}
+func deleteFrame(res http.ResponseWriter, req *http.Request) {
+	editFrameAt(res, req, models.DeleteFrame)
+}
+
+// POST /scene/{id}/frames/{n}/duplicate
+func duplicateFrame(res http.ResponseWriter, req *http.Request) {
+	editFrameAt(res, req, models.DuplicateFrame)
+}
+
+// POST /scene/{id}/frames/{n}/move?to=0
+func moveFrame(res http.ResponseWriter, req *http.Request) {
+	editFrameAt(res, req, func(frames []models.Frame, index int) ([]models.Frame, error) {
+		to, err := strconv.Atoi(req.FormValue("to"))
+		if err != nil {
+			return nil, fmt.Errorf("to should be a frame number")
+		}
+		return models.MoveFrame(frames, index, to)
+	})
+}
+
+// POST /scene/{id}/frames/reverse
+func reverseFrames(res http.ResponseWriter, req *http.Request) {
+	editFrames(res, req, func(frames []models.Frame) ([]models.Frame, error) {
+		return models.ReverseFrames(frames), nil
+	})
+}
+
+// POST /scene/{id}/frames/pingpong
+func pingPongFrames(res http.ResponseWriter, req *http.Request) {
+	editFrames(res, req, func(frames []models.Frame) ([]models.Frame, error) {
+		return models.PingPong(frames), nil
+	})
+}
+
+// POST /scene/{id}/frames/speed?factor=2
+//
+// Plays the animation `factor` times as fast
+func scaleFrameSpeed(res http.ResponseWriter, req *http.Request) {
+	editFrames(res, req, func(frames []models.Frame) ([]models.Frame, error) {
+		factor, err := strconv.ParseFloat(req.FormValue("factor"), 64)
+		if err != nil {
+			return nil, fmt.Errorf("factor should be a number")
+		}
+		return models.ScaleSpeed(frames, factor)
+	})
+}
+
+// POST /scene/{id}/frames/shift?x=1&y=-2
+//
+// Moves the pixels of all frames to the right and down, wrapping around
+func shiftFrames(res http.ResponseWriter, req *http.Request) {
+	editFrames(res, req, func(frames []models.Frame) ([]models.Frame, error) {
+		x, err := intFormValue(req, "x", 0)
+		if err != nil {
+			return nil, err
+		}
+		y, err := intFormValue(req, "y", 0)
+		if err != nil {
+			return nil, err
+		}
+		return models.ShiftFrames(frames, x, y), nil
+	})
+}
+
+// POST /scene/{id}/frames/flip?direction=vertical
+//
+// Mirrors all frames, `horizontal` (left to right, the default) or `vertical`
+func flipFrames(res http.ResponseWriter, req *http.Request) {
+	editFrames(res, req, func(frames []models.Frame) ([]models.Frame, error) {
+		switch req.FormValue("direction") {
+		case "", "horizontal":
+			return models.FlipFrames(frames, false), nil
+		case "vertical":
+			return models.FlipFrames(frames, true), nil
+		default:
+			return nil, fmt.Errorf("direction should be either horizontal or vertical")
+		}
+	})
+}
+
+// POST /scene/{id}/frames/rotate?degrees=90
+//
+// Turns all frames clockwise
+func rotateFrames(res http.ResponseWriter, req *http.Request) {
+	editFrames(res, req, func(frames []models.Frame) ([]models.Frame, error) {
+		degrees, err := intFormValue(req, "degrees", 90)
+		if err != nil {
+			return nil, err
+		}
+		return models.RotateFrames(frames, degrees)
+	})
+}
+
+// GET /scene/{id}/frames/{n}/onion.png?before=1&after=1&scale=8
+//
+// Renders the frame on top of faded versions of the `before` frames before it
+// and the `after` frames after it, both 1 by default and 8 at most. The image
+// is 16x16 pixels, times `scale`.
+func onionSkin(res http.ResponseWriter, req *http.Request) {
+	scene, ok := findAnimation(res, req)
+	if !ok {
+		return
+	}
+	index, ok := frameIndex(res, req, scene)
+	if !ok {
+		return
+	}
+
+	before, err := intFormValue(req, "before", 1)
+	if err == nil && (before < 0 || before > models.MaxOnionDistance) {
+		err = fmt.Errorf("before should be between 0 and %d", models.MaxOnionDistance)
+	}
+	if err != nil {
+		http.Error(res, err.Error(), http.StatusBadRequest)
+		return
+	}
+	after, err := intFormValue(req, "after", 1)
+	if err == nil && (after < 0 || after > models.MaxOnionDistance) {
+		err = fmt.Errorf("after should be between 0 and %d", models.MaxOnionDistance)
+	}
+	if err != nil {
+		http.Error(res, err.Error(), http.StatusBadRequest)
+		return
+	}
+	scale, err := intFormValue(req, "scale", 1)
+	if err == nil && (scale < 1 || scale > maxOnionScale) {
+		err = fmt.Errorf("scale should be between 1 and %d", maxOnionScale)
+	}
+	if err != nil {
+		http.Error(res, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	preview, err := models.OnionSkin(scene.Animation.Frames, index, before, after)
+	if err != nil {
+		http.Error(res, err.Error(), http.StatusNotFound)
+		return
+	}
+
+	res.Header().Set("Content-Type", "image/png")
+	png.Encode(res, scaleUp(preview, scale))
+}
+
+/* Helpers */
+
+// findAnimation looks up the scene like findSceneByIdOrUUID, and refuses
+// scenes that aren't animations
+func findAnimation(res http.ResponseWriter, req *http.Request) (*models.Scene, bool) {
+	scene, ok := findSceneByIdOrUUID(res, req)
+	if !ok {
+		return nil, false
+	}
+	if scene.SceneType != "animation" {
+		http.Error(res, "only animation scenes have frames", http.StatusBadRequest)
+		return nil, false
+	}
+	return scene, true
+}
+
+func frameIndex(res http.ResponseWriter, req *http.Request, scene *models.Scene) (int, bool) {
+	index, err := strconv.Atoi(req.PathValue("n"))
+	if err != nil {
+		http.Error(res, "invalid frame number requested", http.StatusBadRequest)
+		return 0, false
+	}
+	if index < 0 || index >= len(scene.Animation.Frames) {
+		http.Error(res, "Could not find frame with given number", http.StatusNotFound)
+		return 0, false
+	}
+	return index, true
+}
+
+func readFrame(res http.ResponseWriter, req *http.Request, frame any) bool {
+	req.Body = http.MaxBytesReader(res, req.Body, 1<<20) // 1 MB
+	defer req.Body.Close()
+	if err := json.NewDecoder(req.Body).Decode(frame); err != nil {
+		http.Error(res, "invalid JSON: "+err.Error(), http.StatusBadRequest)
+		return false
+	}
+	return true
+}
+
+// editFrames replaces the frames of the animation scene with the result of
+// edit, and stores the scene
+func editFrames(res http.ResponseWriter, req *http.Request, edit func([]models.Frame) ([]models.Frame, error)) {
+	scene, ok := findAnimation(res, req)
+	if !ok || !checkIfMatch(res, req, scene) {
+		return
+	}
+	frames, err := edit(scene.Animation.Frames)
+	if err != nil {
+		http.Error(res, "could not edit frames: "+err.Error(), http.StatusBadRequest)
+		return
+	}
+	edited, err := scene.WithFrames(frames)
+	if err != nil {
+		http.Error(res, "could not edit frames: "+err.Error(), http.StatusConflict)
+		return
+	}
+
+	_, err = models.Scenes.Update(scene, edited)
+	if isInvalid(res, err) || isConflict(res, err) {
+		return
+	}
+	if err != nil {
+		http.Error(res, "Could not update model", http.StatusInternalServerError)
+		return
+	}
+	http.Redirect(res, req, "/scene/"+scene.Uuid.String()+"/frames", http.StatusSeeOther)
+}
+
+// editFrameAt is editFrames for edits of the frame in the path
+func editFrameAt(res http.ResponseWriter, req *http.Request, edit func([]models.Frame, int) ([]models.Frame, error)) {
+	index, err := strconv.Atoi(req.PathValue("n"))
+	if err != nil {
+		http.Error(res, "invalid frame number requested", http.StatusBadRequest)
+		return
+	}
+	editFrames(res, req, func(frames []models.Frame) ([]models.Frame, error) {
+		if index < 0 || index >= len(frames) {
+			return nil, fmt.Errorf("frame %d doesn't exist, the animation has %d frames", index, len(frames))
+		}
+		return edit(frames, index)
+	})
+}
+
+func intFormValue(req *http.Request, name string, fallback int) (int, error) {
+	value := req.FormValue(name)
+	if value == "" {
+		return fallback, nil
+	}
+	number, err := strconv.Atoi(value)
+	if err != nil {
+		return 0, fmt.Errorf("%s should be a whole number", name)
+	}
+	return number, nil
+}
+
+// scaleUp makes every pixel of the image a square of scale by scale pixels
+func scaleUp(img *image.RGBA, scale int) *image.RGBA {
+	if scale == 1 {
+		return img
+	}
+	bounds := img.Bounds()
+	result := image.NewRGBA(image.Rect(0, 0, bounds.Dx()*scale, bounds.Dy()*scale))
+	for y := 0; y < result.Rect.Dy(); y++ {
+		for x := 0; x < result.Rect.Dx(); x++ {
+			result.SetRGBA(x, y, img.RGBAAt(bounds.Min.X+x/scale, bounds.Min.Y+y/scale))
+		}
+	}
+	return result
+}
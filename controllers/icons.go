@@ -0,0 +1,61 @@
+package controllers
+
+import (
+	"encoding/json"
+	"log"
+	"net/http"
+
+	"github.com/timendus/pixelbox/graphics"
+	"github.com/timendus/pixelbox/models"
+	"github.com/timendus/pixelbox/protocol"
+	"github.com/timendus/pixelbox/server"
+)
+
+func init() {
+	router := http.NewServeMux()
+	router.HandleFunc("GET /", iconList)
+	server.RegisterRouter("/icons", router)
+}
+
+func iconList(res http.ResponseWriter, req *http.Request) {
+	json.NewEncoder(res).Encode(graphics.AllIcons())
+}
+
+// POST /apply/icon/{name}
+//
+// Shows an icon from the library. The optional `color` parameter recolors the
+// icon, the optional `background` parameter sets the color of the transparent
+// parts (default black). Both are hex colors like `#FF0000`, and can be passed
+// as query parameters or form fields.
+func showIcon(res http.ResponseWriter, req *http.Request) {
+	icon, err := graphics.FindIcon(req.PathValue("name"))
+	if err != nil {
+		http.Error(res, err.Error(), http.StatusNotFound)
+		return
+	}
+
+	if color := req.FormValue("color"); color != "" {
+		icon = icon.Recolor(graphics.ParseColor(color))
+	}
+	icon = icon.WithBackground(graphics.ParseColor(req.FormValue("background")))
+
+	var message []byte
+	if icon.Animated {
+		message, _, err = protocol.FitAnimation(icon.Frames, icon.Durations, models.AnimationBudget.Get())
+	} else {
+		message, err = protocol.ShowImage(icon.Frames[0])
+	}
+	if err != nil {
+		log.Println("could not show icon:", err)
+		res.WriteHeader(http.StatusInternalServerError)
+		return
+	}
+
+	err = display.show(nil, message)
+	if err != nil {
+		http.Error(res, "could not show icon: "+err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	res.WriteHeader(http.StatusOK)
+}
@@ -0,0 +1,290 @@
+package controllers
+
+// Notifications temporarily take over the display. They are queued and shown
+// one after the other, highest priority first and in order of arrival within
+// the same priority. Once the queue is empty, whatever was showing before the
+// notifications is shown again.
+
+import (
+	"bytes"
+	"container/heap"
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"image"
+	"log"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+	"unicode/utf8"
+
+	"github.com/timendus/pixelbox/graphics"
+	"github.com/timendus/pixelbox/models"
+	"github.com/timendus/pixelbox/server"
+)
+
+func init() {
+	router := http.NewServeMux()
+	router.HandleFunc("POST /", notify)
+	router.HandleFunc("GET /", notificationList)
+	router.HandleFunc("DELETE /", clearNotifications)
+	server.RegisterRouter("/notify", router)
+}
+
+type Notification struct {
+	Id        int    `json:"id"`
+	Icon      string `json:"icon"`
+	IconColor string `json:"iconColor"`
+	Image     string `json:"image,omitempty"` // Base64 encoded image file
+	Text      string `json:"text"`
+	Color     string `json:"color"`
+	Duration  int    `json:"duration"` // Milliseconds
+	Priority  int    `json:"priority"`
+	Repeat    int    `json:"repeat"`
+
+	message []byte
+}
+
+const (
+	defaultNotificationDuration = 5000
+	maxNotificationDuration     = 60 * 1000
+	maxNotificationRepeat       = 10
+	notificationRepeatGap       = 300 * time.Millisecond
+)
+
+// POST /notify
+func notify(res http.ResponseWriter, req *http.Request) {
+	req.Body = http.MaxBytesReader(res, req.Body, 64<<10) // 64 KB
+	defer req.Body.Close()
+
+	var notification Notification
+	if err := json.NewDecoder(req.Body).Decode(&notification); err != nil {
+		http.Error(res, "invalid JSON: "+err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	if notification.Duration <= 0 {
+		notification.Duration = defaultNotificationDuration
+	}
+	if notification.Repeat <= 0 {
+		notification.Repeat = 1
+	}
+	// A notification holds the display, so don't let one hold it for hours
+	if notification.Duration > maxNotificationDuration {
+		http.Error(res, fmt.Sprintf("duration should be at most %d milliseconds", maxNotificationDuration), http.StatusUnprocessableEntity)
+		return
+	}
+	if notification.Repeat > maxNotificationRepeat {
+		http.Error(res, fmt.Sprintf("repeat should be at most %d", maxNotificationRepeat), http.StatusUnprocessableEntity)
+		return
+	}
+	if utf8.RuneCountInString(notification.Text) > models.MaxTextLength {
+		http.Error(res, fmt.Sprintf("text should be at most %d characters", models.MaxTextLength), http.StatusUnprocessableEntity)
+		return
+	}
+
+	composite, err := notification.toComposite()
+	if err != nil {
+		http.Error(res, err.Error(), http.StatusBadRequest)
+		return
+	}
+	notification.message, err = composite.ToMessage()
+	if err != nil {
+		http.Error(res, "could not create message from notification: "+err.Error(), http.StatusBadRequest)
+		return
+	}
+	notification.Image = ""
+
+	notifications.push(&notification)
+	json.NewEncoder(res).Encode(notification)
+}
+
+// GET /notify
+func notificationList(res http.ResponseWriter, req *http.Request) {
+	json.NewEncoder(res).Encode(notifications.list())
+}
+
+// DELETE /notify
+func clearNotifications(res http.ResponseWriter, req *http.Request) {
+	notifications.clear()
+	res.WriteHeader(http.StatusOK)
+}
+
+// toComposite lays out the notification. An icon or image fills the display,
+// text goes at the bottom on a darkened band, scrolling if it's too long. If
+// there's only text, it is centered vertically.
+func (notification *Notification) toComposite() (*models.Composite, error) {
+	composite := models.Composite{}
+	hasPicture := notification.Icon != "" || notification.Image != ""
+
+	switch {
+	case notification.Image != "":
+		img, err := decodeBase64Image(notification.Image)
+		if err != nil {
+			return nil, err
+		}
+		composite.Layers = append(composite.Layers, models.Layer{
+			LType: "image",
+			Image: models.Image{Pixels: models.PixelsFromRGBA(graphics.ToScaledRGBA(img))},
+		})
+	case notification.Icon != "":
+		composite.Layers = append(composite.Layers, models.Layer{
+			LType: "icon",
+			Icon:  models.LayerIcon{Name: notification.Icon, Color: notification.IconColor},
+		})
+	}
+
+	if notification.Text != "" {
+		y := 5
+		if hasPicture {
+			opacity := 0.7
+			composite.Layers = append(composite.Layers, models.Layer{
+				LType:   "progress",
+				Y:       10,
+				Opacity: &opacity,
+				Progress: models.Progress{
+					Value:  100,
+					Height: 6,
+					Color:  "#000000",
+				},
+			})
+			y = 11
+		}
+		composite.Layers = append(composite.Layers, models.Layer{
+			LType: "text",
+			X:     1,
+			Y:     y,
+			Text: models.Text{
+				Text:   notification.Text,
+				Color:  notification.Color,
+				Scroll: true,
+			},
+		})
+	}
+
+	if len(composite.Layers) == 0 {
+		return nil, fmt.Errorf("a notification needs an icon, an image or text")
+	}
+	return &composite, nil
+}
+
+func decodeBase64Image(data string) (image.Image, error) {
+	// Allow data URLs too
+	if _, encoded, found := strings.Cut(data, ";base64,"); found {
+		data = encoded
+	}
+	raw, err := base64.StdEncoding.DecodeString(data)
+	if err != nil {
+		return nil, fmt.Errorf("image should be base64 encoded: %w", err)
+	}
+	img, _, err := image.Decode(bytes.NewReader(raw))
+	if err != nil {
+		return nil, fmt.Errorf("invalid image: %w", err)
+	}
+	return img, nil
+}
+
+/* The notification queue */
+
+type notificationQueue struct {
+	mu      sync.Mutex
+	items   notificationHeap
+	nextId  int
+	running bool
+}
+
+var notifications notificationQueue
+
+func (q *notificationQueue) push(notification *Notification) {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	q.nextId++
+	notification.Id = q.nextId
+	heap.Push(&q.items, notification)
+	if !q.running {
+		q.running = true
+		go q.run()
+	}
+}
+
+func (q *notificationQueue) pop() *Notification {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	if len(q.items) == 0 {
+		q.running = false
+		return nil
+	}
+	return heap.Pop(&q.items).(*Notification)
+}
+
+func (q *notificationQueue) list() []Notification {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	sorted := append(notificationHeap{}, q.items...)
+	result := make([]Notification, 0, len(sorted))
+	for len(sorted) > 0 {
+		result = append(result, *heap.Pop(&sorted).(*Notification))
+	}
+	return result
+}
+
+func (q *notificationQueue) clear() {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	q.items = nil
+}
+
+// run shows notifications until the queue is empty, then hands the display back
+func (q *notificationQueue) run() {
+	display.begin()
+	for {
+		notification := q.pop()
+		if notification == nil {
+			break
+		}
+		for i := 0; i < notification.Repeat; i++ {
+			if i > 0 {
+				if err := send(blankMessage()); err != nil {
+					log.Println("could not show notification:", err)
+					break
+				}
+				time.Sleep(notificationRepeatGap)
+			}
+			if err := send(notification.message); err != nil {
+				log.Println("could not show notification:", err)
+				break
+			}
+			time.Sleep(time.Duration(notification.Duration) * time.Millisecond)
+		}
+	}
+
+	if err := display.end(); err != nil {
+		log.Println("could not restore display after notifications:", err)
+	}
+}
+
+func blankMessage() []byte {
+	composite := models.Composite{}
+	message, _ := composite.ToMessage()
+	return message
+}
+
+// A priority queue of notifications, as described in the `container/heap` docs
+type notificationHeap []*Notification
+
+func (h notificationHeap) Len() int { return len(h) }
+func (h notificationHeap) Less(i, j int) bool {
+	if h[i].Priority != h[j].Priority {
+		return h[i].Priority > h[j].Priority
+	}
+	return h[i].Id < h[j].Id
+}
+func (h notificationHeap) Swap(i, j int) { h[i], h[j] = h[j], h[i] }
+func (h *notificationHeap) Push(x any)   { *h = append(*h, x.(*Notification)) }
+func (h *notificationHeap) Pop() any {
+	old := *h
+	item := old[len(old)-1]
+	*h = old[:len(old)-1]
+	return item
+}
@@ -0,0 +1,261 @@
+package controllers
+
+// The player shows the entries of a playlist one after the other. It fetches
+// the playlist again for every entry, so changes to a playing playlist are
+// picked up right away. Showing anything else by hand pauses the player, and
+// resuming shows the current entry again from the start.
+
+import (
+	"encoding/json"
+	"fmt"
+	"log"
+	"net/http"
+	"sync"
+	"time"
+
+	"github.com/google/uuid"
+	"github.com/timendus/pixelbox/models"
+	"github.com/timendus/pixelbox/server"
+)
+
+func init() {
+	router := http.NewServeMux()
+	router.HandleFunc("GET /", playerStatus)
+	router.HandleFunc("POST /stop", stopPlayer)
+	router.HandleFunc("POST /pause", pausePlayer)
+	router.HandleFunc("POST /resume", resumePlayer)
+	router.HandleFunc("POST /skip", skipEntry)
+	server.RegisterRouter("/player", router)
+}
+
+const (
+	playerStopped = "stopped"
+	playerPlaying = "playing"
+	playerPaused  = "paused"
+)
+
+type playlistPlayer struct {
+	mu        sync.Mutex
+	state     string
+	playlist  uuid.UUID
+	index     int
+	entry     models.PlaylistEntry
+	until     time.Time     // When the current entry ends, while playing
+	remaining time.Duration // Time left for the current entry, while paused
+
+	// Every run of the player gets its own generation, so a timer that fires
+	// after the player was stopped or restarted can tell it's out of date
+	generation int
+	stop       chan struct{}
+}
+
+var player = playlistPlayer{state: playerStopped}
+
+// PlayerStatus is what the player endpoints return
+type PlayerStatus struct {
+	State     string                `json:"state"`
+	Playlist  *models.Playlist      `json:"playlist,omitempty"`
+	Index     int                   `json:"index"`
+	Entry     *models.PlaylistEntry `json:"entry,omitempty"`
+	Remaining int                   `json:"remaining"` // Milliseconds
+}
+
+// start plays the playlist from its first entry
+func (p *playlistPlayer) start(playlist *models.Playlist) error {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	p.playlist = playlist.Uuid
+	p.index = -1
+	return p.play(true)
+}
+
+// pause stops the player, but remembers where it was
+func (p *playlistPlayer) pause() {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	if p.state != playerPlaying {
+		return
+	}
+	p.halt(playerPaused)
+	p.remaining = max(time.Until(p.until), 0)
+}
+
+// resume continues playing after a pause, showing the current entry again
+func (p *playlistPlayer) resume() error {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	if p.state != playerPaused {
+		return fmt.Errorf("the player is not paused")
+	}
+	return p.play(false)
+}
+
+// skip moves on to the next entry right away
+func (p *playlistPlayer) skip() error {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	if p.state == playerStopped {
+		return fmt.Errorf("the player is not playing")
+	}
+	return p.play(true)
+}
+
+func (p *playlistPlayer) stopPlaying() {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	p.halt(playerStopped)
+}
+
+func (p *playlistPlayer) status() PlayerStatus {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	status := PlayerStatus{State: p.state, Index: p.index}
+	if p.state == playerStopped {
+		return status
+	}
+	if playlist, err := models.Playlists.Find(p.playlist.String()); err == nil {
+		status.Playlist = playlist
+	}
+	entry := p.entry
+	status.Entry = &entry
+	switch p.state {
+	case playerPlaying:
+		status.Remaining = int(max(time.Until(p.until), 0).Milliseconds())
+	case playerPaused:
+		status.Remaining = int(p.remaining.Milliseconds())
+	}
+	return status
+}
+
+// halt stops the timer of the current run, if any, and puts the player in the
+// given state. The caller should hold the lock.
+func (p *playlistPlayer) halt(state string) {
+	p.generation++
+	if p.stop != nil {
+		close(p.stop)
+		p.stop = nil
+	}
+	p.state = state
+}
+
+// play shows an entry and starts a timer for the entries after it. With
+// advance set it shows the next entry, otherwise the current one. The caller
+// should hold the lock.
+func (p *playlistPlayer) play(advance bool) error {
+	p.halt(playerPlaying)
+	duration, err := p.show(advance)
+	if err != nil {
+		p.halt(playerStopped)
+		return err
+	}
+	p.stop = make(chan struct{})
+	go p.wait(p.generation, duration, p.stop)
+	return nil
+}
+
+func (p *playlistPlayer) wait(generation int, duration time.Duration, stop chan struct{}) {
+	for {
+		select {
+		case <-time.After(duration):
+		case <-stop:
+			return
+		}
+
+		p.mu.Lock()
+		if p.generation != generation {
+			p.mu.Unlock()
+			return
+		}
+		var err error
+		duration, err = p.show(true)
+		if err != nil {
+			log.Println("playlist:", err)
+			p.halt(playerStopped)
+			p.mu.Unlock()
+			return
+		}
+		p.mu.Unlock()
+	}
+}
+
+// show shows the next or the current entry and returns how long it should be
+// shown. Entries with scenes that can't be shown are skipped. The caller
+// should hold the lock, so a manual apply can't slip in between deciding to
+// show the entry and showing it.
+func (p *playlistPlayer) show(advance bool) (time.Duration, error) {
+	playlist, err := models.Playlists.Find(p.playlist.String())
+	if err != nil {
+		return 0, fmt.Errorf("the playlist no longer exists")
+	}
+	if len(playlist.Entries) == 0 {
+		return 0, fmt.Errorf("the playlist is empty")
+	}
+
+	for range playlist.Entries {
+		if advance || p.index < 0 || p.index >= len(playlist.Entries) {
+			p.index = playlist.Next(p.index)
+		}
+		advance = true
+		p.entry = playlist.Entries[p.index]
+
+		scene, err := models.Scenes.Find(p.entry.Scene)
+		if err != nil {
+			log.Printf("playlist: skipping entry %d, could not find scene %q\n", p.index, p.entry.Scene)
+			continue
+		}
+		if scene.SceneType == "sequence" {
+			sequencer.start(scene)
+		} else {
+			message, err := scene.GetMessage()
+			if err != nil {
+				log.Printf("playlist: skipping entry %d, could not create message from scene: %s\n", p.index, err)
+				continue
+			}
+			sequencer.cancel()
+			if err := display.present(scene, message); err != nil {
+				// Keep going, the device may come back
+				log.Println("playlist: could not show scene:", err)
+			}
+		}
+
+		duration := time.Duration(p.entry.Duration) * time.Millisecond
+		p.until = time.Now().Add(duration)
+		return duration, nil
+	}
+	return 0, fmt.Errorf("none of the scenes in the playlist can be shown")
+}
+
+// GET /player
+func playerStatus(res http.ResponseWriter, req *http.Request) {
+	json.NewEncoder(res).Encode(player.status())
+}
+
+// POST /player/stop
+func stopPlayer(res http.ResponseWriter, req *http.Request) {
+	player.stopPlaying()
+	json.NewEncoder(res).Encode(player.status())
+}
+
+// POST /player/pause
+func pausePlayer(res http.ResponseWriter, req *http.Request) {
+	player.pause()
+	json.NewEncoder(res).Encode(player.status())
+}
+
+// POST /player/resume
+func resumePlayer(res http.ResponseWriter, req *http.Request) {
+	if err := player.resume(); err != nil {
+		http.Error(res, err.Error(), http.StatusConflict)
+		return
+	}
+	json.NewEncoder(res).Encode(player.status())
+}
+
+// POST /player/skip
+func skipEntry(res http.ResponseWriter, req *http.Request) {
+	if err := player.skip(); err != nil {
+		http.Error(res, err.Error(), http.StatusConflict)
+		return
+	}
+	json.NewEncoder(res).Encode(player.status())
+}
@@ -0,0 +1,120 @@
+package controllers
+
+import (
+	"encoding/json"
+	"net/http"
+
+	"github.com/timendus/pixelbox/models"
+	"github.com/timendus/pixelbox/server"
+)
+
+func init() {
+	router := http.NewServeMux()
+	router.HandleFunc("GET /", playlistList)
+	router.HandleFunc("PUT /", newPlaylist)
+	router.HandleFunc("GET /{id}", getPlaylist)
+	router.HandleFunc("POST /{id}", updatePlaylist)
+	router.HandleFunc("DELETE /{id}", deletePlaylist)
+	router.HandleFunc("POST /{id}/start", startPlaylist)
+	server.RegisterRouter("/playlist", router)
+}
+
+func playlistList(res http.ResponseWriter, req *http.Request) {
+	json.NewEncoder(res).Encode(models.Playlists.All())
+}
+
+func newPlaylist(res http.ResponseWriter, req *http.Request) {
+	playlist, ok := decodePlaylist(res, req)
+	if !ok {
+		return
+	}
+	err := models.Playlists.Create(playlist)
+	if isInvalid(res, err) {
+		return
+	}
+	if err != nil {
+		http.Error(res, "could not create playlist: "+err.Error(), http.StatusInternalServerError)
+		return
+	}
+	http.Redirect(res, req, "/playlist/"+playlist.Uuid.String(), http.StatusSeeOther)
+}
+
+func getPlaylist(res http.ResponseWriter, req *http.Request) {
+	playlist, ok := findPlaylist(res, req)
+	if !ok {
+		return
+	}
+	json.NewEncoder(res).Encode(playlist)
+}
+
+func updatePlaylist(res http.ResponseWriter, req *http.Request) {
+	playlist, ok := findPlaylist(res, req)
+	if !ok {
+		return
+	}
+	newPlaylist, ok := decodePlaylist(res, req)
+	if !ok {
+		return
+	}
+	_, err := models.Playlists.Update(playlist, newPlaylist)
+	if isInvalid(res, err) {
+		return
+	}
+	if err != nil {
+		http.Error(res, "could not update playlist: "+err.Error(), http.StatusInternalServerError)
+		return
+	}
+	http.Redirect(res, req, "/playlist/", http.StatusSeeOther)
+}
+
+func deletePlaylist(res http.ResponseWriter, req *http.Request) {
+	playlist, ok := findPlaylist(res, req)
+	if !ok {
+		return
+	}
+	if err := models.Playlists.Delete(playlist); err != nil {
+		http.Error(res, "could not delete playlist: "+err.Error(), http.StatusInternalServerError)
+		return
+	}
+	http.Redirect(res, req, "/playlist/", http.StatusSeeOther)
+}
+
+// POST /playlist/{id}/start
+//
+// Starts playing the playlist from its first entry, replacing whatever the
+// player was doing. Use the `/player` endpoints to control it after that.
+func startPlaylist(res http.ResponseWriter, req *http.Request) {
+	playlist, ok := findPlaylist(res, req)
+	if !ok {
+		return
+	}
+	if err := player.start(playlist); err != nil {
+		http.Error(res, "could not start playlist: "+err.Error(), http.StatusConflict)
+		return
+	}
+	json.NewEncoder(res).Encode(player.status())
+}
+
+// findPlaylist looks up the playlist in the `id` path value, which can be either
+// the human readable ID or the UUID of the playlist. If the playlist can't be
+// found, an error is written to the response.
+func findPlaylist(res http.ResponseWriter, req *http.Request) (*models.Playlist, bool) {
+	playlist, err := models.Playlists.Find(req.PathValue("id"))
+	if err != nil {
+		http.Error(res, "Could not find playlist with given ID", http.StatusNotFound)
+		return nil, false
+	}
+	return playlist, true
+}
+
+func decodePlaylist(res http.ResponseWriter, req *http.Request) (*models.Playlist, bool) {
+	req.Body = http.MaxBytesReader(res, req.Body, 1<<20) // 1 MB
+	defer req.Body.Close()
+
+	var playlist models.Playlist
+	if err := json.NewDecoder(req.Body).Decode(&playlist); err != nil {
+		http.Error(res, "invalid JSON: "+err.Error(), http.StatusBadRequest)
+		return nil, false
+	}
+	return &playlist, true
+}
@@ -0,0 +1,53 @@
+package controllers
+
+// The reloader polls the scene files and config.json for changes made on disk,
+// like a deployment from git, and applies them without a restart. Changes that
+// are refused are logged and announced as `reload` events, so they don't go
+// unnoticed.
+
+import (
+	"encoding/json"
+	"log"
+	"time"
+
+	"github.com/timendus/pixelbox/models"
+	"github.com/timendus/pixelbox/server"
+)
+
+const reloadInterval = 2 * time.Second
+
+// StartReloader starts watching the scene files and config.json in the
+// background
+func StartReloader() {
+	go func() {
+		for range time.Tick(reloadInterval) {
+			reloadFiles()
+		}
+	}()
+}
+
+func reloadFiles() {
+	for _, report := range models.Scenes.Reload() {
+		announceReload(report)
+	}
+
+	changed, err := server.ReloadConfig()
+	switch {
+	case err != nil:
+		announceReload(models.ReloadReport{File: "config.json", Change: "rejected", Error: err.Error()})
+	case changed:
+		announceReload(models.ReloadReport{File: "config.json", Change: "updated"})
+	}
+}
+
+// announceReload logs what happened to a file that changed, and sends it as a
+// `reload` event. Scene changes are announced as `scene` events too.
+func announceReload(report models.ReloadReport) {
+	if report.Error != "" {
+		log.Printf("Refused the changes to %s: %s\n", report.File, report.Error)
+	} else {
+		log.Printf("Reloaded %s: %s\n", report.File, report.Change)
+	}
+	data, _ := json.Marshal(report)
+	Events.BroadcastEvent("reload", string(data))
+}
@@ -0,0 +1,133 @@
+package controllers
+
+import (
+	"encoding/json"
+	"net/http"
+	"strconv"
+
+	"github.com/google/uuid"
+	"github.com/timendus/pixelbox/models"
+)
+
+// GET /scene/{id}/revisions
+//
+// Lists the earlier versions of the scene, newest first
+func revisionList(res http.ResponseWriter, req *http.Request) {
+	scene, ok := findSceneByIdOrUUID(res, req)
+	if !ok {
+		return
+	}
+	revisions, err := models.Scenes.Revisions(scene)
+	if err != nil {
+		http.Error(res, "could not read revisions: "+err.Error(), http.StatusInternalServerError)
+		return
+	}
+	json.NewEncoder(res).Encode(revisions)
+}
+
+// GET /scene/{id}/revisions/{rev}
+func getRevision(res http.ResponseWriter, req *http.Request) {
+	_, revision, ok := findRevision(res, req)
+	if !ok {
+		return
+	}
+	json.NewEncoder(res).Encode(revision)
+}
+
+// GET /scene/{id}/revisions/{rev}/apply
+//
+// Shows an earlier version of the scene on the device, without restoring it
+func applyRevision(res http.ResponseWriter, req *http.Request) {
+	_, revision, ok := findRevision(res, req)
+	if !ok {
+		return
+	}
+	if err := showScene(revision); err != nil {
+		http.Error(res, "could not apply scene: "+err.Error(), http.StatusInternalServerError)
+		return
+	}
+	res.WriteHeader(http.StatusOK)
+}
+
+// POST /scene/{id}/revisions/{rev}/restore
+//
+// Makes an earlier version the current version of the scene. The version it
+// replaces becomes a new revision.
+func restoreRevision(res http.ResponseWriter, req *http.Request) {
+	scene, revision, ok := findRevision(res, req)
+	if !ok || !checkIfMatch(res, req, scene) {
+		return
+	}
+	_, err := models.Scenes.Update(scene, revision)
+	if isInvalid(res, err) || isConflict(res, err) {
+		return
+	}
+	if err != nil {
+		http.Error(res, "could not restore revision: "+err.Error(), http.StatusInternalServerError)
+		return
+	}
+	http.Redirect(res, req, "/scene/"+scene.Uuid.String(), http.StatusSeeOther)
+}
+
+func findRevision(res http.ResponseWriter, req *http.Request) (*models.Scene, *models.Scene, bool) {
+	scene, ok := findSceneByIdOrUUID(res, req)
+	if !ok {
+		return nil, nil, false
+	}
+	number, err := strconv.Atoi(req.PathValue("rev"))
+	if err != nil {
+		http.Error(res, "invalid revision requested", http.StatusBadRequest)
+		return nil, nil, false
+	}
+	revision, err := models.Scenes.Revision(scene, number)
+	if err != nil {
+		http.Error(res, "Could not find revision: "+err.Error(), http.StatusNotFound)
+		return nil, nil, false
+	}
+	return scene, revision, true
+}
+
+/* The trash */
+
+// GET /scene/trash
+//
+// Lists the deleted scenes, most recently deleted first
+func trashList(res http.ResponseWriter, req *http.Request) {
+	scenes, err := models.Scenes.Trash()
+	if err != nil {
+		http.Error(res, "could not read the trash: "+err.Error(), http.StatusInternalServerError)
+		return
+	}
+	json.NewEncoder(res).Encode(scenes)
+}
+
+// POST /scene/trash/{id}/restore
+func restoreFromTrash(res http.ResponseWriter, req *http.Request) {
+	id, err := uuid.Parse(req.PathValue("id"))
+	if err != nil {
+		http.Error(res, "invalid ID requested", http.StatusBadRequest)
+		return
+	}
+	scene, err := models.Scenes.RestoreFromTrash(id)
+	if err != nil {
+		http.Error(res, "could not restore scene: "+err.Error(), http.StatusNotFound)
+		return
+	}
+	http.Redirect(res, req, "/scene/"+scene.Uuid.String(), http.StatusSeeOther)
+}
+
+// DELETE /scene/trash/{id}
+//
+// Removes a deleted scene and its revisions for good
+func purgeScene(res http.ResponseWriter, req *http.Request) {
+	id, err := uuid.Parse(req.PathValue("id"))
+	if err != nil {
+		http.Error(res, "invalid ID requested", http.StatusBadRequest)
+		return
+	}
+	if err := models.Scenes.Purge(id); err != nil {
+		http.Error(res, "could not purge scene: "+err.Error(), http.StatusNotFound)
+		return
+	}
+	http.Redirect(res, req, "/scene/trash", http.StatusSeeOther)
+}
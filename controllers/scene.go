@@ -1,35 +1,148 @@
 package controllers
 
 import (
+	"bytes"
 	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"mime"
 	"net/http"
+	"strconv"
+	"strings"
 
 	"github.com/google/uuid"
 	"github.com/timendus/pixelbox/models"
 	"github.com/timendus/pixelbox/server"
 )
 
+const (
+	defaultPageSize = 50
+	maxPageSize     = 500
+
+	// Query parameters that override a setting when applying a scene start
+	// with this
+	overridePrefix = "set."
+)
+
 func init() {
 	router := http.NewServeMux()
 	router.HandleFunc("GET /", sceneList)
+	router.HandleFunc("GET /list", sceneQuery)
 	router.HandleFunc("PUT /", newScene)
 	router.HandleFunc("GET /{id}", getScene)
 	router.HandleFunc("DELETE /{id}", deleteScene)
 	router.HandleFunc("POST /{id}", updateScene)
+	router.HandleFunc("PATCH /{id}", patchScene)
 	router.HandleFunc("GET /{id}/apply", applyScene)
+	router.HandleFunc("POST /{id}/apply", applyScene)
+	router.HandleFunc("GET /{id}/revisions", revisionList)
+	router.HandleFunc("GET /{id}/revisions/{rev}", getRevision)
+	router.HandleFunc("GET /{id}/revisions/{rev}/apply", applyRevision)
+	router.HandleFunc("POST /{id}/revisions/{rev}/restore", restoreRevision)
+	router.HandleFunc("GET /trash", trashList)
+	router.HandleFunc("POST /trash/{id}/restore", restoreFromTrash)
+	router.HandleFunc("DELETE /trash/{id}", purgeScene)
+	router.HandleFunc("GET /export", exportScenes)
+	router.HandleFunc("POST /import", importScenes)
+	router.HandleFunc("POST /import/spritesheet", importSpriteSheet)
+	router.HandleFunc("GET /{id}/spritesheet.png", exportSpriteSheet)
+	router.HandleFunc("GET /{id}/frames", frameList)
+	router.HandleFunc("PUT /{id}/frames", insertFrame)
+	router.HandleFunc("GET /{id}/frames/{n}", getFrame)
+	router.HandleFunc("PATCH /{id}/frames/{n}", updateFrame)
+	router.HandleFunc("DELETE /{id}/frames/{n}", deleteFrame)
+	router.HandleFunc("POST /{id}/frames/{n}/duplicate", duplicateFrame)
+	router.HandleFunc("POST /{id}/frames/{n}/move", moveFrame)
+	router.HandleFunc("GET /{id}/frames/{n}/onion.png", onionSkin)
+	router.HandleFunc("POST /{id}/frames/reverse", reverseFrames)
+	router.HandleFunc("POST /{id}/frames/pingpong", pingPongFrames)
+	router.HandleFunc("POST /{id}/frames/speed", scaleFrameSpeed)
+	router.HandleFunc("POST /{id}/frames/shift", shiftFrames)
+	router.HandleFunc("POST /{id}/frames/flip", flipFrames)
+	router.HandleFunc("POST /{id}/frames/rotate", rotateFrames)
 	server.RegisterRouter("/scene", router)
 }
 
+// GET /scene/
+//
+// Lists all scenes, each with its `etag`
 func sceneList(res http.ResponseWriter, req *http.Request) {
-	scenes := models.AllScenes()
-	json.NewEncoder(res).Encode(scenes)
+	scenes := models.Scenes.All()
+	result := make([]map[string]json.RawMessage, 0, len(scenes))
+	for _, scene := range scenes {
+		// Scene has its own MarshalJSON for the bindings, so we can't embed it
+		// in a struct with the ETag. Add the ETag to its members instead.
+		data, err := json.Marshal(scene)
+		var members map[string]json.RawMessage
+		if err == nil {
+			err = json.Unmarshal(data, &members)
+		}
+		if err != nil {
+			http.Error(res, "could not encode scene: "+err.Error(), http.StatusInternalServerError)
+			return
+		}
+		members["etag"], _ = json.Marshal(scene.ETag())
+		result = append(result, members)
+	}
+	json.NewEncoder(res).Encode(result)
+}
+
+// GET /scene/list?type=clock&tag=kitchen&folder=holidays&q=xmas&sort=-name&offset=0&limit=50
+//
+// Lists summaries of the scenes, filtered by type, tags (all of them, the
+// parameter can be repeated), folder (including subfolders) and a search in the
+// name and ID. Sorted by `name`, `id`, `type` or `folder`, with a `-` in front
+// to reverse the order. Returns at most `limit` scenes, starting at `offset`.
+func sceneQuery(res http.ResponseWriter, req *http.Request) {
+	params := req.URL.Query()
+	query := models.SceneQuery{
+		Type:   params.Get("type"),
+		Tags:   params["tag"],
+		Folder: strings.Trim(params.Get("folder"), "/"),
+		Search: params.Get("q"),
+		Sort:   params.Get("sort"),
+		Limit:  defaultPageSize,
+	}
+	var err error
+	if offset := params.Get("offset"); offset != "" {
+		if query.Offset, err = strconv.Atoi(offset); err != nil {
+			http.Error(res, "invalid offset", http.StatusBadRequest)
+			return
+		}
+	}
+	if limit := params.Get("limit"); limit != "" {
+		if query.Limit, err = strconv.Atoi(limit); err != nil || query.Limit > maxPageSize {
+			http.Error(res, fmt.Sprintf("invalid limit, the maximum is %d", maxPageSize), http.StatusBadRequest)
+			return
+		}
+	}
+
+	result, err := models.Scenes.Query(query)
+	if err != nil {
+		http.Error(res, err.Error(), http.StatusBadRequest)
+		return
+	}
+	json.NewEncoder(res).Encode(result)
 }
 
 func newScene(res http.ResponseWriter, req *http.Request) {
+	scene := defaultScene()
+	err := models.Scenes.Create(&scene)
+	if err != nil {
+		http.Error(res, "invalid JSON: "+err.Error(), http.StatusBadRequest)
+		return
+	}
+	http.Redirect(res, req, "/scene/", http.StatusSeeOther)
+}
+
+// defaultScene returns a scene with sensible defaults for every scene type, so
+// switching types in the user interface always gives something to work with.
+func defaultScene() models.Scene {
 	brightness := 100
 	volume := 16
 	temperature := 20
-	scene := models.Scene{
+	return models.Scene{
 		Name:       "New Scene",
 		Id:         "new-scene",
 		Brightness: &brightness,
@@ -54,12 +167,6 @@ func newScene(res http.ResponseWriter, req *http.Request) {
 			EType: "CLOUD",
 		},
 	}
-	err := scene.Create()
-	if err != nil {
-		http.Error(res, "invalid JSON: "+err.Error(), http.StatusBadRequest)
-		return
-	}
-	http.Redirect(res, req, "/scene/", http.StatusSeeOther)
 }
 
 func getScene(res http.ResponseWriter, req *http.Request) {
@@ -68,11 +175,16 @@ func getScene(res http.ResponseWriter, req *http.Request) {
 		http.Error(res, "invalid ID requested", http.StatusBadRequest)
 		return
 	}
-	scene, err := models.FindSceneByUUID(uuid)
+	scene, err := models.Scenes.FindByUUID(uuid)
 	if err != nil {
 		http.Error(res, "Could not find model with given ID", http.StatusNotFound)
 		return
 	}
+	res.Header().Set("ETag", scene.ETag())
+	if req.Header.Get("If-None-Match") == scene.ETag() {
+		res.WriteHeader(http.StatusNotModified)
+		return
+	}
 	json.NewEncoder(res).Encode(scene)
 }
 
@@ -82,12 +194,18 @@ func deleteScene(res http.ResponseWriter, req *http.Request) {
 		http.Error(res, "invalid ID requested", http.StatusBadRequest)
 		return
 	}
-	scene, err := models.FindSceneByUUID(uuid)
+	scene, err := models.Scenes.FindByUUID(uuid)
 	if err != nil {
 		http.Error(res, "Could not find model with given ID", http.StatusNotFound)
 		return
 	}
-	err = scene.Delete()
+	if !checkIfMatch(res, req, scene) {
+		return
+	}
+	err = models.Scenes.Delete(scene)
+	if isConflict(res, err) {
+		return
+	}
 	if err != nil {
 		http.Error(res, "Could not delete model", http.StatusInternalServerError)
 		return
@@ -102,12 +220,16 @@ func updateScene(res http.ResponseWriter, req *http.Request) {
 		return
 	}
 
-	scene, err := models.FindSceneByUUID(uuid)
+	scene, err := models.Scenes.FindByUUID(uuid)
 	if err != nil {
 		http.Error(res, "Could not find model with given ID", http.StatusNotFound)
 		return
 	}
 
+	if !checkIfMatch(res, req, scene) {
+		return
+	}
+
 	req.Body = http.MaxBytesReader(res, req.Body, 1<<20) // 1 MB
 	defer req.Body.Close()
 
@@ -117,7 +239,10 @@ func updateScene(res http.ResponseWriter, req *http.Request) {
 		return
 	}
 
-	err = scene.Update(&newScene)
+	_, err = models.Scenes.Update(scene, &newScene)
+	if isInvalid(res, err) || isConflict(res, err) {
+		return
+	}
 	if err != nil {
 		http.Error(res, "Could not update model", http.StatusInternalServerError)
 		return
@@ -126,28 +251,102 @@ func updateScene(res http.ResponseWriter, req *http.Request) {
 	http.Redirect(res, req, "/scene/", http.StatusSeeOther)
 }
 
-func applyScene(res http.ResponseWriter, req *http.Request) {
-	scene, err := models.FindSceneById(req.PathValue("id"))
+// PATCH /scene/{id}
+//
+// Changes part of a scene. With a `Content-Type` of
+// `application/json-patch+json`, the body is a JSON Patch (RFC 6902), like
+// `[{"op": "replace", "path": "/clock/color", "value": "#00FF00"}]`. Otherwise
+// it is a JSON merge patch (RFC 7396), like `{"clock": {"color": "#00FF00"}}`.
+// The patched scene is validated as a whole before it is saved.
+func patchScene(res http.ResponseWriter, req *http.Request) {
+	scene, ok := findSceneByIdOrUUID(res, req)
+	if !ok || !checkIfMatch(res, req, scene) {
+		return
+	}
+
+	req.Body = http.MaxBytesReader(res, req.Body, 1<<20) // 1 MB
+	defer req.Body.Close()
+	patch, err := io.ReadAll(req.Body)
 	if err != nil {
-		uuid, err := uuid.Parse(req.PathValue("id"))
-		if err != nil {
-			http.Error(res, "invalid ID requested", http.StatusBadRequest)
+		http.Error(res, "could not read body: "+err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	contentType, _, _ := mime.ParseMediaType(req.Header.Get("Content-Type"))
+	jsonPatch := contentType == "application/json-patch+json"
+	patched, err := scene.Patched(patch, jsonPatch)
+	if err != nil {
+		http.Error(res, "could not apply patch: "+err.Error(), http.StatusUnprocessableEntity)
+		return
+	}
+
+	_, err = models.Scenes.Update(scene, patched)
+	if isInvalid(res, err) || isConflict(res, err) {
+		return
+	}
+	if err != nil {
+		http.Error(res, "Could not update model", http.StatusInternalServerError)
+		return
+	}
+
+	http.Redirect(res, req, "/scene/"+scene.Uuid.String(), http.StatusSeeOther)
+}
+
+// GET|POST /scene/{id}/apply?set.temperature=12&set.weather=RAIN
+//
+// Shows the scene on the device. Settings can be overridden for this one time
+// with query parameters that start with `set.`, and with a partial scene as
+// JSON in the body of a POST. Other query parameters are ignored. The stored
+// scene doesn't change.
+func applyScene(res http.ResponseWriter, req *http.Request) {
+	scene, ok := findSceneByIdOrUUID(res, req)
+	if !ok {
+		return
+	}
+
+	var patch []byte
+	if req.Method == http.MethodPost {
+		req.Body = http.MaxBytesReader(res, req.Body, 1<<20) // 1 MB
+		defer req.Body.Close()
+		var err error
+		if patch, err = io.ReadAll(req.Body); err != nil {
+			http.Error(res, "could not read body: "+err.Error(), http.StatusBadRequest)
 			return
 		}
-		scene, err = models.FindSceneByUUID(uuid)
-		if err != nil {
-			http.Error(res, "Could not find model with given ID", http.StatusNotFound)
+		patch = bytes.TrimSpace(patch)
+	}
+	values := make(map[string]any)
+	for param, value := range req.URL.Query() {
+		if name, found := strings.CutPrefix(param, overridePrefix); found {
+			values[name] = parseVarValue(value[0])
+		}
+	}
+
+	if len(patch) == 0 && len(values) == 0 {
+		if err := showScene(scene); err != nil {
+			http.Error(res, "could not apply scene: "+err.Error(), http.StatusInternalServerError)
 			return
 		}
+		res.WriteHeader(http.StatusOK)
+		return
 	}
 
-	message, err := scene.GetMessage()
+	scene, err := scene.WithOverrides(patch, values)
+	if isInvalid(res, err) {
+		return
+	}
+	if err != nil {
+		http.Error(res, err.Error(), http.StatusBadRequest)
+		return
+	}
+	message, err := scene.ToMessage()
 	if err != nil {
 		http.Error(res, "could not create message from scene: "+err.Error(), http.StatusInternalServerError)
 		return
 	}
 
-	err = server.GetConnection().Send(message)
+	// Not the stored scene, so it shouldn't be recompiled from storage
+	err = display.show(nil, message)
 	if err != nil {
 		http.Error(res, "could not apply scene: "+err.Error(), http.StatusInternalServerError)
 		return
@@ -155,3 +354,64 @@ func applyScene(res http.ResponseWriter, req *http.Request) {
 
 	res.WriteHeader(http.StatusOK)
 }
+
+// findSceneByIdOrUUID looks up the scene in the `id` path value, which can be
+// either the human readable ID or the UUID of the scene. If the scene can't be
+// found, an error is written to the response.
+func findSceneByIdOrUUID(res http.ResponseWriter, req *http.Request) (*models.Scene, bool) {
+	scene, err := models.Scenes.FindById(req.PathValue("id"))
+	if err == nil {
+		return scene, true
+	}
+	uuid, err := uuid.Parse(req.PathValue("id"))
+	if err != nil {
+		http.Error(res, "invalid ID requested", http.StatusBadRequest)
+		return nil, false
+	}
+	scene, err = models.Scenes.FindByUUID(uuid)
+	if err != nil {
+		http.Error(res, "Could not find model with given ID", http.StatusNotFound)
+		return nil, false
+	}
+	return scene, true
+}
+
+// isInvalid writes the list of field errors to the response if the error is
+// about an invalid scene
+func isInvalid(res http.ResponseWriter, err error) bool {
+	var invalid models.ValidationErrors
+	if !errors.As(err, &invalid) {
+		return false
+	}
+	res.Header().Set("Content-Type", "application/json")
+	res.WriteHeader(http.StatusUnprocessableEntity)
+	json.NewEncoder(res).Encode(invalid)
+	return true
+}
+
+// checkIfMatch refuses the request with 412 Precondition Failed if it has an
+// If-Match header that doesn't match the ETag of the scene
+func checkIfMatch(res http.ResponseWriter, req *http.Request, scene *models.Scene) bool {
+	header := req.Header.Get("If-Match")
+	if header == "" || header == "*" {
+		return true
+	}
+	for _, etag := range strings.Split(header, ",") {
+		if strings.TrimSpace(etag) == scene.ETag() {
+			return true
+		}
+	}
+	res.Header().Set("ETag", scene.ETag())
+	http.Error(res, "scene was changed by someone else, reload it and try again", http.StatusPreconditionFailed)
+	return false
+}
+
+// isConflict writes 412 Precondition Failed to the response if the error is
+// about a scene that was changed in the mean time
+func isConflict(res http.ResponseWriter, err error) bool {
+	if !errors.Is(err, models.ErrConflict) {
+		return false
+	}
+	http.Error(res, "scene was changed by someone else, reload it and try again", http.StatusPreconditionFailed)
+	return true
+}
@@ -0,0 +1,401 @@
+package controllers
+
+// The scheduler runs the rules of the schedule when their cron expressions
+// or sun triggers match, in the time zone and at the location from
+// `config.json`.
+//
+// Rules that were missed, because PixelBox wasn't running or the clock jumped
+// ahead, are caught up on: of all the rules that should have run in the last
+// week, the most recent one of each kind is run (see ScheduleRule.Kind). That
+// leaves the device as if PixelBox had been running all along, without
+// replaying every single rule. This happens when the device connects, and
+// whenever the scheduler wakes up late.
+
+import (
+	"encoding/json"
+	"fmt"
+	"log"
+	"net/http"
+	"slices"
+	"sync"
+	"time"
+
+	"github.com/google/uuid"
+	"github.com/timendus/pixelbox/models"
+	"github.com/timendus/pixelbox/protocol"
+	"github.com/timendus/pixelbox/server"
+)
+
+func init() {
+	router := http.NewServeMux()
+	router.HandleFunc("GET /", ruleList)
+	router.HandleFunc("PUT /", newRule)
+	router.HandleFunc("GET /sun", sunTimes)
+	router.HandleFunc("GET /{id}", getRule)
+	router.HandleFunc("POST /{id}", updateRule)
+	router.HandleFunc("DELETE /{id}", deleteRule)
+	router.HandleFunc("POST /{id}/run", runRuleNow)
+	server.RegisterRouter("/schedule", router)
+}
+
+const (
+	catchUpWindow   = 7 * 24 * time.Hour
+	schedulerMaxNap = time.Minute // Check at least this often, in case the clock jumps
+)
+
+type ruleScheduler struct {
+	mu       sync.Mutex // Held while running rules
+	location *models.Setting[*time.Location]
+	wake     chan struct{}
+}
+
+var scheduler = ruleScheduler{
+	location: models.NewSetting(time.Local),
+	wake:     make(chan struct{}, 1),
+}
+
+// ScheduledRule is a rule together with the next time it will run
+type ScheduledRule struct {
+	*models.ScheduleRule
+	Next *time.Time `json:"next"`
+}
+
+// StartScheduler starts running the rules of the schedule in the background
+func StartScheduler() {
+	configureScheduler(server.GetConfig().Schedule)
+	server.RegisterConfigListener(func(config server.Config) {
+		configureScheduler(config.Schedule)
+		scheduler.reload()
+	})
+
+	server.RegisterConnectListener(func() {
+		now := scheduler.now()
+		scheduler.catchUp(now.Add(-catchUpWindow), now)
+	})
+	go scheduler.run()
+}
+
+// configureScheduler sets the time zone and the location from config.json
+func configureScheduler(config server.ConfigSchedule) {
+	var position *models.Coordinates
+	if config.Location != nil {
+		position = &models.Coordinates{
+			Latitude:  config.Location.Latitude,
+			Longitude: config.Location.Longitude,
+		}
+	}
+	models.Position.Set(position)
+
+	location := time.Local
+	if timezone := config.Timezone; timezone != "" {
+		var err error
+		if location, err = time.LoadLocation(timezone); err != nil {
+			log.Println("Unknown time zone in config.json, using the system time zone:", err)
+			location = time.Local
+		}
+	}
+	scheduler.location.Set(location)
+}
+
+func (s *ruleScheduler) now() time.Time {
+	return time.Now().In(s.location.Get())
+}
+
+// reload makes the scheduler look at the rules again after they changed
+func (s *ruleScheduler) reload() {
+	select {
+	case s.wake <- struct{}{}:
+	default:
+	}
+}
+
+func (s *ruleScheduler) run() {
+	last := s.now()
+	for {
+		nap := schedulerMaxNap
+		if next := s.next(last); !next.IsZero() {
+			nap = min(nap, time.Until(next))
+		}
+
+		timer := time.NewTimer(nap)
+		select {
+		case <-timer.C:
+		case <-s.wake:
+			// Rules that were just changed should not run for the past
+			timer.Stop()
+			last = s.now()
+			continue
+		}
+
+		now := s.now()
+		if now.Before(last) {
+			// The clock was turned back
+			last = now
+			continue
+		}
+		from := last
+		if from.Before(now.Add(-catchUpWindow)) {
+			from = now.Add(-catchUpWindow)
+		}
+		s.catchUp(from, now)
+		last = now
+	}
+}
+
+// next returns the first time after the given time that any rule should run,
+// or the zero time if there are no rules
+func (s *ruleScheduler) next(after time.Time) time.Time {
+	var first time.Time
+	for _, rule := range models.Schedule.All() {
+		if next := nextRun(rule, after); !next.IsZero() && (first.IsZero() || next.Before(first)) {
+			first = next
+		}
+	}
+	return first
+}
+
+// catchUp runs the rules that should have run after `from` and up to and
+// including `to`. Of each kind of rule, only the one that should have run last
+// is run.
+func (s *ruleScheduler) catchUp(from, to time.Time) {
+	type due struct {
+		rule *models.ScheduleRule
+		at   time.Time
+	}
+	latest := make(map[string]due)
+	for _, rule := range models.Schedule.All() {
+		at := lastRun(rule, from, to)
+		if at.IsZero() {
+			continue
+		}
+		if current, ok := latest[rule.Kind()]; !ok || at.After(current.at) {
+			latest[rule.Kind()] = due{rule, at}
+		}
+	}
+
+	rules := make([]due, 0, len(latest))
+	for _, d := range latest {
+		rules = append(rules, d)
+	}
+	slices.SortFunc(rules, func(a, b due) int { return a.at.Compare(b.at) })
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	for _, d := range rules {
+		log.Printf("Running schedule rule %q (%s)\n", d.rule.Name, d.rule.When())
+		if err := runRule(d.rule); err != nil {
+			log.Printf("Could not run schedule rule %q: %s\n", d.rule.Name, err)
+		}
+	}
+}
+
+// nextRun returns the first time after the given time that the rule should
+// run, or the zero time if it shouldn't run at all
+func nextRun(rule *models.ScheduleRule, after time.Time) time.Time {
+	trigger, err := rule.Trigger()
+	if rule.Disabled || err != nil {
+		return time.Time{}
+	}
+	return trigger.Next(after)
+}
+
+// lastRun returns the last time the rule should have run after `from` and up
+// to and including `to`, or the zero time if it shouldn't have run
+func lastRun(rule *models.ScheduleRule, from, to time.Time) time.Time {
+	var last time.Time
+	for at := nextRun(rule, from); !at.IsZero() && !at.After(to); at = nextRun(rule, at) {
+		last = at
+	}
+	return last
+}
+
+func runRule(rule *models.ScheduleRule) error {
+	switch rule.Action {
+	case "scene":
+		scene, err := models.Scenes.Find(rule.Scene)
+		if err != nil {
+			return err
+		}
+		return showScene(scene)
+
+	case "playlist":
+		playlist, err := models.Playlists.Find(rule.Playlist)
+		if err != nil {
+			return err
+		}
+		return player.start(playlist)
+
+	case "off":
+		return display.show(nil, protocol.DisplayOff())
+
+	case "brightness", "volume":
+		return sendSetting(rule.Action, rule.Value)
+
+	default:
+		return fmt.Errorf("unknown action %q", rule.Action)
+	}
+}
+
+// sendSetting sets the brightness or the volume of the device
+func sendSetting(setting string, value *int) error {
+	if value == nil {
+		return fmt.Errorf("no value to set the %s to", setting)
+	}
+	set := protocol.SetBrightness
+	if setting == "volume" {
+		set = protocol.SetVolume
+	}
+	message, err := set(*value)
+	if err != nil {
+		return err
+	}
+	return send(message)
+}
+
+/* The REST resource */
+
+func scheduled(rule *models.ScheduleRule) ScheduledRule {
+	result := ScheduledRule{ScheduleRule: rule}
+	if next := nextRun(rule, scheduler.now()); !next.IsZero() {
+		result.Next = &next
+	}
+	return result
+}
+
+func ruleList(res http.ResponseWriter, req *http.Request) {
+	rules := models.Schedule.All()
+	result := make([]ScheduledRule, len(rules))
+	for i, rule := range rules {
+		result[i] = scheduled(rule)
+	}
+	json.NewEncoder(res).Encode(result)
+}
+
+func newRule(res http.ResponseWriter, req *http.Request) {
+	rule, ok := decodeRule(res, req)
+	if !ok {
+		return
+	}
+	err := models.Schedule.Create(rule)
+	if isInvalid(res, err) {
+		return
+	}
+	if err != nil {
+		http.Error(res, "could not create rule: "+err.Error(), http.StatusInternalServerError)
+		return
+	}
+	scheduler.reload()
+	http.Redirect(res, req, "/schedule/"+rule.Uuid.String(), http.StatusSeeOther)
+}
+
+func getRule(res http.ResponseWriter, req *http.Request) {
+	rule, ok := findRule(res, req)
+	if !ok {
+		return
+	}
+	json.NewEncoder(res).Encode(scheduled(rule))
+}
+
+func updateRule(res http.ResponseWriter, req *http.Request) {
+	rule, ok := findRule(res, req)
+	if !ok {
+		return
+	}
+	newRule, ok := decodeRule(res, req)
+	if !ok {
+		return
+	}
+	_, err := models.Schedule.Update(rule, newRule)
+	if isInvalid(res, err) {
+		return
+	}
+	if err != nil {
+		http.Error(res, "could not update rule: "+err.Error(), http.StatusInternalServerError)
+		return
+	}
+	scheduler.reload()
+	http.Redirect(res, req, "/schedule/", http.StatusSeeOther)
+}
+
+func deleteRule(res http.ResponseWriter, req *http.Request) {
+	rule, ok := findRule(res, req)
+	if !ok {
+		return
+	}
+	if err := models.Schedule.Delete(rule); err != nil {
+		http.Error(res, "could not delete rule: "+err.Error(), http.StatusInternalServerError)
+		return
+	}
+	scheduler.reload()
+	http.Redirect(res, req, "/schedule/", http.StatusSeeOther)
+}
+
+// POST /schedule/{id}/run
+//
+// Runs the rule right away, to try it out
+func runRuleNow(res http.ResponseWriter, req *http.Request) {
+	rule, ok := findRule(res, req)
+	if !ok {
+		return
+	}
+	scheduler.mu.Lock()
+	err := runRule(rule)
+	scheduler.mu.Unlock()
+	if err != nil {
+		http.Error(res, "could not run rule: "+err.Error(), http.StatusInternalServerError)
+		return
+	}
+	res.WriteHeader(http.StatusOK)
+}
+
+// GET /schedule/sun?date=2006-01-02
+//
+// Returns the sun times for the given day, or for today, so you can check the
+// configured location
+func sunTimes(res http.ResponseWriter, req *http.Request) {
+	position := models.Position.Get()
+	if position == nil {
+		http.Error(res, "no location configured in config.json", http.StatusNotFound)
+		return
+	}
+	day := scheduler.now()
+	if date := req.URL.Query().Get("date"); date != "" {
+		var err error
+		day, err = time.ParseInLocation(time.DateOnly, date, scheduler.location.Get())
+		if err != nil {
+			http.Error(res, "invalid date, use YYYY-MM-DD", http.StatusBadRequest)
+			return
+		}
+	}
+	json.NewEncoder(res).Encode(struct {
+		Date     string             `json:"date"`
+		Location models.Coordinates `json:"location"`
+		models.SunTimes
+	}{day.Format(time.DateOnly), *position, position.Sun(day)})
+}
+
+func findRule(res http.ResponseWriter, req *http.Request) (*models.ScheduleRule, bool) {
+	id, err := uuid.Parse(req.PathValue("id"))
+	if err != nil {
+		http.Error(res, "invalid ID requested", http.StatusBadRequest)
+		return nil, false
+	}
+	rule, err := models.Schedule.FindByUUID(id)
+	if err != nil {
+		http.Error(res, "Could not find rule with given ID", http.StatusNotFound)
+		return nil, false
+	}
+	return rule, true
+}
+
+func decodeRule(res http.ResponseWriter, req *http.Request) (*models.ScheduleRule, bool) {
+	req.Body = http.MaxBytesReader(res, req.Body, 1<<20) // 1 MB
+	defer req.Body.Close()
+
+	var rule models.ScheduleRule
+	if err := json.NewDecoder(req.Body).Decode(&rule); err != nil {
+		http.Error(res, "invalid JSON: "+err.Error(), http.StatusBadRequest)
+		return nil, false
+	}
+	return &rule, true
+}
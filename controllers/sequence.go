@@ -0,0 +1,148 @@
+package controllers
+
+// The sequencer runs sequence scenes step by step. Only one sequence runs at a
+// time: starting another one, or showing anything else, aborts it. Sequences
+// that show other sequences run their steps in place.
+
+import (
+	"fmt"
+	"log"
+	"sync"
+	"time"
+
+	"github.com/google/uuid"
+	"github.com/timendus/pixelbox/models"
+	"github.com/timendus/pixelbox/protocol"
+)
+
+type sequenceRunner struct {
+	mu sync.Mutex
+
+	// Every run gets its own generation, so a step that is about to run after
+	// the sequence was aborted can tell it's out of date
+	generation int
+	stop       chan struct{}
+}
+
+var sequencer sequenceRunner
+
+// showScene shows a stored scene by hand. Sequences are started, other scenes
+// are compiled and sent to the device.
+func showScene(scene *models.Scene) error {
+	if scene.SceneType == "sequence" {
+		player.pause()
+		sequencer.start(scene)
+		return nil
+	}
+	message, err := scene.GetMessage()
+	if err != nil {
+		return fmt.Errorf("could not create message from scene: %w", err)
+	}
+	return display.show(scene, message)
+}
+
+// start runs the sequence from its first step, aborting the one that was
+// running, if any
+func (s *sequenceRunner) start(scene *models.Scene) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.halt()
+	s.stop = make(chan struct{})
+	go s.run(s.generation, scene, s.stop, make(map[uuid.UUID]bool))
+}
+
+// cancel aborts the running sequence, if any
+func (s *sequenceRunner) cancel() {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.halt()
+}
+
+// halt stops the current run. The caller should hold the lock.
+func (s *sequenceRunner) halt() {
+	s.generation++
+	if s.stop != nil {
+		close(s.stop)
+		s.stop = nil
+	}
+}
+
+// run runs the steps of the sequence and returns whether it got to the end
+// without being aborted
+func (s *sequenceRunner) run(generation int, scene *models.Scene, stop chan struct{}, running map[uuid.UUID]bool) bool {
+	running[scene.Uuid] = true
+	defer delete(running, scene.Uuid)
+
+	for i, step := range scene.Sequence.Steps {
+		if nested := nestedSequence(step); nested != nil {
+			if running[nested.Uuid] {
+				log.Printf("sequence %q: skipping step %d, it would run %q again\n", scene.Id, i, step.Scene)
+			} else if !s.run(generation, nested, stop, running) {
+				return false
+			}
+		} else if !s.step(generation, step) {
+			return false
+		}
+
+		select {
+		case <-time.After(time.Duration(step.Delay) * time.Millisecond):
+		case <-stop:
+			return false
+		}
+	}
+	return true
+}
+
+// step runs a single step, unless the sequence was aborted in the mean time,
+// and returns whether it was run
+func (s *sequenceRunner) step(generation int, step models.Step) bool {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.generation != generation {
+		return false
+	}
+	if err := runStep(step); err != nil {
+		// Keep going, the next steps may work
+		log.Printf("sequence: could not run %s step: %s\n", step.Action, err)
+	}
+	return true
+}
+
+// nestedSequence returns the sequence the step shows, if it shows one
+func nestedSequence(step models.Step) *models.Scene {
+	if step.Action != "scene" {
+		return nil
+	}
+	scene, err := models.Scenes.Find(step.Scene)
+	if err != nil || scene.SceneType != "sequence" {
+		return nil
+	}
+	return scene
+}
+
+func runStep(step models.Step) error {
+	switch step.Action {
+	case "scene":
+		scene, err := models.Scenes.Find(step.Scene)
+		if err != nil {
+			return err
+		}
+		message, err := scene.GetMessage()
+		if err != nil {
+			return fmt.Errorf("could not create message from scene: %w", err)
+		}
+		return display.present(scene, message)
+
+	case "off":
+		return display.present(nil, protocol.DisplayOff())
+
+	case "time":
+		return send(protocol.SetTime(time.Now()))
+
+	case "brightness", "volume":
+		return sendSetting(step.Action, step.Value)
+
+	default:
+		return fmt.Errorf("unknown action %q", step.Action)
+	}
+}
@@ -0,0 +1,295 @@
+package controllers
+
+import (
+	"fmt"
+	"image"
+	"image/draw"
+	"image/png"
+	"net/http"
+	"path/filepath"
+	"strconv"
+	"strings"
+
+	"github.com/timendus/pixelbox/graphics"
+	"github.com/timendus/pixelbox/models"
+)
+
+// POST /scene/import/spritesheet
+//
+// Expects a multipart form with the sprite sheet in a field called `file`. The
+// other fields are optional:
+//
+//   - `frameWidth`, `frameHeight`: size of a single frame (default 16x16)
+//   - `margin`: pixels around the edge of the sheet (default 0)
+//   - `spacing`: pixels between frames (default 0)
+//   - `order`: `rows` (left to right, then down) or `columns` (top to bottom,
+//     then right). Defaults to `rows`.
+//   - `frames`: maximum number of frames to import
+//   - `duration`: duration of each frame in milliseconds (default 100)
+//   - `durations`: comma separated list of durations per frame, overriding
+//     `duration` for the frames it covers
+//   - `keepEmpty`: set to `true` to keep fully transparent frames
+//   - `name`: name of the new scene (default is the file name)
+func importSpriteSheet(res http.ResponseWriter, req *http.Request) {
+	// Limit size defensively (example: 10 MB)
+	req.Body = http.MaxBytesReader(res, req.Body, 10<<20)
+
+	if err := req.ParseMultipartForm(10 << 20); err != nil {
+		http.Error(res, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	file, header, err := req.FormFile("file")
+	if err != nil {
+		http.Error(res, err.Error(), http.StatusBadRequest)
+		return
+	}
+	defer file.Close()
+
+	sheet, _, err := image.Decode(file)
+	if err != nil {
+		http.Error(res, "invalid image", http.StatusBadRequest)
+		return
+	}
+
+	grid, err := parseSpriteGrid(req)
+	if err != nil {
+		http.Error(res, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	frames, err := grid.slice(sheet)
+	if err != nil {
+		http.Error(res, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	name := req.FormValue("name")
+	if name == "" {
+		name = strings.TrimSuffix(header.Filename, filepath.Ext(header.Filename))
+	}
+
+	scene := defaultScene()
+	scene.Name = name
+	scene.Id = toId(name)
+	scene.SceneType = "animation"
+	scene.Animation.Frames = frames
+
+	err = models.Scenes.Create(&scene)
+	if isInvalid(res, err) {
+		return
+	}
+	if err != nil {
+		http.Error(res, "could not create scene: "+err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	http.Redirect(res, req, "/scene/"+scene.Uuid.String(), http.StatusSeeOther)
+}
+
+// GET /scene/{id}/spritesheet.png
+//
+// Renders the frames of an animation scene (or the single frame of an image
+// scene) to a PNG sprite sheet. The optional `columns` query parameter sets the
+// number of frames per row, defaulting to all frames on a single row. The
+// frame durations are returned in the `X-Frame-Durations` header, in the same
+// format that the import endpoint accepts.
+func exportSpriteSheet(res http.ResponseWriter, req *http.Request) {
+	scene, ok := findSceneByIdOrUUID(res, req)
+	if !ok {
+		return
+	}
+
+	var frames []models.Frame
+	switch scene.SceneType {
+	case "animation":
+		frames = scene.Animation.Frames
+	case "image":
+		frames = []models.Frame{{Pixels: scene.Image.Pixels}}
+	default:
+		http.Error(res, "only image and animation scenes can be exported as a sprite sheet", http.StatusBadRequest)
+		return
+	}
+	if len(frames) == 0 {
+		http.Error(res, "scene has no frames to export", http.StatusBadRequest)
+		return
+	}
+
+	columns := len(frames)
+	if value := req.URL.Query().Get("columns"); value != "" {
+		var err error
+		columns, err = strconv.Atoi(value)
+		if err != nil || columns < 1 {
+			http.Error(res, "columns should be a positive number", http.StatusBadRequest)
+			return
+		}
+	}
+	rows := (len(frames) + columns - 1) / columns
+	if columns > len(frames) {
+		columns = len(frames)
+	}
+
+	sheet := image.NewRGBA(image.Rect(0, 0, columns*models.Width, rows*models.Height))
+	durations := make([]string, len(frames))
+	for i, frame := range frames {
+		x := (i % columns) * models.Width
+		y := (i / columns) * models.Height
+		draw.Draw(sheet, image.Rect(x, y, x+models.Width, y+models.Height), models.PixelsToRGBA(frame.Pixels), image.Point{}, draw.Src)
+		durations[i] = strconv.Itoa(frame.Duration)
+	}
+
+	res.Header().Set("Content-Type", "image/png")
+	name := scene.Id
+	if name == "" {
+		name = scene.Uuid.String()
+	}
+	res.Header().Set("Content-Disposition", fmt.Sprintf("inline; filename=%q", name+".png"))
+	res.Header().Set("X-Frame-Durations", strings.Join(durations, ","))
+	png.Encode(res, sheet)
+}
+
+type spriteGrid struct {
+	frameWidth  int
+	frameHeight int
+	margin      int
+	spacing     int
+	byColumns   bool
+	maxFrames   int
+	limited     bool // Whether maxFrames was asked for
+	duration    int
+	durations   []int
+	keepEmpty   bool
+}
+
+func parseSpriteGrid(req *http.Request) (*spriteGrid, error) {
+	grid := spriteGrid{
+		frameWidth:  models.Width,
+		frameHeight: models.Height,
+		duration:    100,
+		keepEmpty:   req.FormValue("keepEmpty") == "true",
+	}
+
+	fields := []struct {
+		name   string
+		target *int
+		min    int
+	}{
+		{"frameWidth", &grid.frameWidth, 1},
+		{"frameHeight", &grid.frameHeight, 1},
+		{"margin", &grid.margin, 0},
+		{"spacing", &grid.spacing, 0},
+		{"frames", &grid.maxFrames, 1},
+		{"duration", &grid.duration, 0},
+	}
+	for _, field := range fields {
+		value := req.FormValue(field.name)
+		if value == "" {
+			continue
+		}
+		number, err := strconv.Atoi(value)
+		if err != nil || number < field.min {
+			return nil, fmt.Errorf("%s should be a number of at least %d", field.name, field.min)
+		}
+		*field.target = number
+	}
+
+	// Keep the number of frames within the animation budget, also when frames
+	// isn't given, so a huge sheet of tiny frames can't take all our memory
+	limit := models.AnimationBudget.Get().MaxFrames
+	if grid.maxFrames > limit {
+		return nil, fmt.Errorf("frames should be at most %d", limit)
+	}
+	grid.limited = grid.maxFrames > 0
+	if !grid.limited {
+		grid.maxFrames = limit
+	}
+
+	switch req.FormValue("order") {
+	case "", "rows":
+		grid.byColumns = false
+	case "columns":
+		grid.byColumns = true
+	default:
+		return nil, fmt.Errorf("order should be either rows or columns")
+	}
+
+	if value := req.FormValue("durations"); value != "" {
+		for _, part := range strings.Split(value, ",") {
+			duration, err := strconv.Atoi(strings.TrimSpace(part))
+			if err != nil || duration < 0 {
+				return nil, fmt.Errorf("durations should be a comma separated list of milliseconds")
+			}
+			grid.durations = append(grid.durations, duration)
+		}
+	}
+
+	return &grid, nil
+}
+
+// slice cuts the sprite sheet into frames, scaling every frame to 16x16 pixels
+// if the grid size is different
+func (grid *spriteGrid) slice(sheet image.Image) ([]models.Frame, error) {
+	bounds := sheet.Bounds()
+	columns := (bounds.Dx() - 2*grid.margin + grid.spacing) / (grid.frameWidth + grid.spacing)
+	rows := (bounds.Dy() - 2*grid.margin + grid.spacing) / (grid.frameHeight + grid.spacing)
+	if columns < 1 || rows < 1 {
+		return nil, fmt.Errorf("sprite sheet of %dx%d is too small for frames of %dx%d", bounds.Dx(), bounds.Dy(), grid.frameWidth, grid.frameHeight)
+	}
+
+	frames := make([]models.Frame, 0)
+	for i := 0; i < columns*rows; i++ {
+		column, row := i%columns, i/columns
+		if grid.byColumns {
+			column, row = i/rows, i%rows
+		}
+		origin := image.Point{
+			X: bounds.Min.X + grid.margin + column*(grid.frameWidth+grid.spacing),
+			Y: bounds.Min.Y + grid.margin + row*(grid.frameHeight+grid.spacing),
+		}
+
+		// Copy the cell to its own image first, so we get a clean RGBA image
+		// that starts at (0, 0)
+		cell := image.NewRGBA(image.Rect(0, 0, grid.frameWidth, grid.frameHeight))
+		draw.Draw(cell, cell.Bounds(), sheet, origin, draw.Src)
+		if !grid.keepEmpty && isTransparent(cell) {
+			continue
+		}
+		// Only the frames we keep count towards the maximum
+		if len(frames) == grid.maxFrames {
+			if grid.limited {
+				break
+			}
+			return nil, fmt.Errorf("sprite sheet has more than the maximum of %d frames, use frames to take only the first ones", grid.maxFrames)
+		}
+
+		duration := grid.duration
+		if len(frames) < len(grid.durations) {
+			duration = grid.durations[len(frames)]
+		}
+
+		frames = append(frames, models.Frame{
+			Duration: duration,
+			Pixels:   models.PixelsFromRGBA(graphics.ToScaledRGBA(cell)),
+		})
+	}
+
+	if len(frames) == 0 {
+		return nil, fmt.Errorf("sprite sheet holds no frames")
+	}
+	return frames, nil
+}
+
+func isTransparent(img *image.RGBA) bool {
+	for i := 3; i < len(img.Pix); i += 4 {
+		if img.Pix[i] != 0 {
+			return false
+		}
+	}
+	return true
+}
+
+// toId turns a scene name into a human readable ID, the same way the user
+// interface does it
+func toId(name string) string {
+	return strings.ReplaceAll(strings.ToLower(strings.TrimSpace(name)), " ", "-")
+}
@@ -0,0 +1,199 @@
+package controllers
+
+// Live streaming of frames over a WebSocket. Clients send frames as binary
+// messages, either as 768 bytes of raw 16x16 RGB data or as an encoded image
+// (PNG, or anything else we can decode). Frames are sent to the device as fast
+// as the Bluetooth link allows. If frames come in faster than that, we only
+// keep the most recent one. Once per second we report statistics back to the
+// client as a JSON text message. When the stream closes, we restore whatever
+// was showing before the stream started.
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"image"
+	"log"
+	"net/http"
+	"sync"
+	"time"
+
+	"github.com/timendus/pixelbox/graphics"
+	"github.com/timendus/pixelbox/models"
+	"github.com/timendus/pixelbox/protocol"
+	"github.com/timendus/pixelbox/server"
+)
+
+func init() {
+	router := http.NewServeMux()
+	router.HandleFunc("GET /", streamFrames)
+	server.RegisterRouter("/stream", router)
+}
+
+const (
+	// Plenty for a 16x16 image in any format, even uncompressed
+	maxStreamFrameSize = 16 << 10 // 16 KB
+	maxStreamImageSize = 256      // Pixels wide and high, before scaling
+)
+
+// Only one stream can control the display at a time
+var streamLock sync.Mutex
+
+type streamFrame struct {
+	image    *image.RGBA
+	received time.Time
+}
+
+type streamStats struct {
+	Fps       float64 `json:"fps"`
+	LatencyMs float64 `json:"latencyMs"`
+	Received  int     `json:"received"`
+	Sent      int     `json:"sent"`
+	Dropped   int     `json:"dropped"`
+	Invalid   int     `json:"invalid"`
+	Error     string  `json:"error,omitempty"`
+}
+
+// GET /stream
+func streamFrames(res http.ResponseWriter, req *http.Request) {
+	if !streamLock.TryLock() {
+		http.Error(res, "another stream is already active", http.StatusConflict)
+		return
+	}
+	defer streamLock.Unlock()
+
+	ws, err := server.UpgradeWebSocket(res, req)
+	if err != nil {
+		log.Println("could not start stream:", err)
+		return
+	}
+	defer ws.Close()
+	ws.SetReadLimit(maxStreamFrameSize)
+
+	display.begin()
+
+	var mu sync.Mutex
+	stats := streamStats{}
+	var latency time.Duration
+
+	// Holds at most one frame: the most recent one that hasn't been sent yet
+	latest := make(chan streamFrame, 1)
+	done := make(chan struct{})
+	stopped := make(chan struct{})
+
+	// Send frames to the device
+	go func() {
+		defer close(stopped)
+		for {
+			select {
+			case <-done:
+				return
+			case frame := <-latest:
+				message, err := protocol.ShowImage(frame.image)
+				if err == nil {
+					err = send(message)
+				}
+				mu.Lock()
+				if err != nil {
+					stats.Error = err.Error()
+				} else {
+					stats.Sent++
+					latency += time.Since(frame.received)
+				}
+				mu.Unlock()
+			}
+		}
+	}()
+
+	// Report statistics to the client
+	go func() {
+		ticker := time.NewTicker(time.Second)
+		defer ticker.Stop()
+		lastReport := time.Now()
+		lastSent := 0
+		for {
+			select {
+			case <-done:
+				return
+			case now := <-ticker.C:
+				mu.Lock()
+				report := stats
+				sent := stats.Sent - lastSent
+				report.Fps = float64(sent) / now.Sub(lastReport).Seconds()
+				if sent > 0 {
+					report.LatencyMs = float64(latency.Microseconds()) / 1000 / float64(sent)
+				}
+				latency = 0
+				lastSent = stats.Sent
+				stats.Error = ""
+				mu.Unlock()
+				lastReport = now
+
+				payload, _ := json.Marshal(report)
+				if err := ws.WriteMessage(server.WebSocketText, payload); err != nil {
+					return
+				}
+			}
+		}
+	}()
+
+	// Receive frames from the client
+	for {
+		messageType, data, err := ws.ReadMessage()
+		if err != nil {
+			break
+		}
+		if messageType != server.WebSocketBinary {
+			continue
+		}
+
+		img, err := decodeStreamFrame(data)
+		mu.Lock()
+		stats.Received++
+		if err != nil {
+			stats.Invalid++
+			mu.Unlock()
+			continue
+		}
+		select {
+		case <-latest:
+			stats.Dropped++
+		default:
+		}
+		mu.Unlock()
+		latest <- streamFrame{image: img, received: time.Now()}
+	}
+
+	close(done)
+	<-stopped
+	if err := display.end(); err != nil {
+		log.Println("could not restore display after stream:", err)
+	}
+}
+
+func decodeStreamFrame(data []byte) (*image.RGBA, error) {
+	if len(data) == models.Width*models.Height*3 {
+		img := image.NewRGBA(image.Rect(0, 0, models.Width, models.Height))
+		for i := 0; i < models.Width*models.Height; i++ {
+			img.Pix[i*4+0] = data[i*3+0]
+			img.Pix[i*4+1] = data[i*3+1]
+			img.Pix[i*4+2] = data[i*3+2]
+			img.Pix[i*4+3] = 0xFF
+		}
+		return img, nil
+	}
+
+	// Check the size first, a small file can hold a huge image
+	config, _, err := image.DecodeConfig(bytes.NewReader(data))
+	if err != nil {
+		return nil, err
+	}
+	if config.Width > maxStreamImageSize || config.Height > maxStreamImageSize {
+		return nil, fmt.Errorf("image of %dx%d is too large", config.Width, config.Height)
+	}
+	img, _, err := image.Decode(bytes.NewReader(data))
+	if err != nil {
+		return nil, err
+	}
+	return graphics.ToScaledRGBA(img), nil
+}
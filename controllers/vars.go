@@ -0,0 +1,105 @@
+package controllers
+
+import (
+	"encoding/json"
+	"io"
+	"log"
+	"net/http"
+	"strings"
+
+	"github.com/timendus/pixelbox/models"
+	"github.com/timendus/pixelbox/server"
+)
+
+func init() {
+	router := http.NewServeMux()
+	router.HandleFunc("GET /", varList)
+	router.HandleFunc("GET /{name}", getVar)
+	router.HandleFunc("PUT /{name}", setVar)
+	router.HandleFunc("DELETE /{name}", deleteVar)
+	server.RegisterRouter("/vars", router)
+}
+
+func varList(res http.ResponseWriter, req *http.Request) {
+	json.NewEncoder(res).Encode(models.Vars.All())
+}
+
+func getVar(res http.ResponseWriter, req *http.Request) {
+	value, ok := models.Vars.Get(req.PathValue("name"))
+	if !ok {
+		http.Error(res, "Could not find variable with given name", http.StatusNotFound)
+		return
+	}
+	json.NewEncoder(res).Encode(value)
+}
+
+// PUT /vars/{name}
+//
+// The value can be given as a `value` query parameter, as JSON like `12`,
+// `"#FF0000"` or `{"value": 12}`, or as plain text in the body. Scenes that
+// use the variable are recompiled, and if one of them is showing, it is sent
+// to the device again.
+func setVar(res http.ResponseWriter, req *http.Request) {
+	name := req.PathValue("name")
+	value, err := readVarValue(res, req)
+	if err != nil {
+		http.Error(res, err.Error(), http.StatusBadRequest)
+		return
+	}
+	if err := models.Vars.Set(name, value); err != nil {
+		http.Error(res, "could not set variable: "+err.Error(), http.StatusBadRequest)
+		return
+	}
+	variableChanged(name)
+	http.Redirect(res, req, "/vars/"+name, http.StatusSeeOther)
+}
+
+func deleteVar(res http.ResponseWriter, req *http.Request) {
+	name := req.PathValue("name")
+	if err := models.Vars.Delete(name); err != nil {
+		http.Error(res, "could not delete variable: "+err.Error(), http.StatusNotFound)
+		return
+	}
+	variableChanged(name)
+	http.Redirect(res, req, "/vars/", http.StatusSeeOther)
+}
+
+func variableChanged(name string) {
+	if len(models.Scenes.Invalidate(name)) == 0 {
+		return
+	}
+	if err := display.refresh(name); err != nil {
+		log.Printf("Could not show the new value of variable %q: %s\n", name, err)
+	}
+}
+
+func readVarValue(res http.ResponseWriter, req *http.Request) (any, error) {
+	if value := req.URL.Query().Get("value"); value != "" {
+		return parseVarValue(value), nil
+	}
+
+	req.Body = http.MaxBytesReader(res, req.Body, 1<<10) // 1 kB
+	defer req.Body.Close()
+	body, err := io.ReadAll(req.Body)
+	if err != nil {
+		return nil, err
+	}
+
+	var payload struct {
+		Value any `json:"value"`
+	}
+	if err := json.Unmarshal(body, &payload); err == nil && payload.Value != nil {
+		return payload.Value, nil
+	}
+	return parseVarValue(string(body)), nil
+}
+
+// parseVarValue reads a JSON value like `12` or `"text"`, and takes anything
+// that isn't valid JSON as plain text
+func parseVarValue(text string) any {
+	var value any
+	if err := json.Unmarshal([]byte(text), &value); err == nil {
+		return value
+	}
+	return strings.TrimSpace(text)
+}
@@ -0,0 +1,131 @@
+package controllers
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"log"
+	"math"
+	"net/http"
+	"strconv"
+	"strings"
+
+	"github.com/timendus/pixelbox/models"
+	"github.com/timendus/pixelbox/protocol"
+	"github.com/timendus/pixelbox/server"
+)
+
+func init() {
+	router := http.NewServeMux()
+	router.HandleFunc("GET /", widgetList)
+	router.HandleFunc("GET /{name}", getWidget)
+	router.HandleFunc("PUT /{name}", configureWidget)
+	router.HandleFunc("DELETE /{name}", deleteWidget)
+	router.HandleFunc("POST /{name}/value", pushWidgetValue)
+	server.RegisterRouter("/widget", router)
+}
+
+func widgetList(res http.ResponseWriter, req *http.Request) {
+	json.NewEncoder(res).Encode(models.AllWidgets())
+}
+
+func getWidget(res http.ResponseWriter, req *http.Request) {
+	widget, err := models.FindWidget(req.PathValue("name"))
+	if err != nil {
+		http.Error(res, "Could not find widget with given name", http.StatusNotFound)
+		return
+	}
+	json.NewEncoder(res).Encode(widget)
+}
+
+func configureWidget(res http.ResponseWriter, req *http.Request) {
+	req.Body = http.MaxBytesReader(res, req.Body, 1<<20) // 1 MB
+	defer req.Body.Close()
+
+	var config models.Widget
+	if err := json.NewDecoder(req.Body).Decode(&config); err != nil {
+		http.Error(res, "invalid JSON: "+err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	widget, err := models.ConfigureWidget(req.PathValue("name"), config)
+	if err != nil {
+		http.Error(res, err.Error(), http.StatusBadRequest)
+		return
+	}
+	json.NewEncoder(res).Encode(widget)
+}
+
+func deleteWidget(res http.ResponseWriter, req *http.Request) {
+	if err := models.DeleteWidget(req.PathValue("name")); err != nil {
+		http.Error(res, "Could not find widget with given name", http.StatusNotFound)
+		return
+	}
+	http.Redirect(res, req, "/widget/", http.StatusSeeOther)
+}
+
+// POST /widget/{name}/value
+//
+// The value can be given as a `value` query parameter, as a plain number in the
+// body or as JSON like `{"value": 42}`. If the widget doesn't exist yet, it is
+// created with the type in the `type` query parameter (default `counter`). If
+// the value differs from the previous one, the widget is shown on the device.
+func pushWidgetValue(res http.ResponseWriter, req *http.Request) {
+	value, err := readWidgetValue(res, req)
+	if err != nil {
+		http.Error(res, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	widget, changed, err := models.PushWidgetValue(req.PathValue("name"), value, req.URL.Query().Get("type"))
+	if err != nil {
+		http.Error(res, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	if changed {
+		message, err := protocol.ShowImage(widget.Render())
+		if err != nil {
+			log.Println("could not render widget:", err)
+			res.WriteHeader(http.StatusInternalServerError)
+			return
+		}
+		if err := display.show(nil, message); err != nil {
+			http.Error(res, "could not show widget: "+err.Error(), http.StatusInternalServerError)
+			return
+		}
+	}
+
+	json.NewEncoder(res).Encode(widget)
+}
+
+// readWidgetValue reads the value from the query or the body. Numbers like NaN
+// and Inf are refused, they can't be shown or stored as JSON.
+func readWidgetValue(res http.ResponseWriter, req *http.Request) (float64, error) {
+	value, err := parseWidgetValue(res, req)
+	if err == nil && (math.IsNaN(value) || math.IsInf(value, 0)) {
+		return 0, fmt.Errorf("the value should be a finite number")
+	}
+	return value, err
+}
+
+func parseWidgetValue(res http.ResponseWriter, req *http.Request) (float64, error) {
+	if value := req.URL.Query().Get("value"); value != "" {
+		return strconv.ParseFloat(value, 64)
+	}
+
+	req.Body = http.MaxBytesReader(res, req.Body, 1<<10) // 1 kB
+	defer req.Body.Close()
+	body, err := io.ReadAll(req.Body)
+	if err != nil {
+		return 0, err
+	}
+
+	var payload struct {
+		Value *float64 `json:"value"`
+	}
+	if err := json.Unmarshal(body, &payload); err == nil && payload.Value != nil {
+		return *payload.Value, nil
+	}
+	return strconv.ParseFloat(strings.TrimSpace(string(body)), 64)
+}
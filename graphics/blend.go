@@ -0,0 +1,76 @@
+package graphics
+
+// Drawing one image on top of another with an opacity and a blend mode, like
+// layers in an image editor.
+
+import (
+	"fmt"
+	"image"
+	"image/color"
+
+	"github.com/timendus/pixelbox/protocol"
+)
+
+type BlendMode string
+
+var blendModes = map[BlendMode]func(src, dst int) int{
+	"normal":     func(src, dst int) int { return src },
+	"multiply":   func(src, dst int) int { return src * dst / 255 },
+	"screen":     func(src, dst int) int { return 255 - (255-src)*(255-dst)/255 },
+	"add":        func(src, dst int) int { return min(src+dst, 255) },
+	"subtract":   func(src, dst int) int { return max(dst-src, 0) },
+	"difference": func(src, dst int) int { return max(src-dst, dst-src) },
+	"lighten":    func(src, dst int) int { return max(src, dst) },
+	"darken":     func(src, dst int) int { return min(src, dst) },
+}
+
+// Valid reports whether this is a blend mode we know. The empty string is
+// valid too, and means "normal".
+func (mode BlendMode) Valid() bool {
+	_, ok := blendModes[mode]
+	return ok || mode == ""
+}
+
+// Blend draws `src` onto `dst` with the top left corner of `src` at (x, y). The
+// alpha channel of `src` is respected and multiplied by `opacity`, which should
+// be between zero and one. The alpha channel of `dst` is left untouched.
+func Blend(dst, src *image.RGBA, x, y int, opacity float64, mode BlendMode) error {
+	blend, ok := blendModes[mode]
+	if mode == "" {
+		blend, ok = blendModes["normal"], true
+	}
+	if !ok {
+		return fmt.Errorf("unknown blend mode %q", mode)
+	}
+	opacity = min(max(opacity, 0), 1)
+
+	bounds := src.Bounds()
+	for sy := bounds.Min.Y; sy < bounds.Max.Y; sy++ {
+		for sx := bounds.Min.X; sx < bounds.Max.X; sx++ {
+			dx := x + sx - bounds.Min.X
+			dy := y + sy - bounds.Min.Y
+			if !image.Pt(dx, dy).In(dst.Rect) {
+				continue
+			}
+			s := src.PixOffset(sx, sy)
+			d := dst.PixOffset(dx, dy)
+			alpha := float64(src.Pix[s+3]) / 255 * opacity
+			if alpha == 0 {
+				continue
+			}
+			for c := 0; c < 3; c++ {
+				under := int(dst.Pix[d+c])
+				over := blend(int(src.Pix[s+c]), under)
+				dst.Pix[d+c] = byte(float64(under) + (float64(over)-float64(under))*alpha + 0.5)
+			}
+		}
+	}
+	return nil
+}
+
+// ParseColor converts a color like "#FF0000" to an opaque RGBA color. Invalid
+// colors are black.
+func ParseColor(hex string) color.RGBA {
+	c := protocol.ColorFromHex(hex)
+	return color.RGBA{c[0], c[1], c[2], 0xFF}
+}
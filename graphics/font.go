@@ -0,0 +1,120 @@
+package graphics
+
+// A tiny 3x5 pixel font, which is about the largest that still fits four
+// characters on the 16x16 display. Lower case letters are drawn as upper case.
+
+import (
+	"image"
+	"image/color"
+	"strings"
+)
+
+const (
+	GlyphWidth  = 3
+	GlyphHeight = 5
+	GlyphSpace  = 1
+)
+
+// Each glyph is five rows of three pixels, top to bottom
+var glyphs = map[rune][GlyphHeight]string{
+	'A':  {"###", "#.#", "###", "#.#", "#.#"},
+	'B':  {"##.", "#.#", "##.", "#.#", "##."},
+	'C':  {"###", "#..", "#..", "#..", "###"},
+	'D':  {"##.", "#.#", "#.#", "#.#", "##."},
+	'E':  {"###", "#..", "##.", "#..", "###"},
+	'F':  {"###", "#..", "##.", "#..", "#.."},
+	'G':  {"###", "#..", "#.#", "#.#", "###"},
+	'H':  {"#.#", "#.#", "###", "#.#", "#.#"},
+	'I':  {"###", ".#.", ".#.", ".#.", "###"},
+	'J':  {"..#", "..#", "..#", "#.#", "###"},
+	'K':  {"#.#", "#.#", "##.", "#.#", "#.#"},
+	'L':  {"#..", "#..", "#..", "#..", "###"},
+	'M':  {"#.#", "###", "###", "#.#", "#.#"},
+	'N':  {"##.", "#.#", "#.#", "#.#", "#.#"},
+	'O':  {"###", "#.#", "#.#", "#.#", "###"},
+	'P':  {"###", "#.#", "###", "#..", "#.."},
+	'Q':  {"###", "#.#", "#.#", "###", "..#"},
+	'R':  {"##.", "#.#", "##.", "#.#", "#.#"},
+	'S':  {"###", "#..", "###", "..#", "###"},
+	'T':  {"###", ".#.", ".#.", ".#.", ".#."},
+	'U':  {"#.#", "#.#", "#.#", "#.#", "###"},
+	'V':  {"#.#", "#.#", "#.#", "#.#", ".#."},
+	'W':  {"#.#", "#.#", "###", "###", "#.#"},
+	'X':  {"#.#", "#.#", ".#.", "#.#", "#.#"},
+	'Y':  {"#.#", "#.#", ".#.", ".#.", ".#."},
+	'Z':  {"###", "..#", ".#.", "#..", "###"},
+	'0':  {"###", "#.#", "#.#", "#.#", "###"},
+	'1':  {".#.", "##.", ".#.", ".#.", "###"},
+	'2':  {"###", "..#", "###", "#..", "###"},
+	'3':  {"###", "..#", ".##", "..#", "###"},
+	'4':  {"#.#", "#.#", "###", "..#", "..#"},
+	'5':  {"###", "#..", "###", "..#", "###"},
+	'6':  {"###", "#..", "###", "#.#", "###"},
+	'7':  {"###", "..#", "..#", ".#.", ".#."},
+	'8':  {"###", "#.#", "###", "#.#", "###"},
+	'9':  {"###", "#.#", "###", "..#", "###"},
+	' ':  {"...", "...", "...", "...", "..."},
+	'.':  {"...", "...", "...", "...", ".#."},
+	',':  {"...", "...", "...", ".#.", "#.."},
+	':':  {"...", ".#.", "...", ".#.", "..."},
+	';':  {"...", ".#.", "...", ".#.", "#.."},
+	'!':  {".#.", ".#.", ".#.", "...", ".#."},
+	'?':  {"###", "..#", ".##", "...", ".#."},
+	'-':  {"...", "...", "###", "...", "..."},
+	'+':  {"...", ".#.", "###", ".#.", "..."},
+	'=':  {"...", "###", "...", "###", "..."},
+	'_':  {"...", "...", "...", "...", "###"},
+	'*':  {"#.#", ".#.", "#.#", "...", "..."},
+	'/':  {"..#", "..#", ".#.", "#..", "#.."},
+	'%':  {"#.#", "..#", ".#.", "#..", "#.#"},
+	'\'': {".#.", ".#.", "...", "...", "..."},
+	'"':  {"#.#", "#.#", "...", "...", "..."},
+	'(':  {".#.", "#..", "#..", "#..", ".#."},
+	')':  {".#.", "..#", "..#", "..#", ".#."},
+	'<':  {"..#", ".#.", "#..", ".#.", "..#"},
+	'>':  {"#..", ".#.", "..#", ".#.", "#.."},
+	'#':  {"#.#", "###", "#.#", "###", "#.#"},
+	'°':  {"###", "#.#", "###", "...", "..."},
+}
+
+// TextWidth returns the width in pixels of the given text
+func TextWidth(text string) int {
+	length := len([]rune(text))
+	if length == 0 {
+		return 0
+	}
+	return length*(GlyphWidth+GlyphSpace) - GlyphSpace
+}
+
+// DrawText draws the text onto the image with its top left corner at the given
+// position. Unknown characters are drawn as a question mark.
+func DrawText(img *image.RGBA, text string, x, y int, c color.Color) {
+	for _, char := range strings.ToUpper(text) {
+		glyph, ok := glyphs[char]
+		if !ok {
+			glyph = glyphs['?']
+		}
+		for row, line := range glyph {
+			for column, pixel := range line {
+				if pixel == '#' {
+					setPixel(img, x+column, y+row, c)
+				}
+			}
+		}
+		x += GlyphWidth + GlyphSpace
+	}
+}
+
+// RenderText returns an image that fits the text exactly, with a transparent
+// background.
+func RenderText(text string, c color.Color) *image.RGBA {
+	img := image.NewRGBA(image.Rect(0, 0, max(TextWidth(text), 1), GlyphHeight))
+	DrawText(img, text, 0, 0, c)
+	return img
+}
+
+func setPixel(img *image.RGBA, x, y int, c color.Color) {
+	if image.Pt(x, y).In(img.Rect) {
+		img.Set(x, y, c)
+	}
+}
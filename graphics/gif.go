@@ -0,0 +1,43 @@
+package graphics
+
+import (
+	"image"
+	"image/draw"
+	"image/gif"
+)
+
+// GIFFrames renders every frame of the GIF to a full image, taking into account
+// that GIF frames can be partial and that they have different ways of disposing
+// of the previous frame.
+func GIFFrames(g *gif.GIF) []*image.RGBA {
+	bounds := image.Rect(0, 0, g.Config.Width, g.Config.Height)
+	canvas := image.NewRGBA(bounds)
+
+	var frames []*image.RGBA
+
+	for i, frame := range g.Image {
+		// Save a copy of the canvas *before* drawing the frame
+		prev := image.NewRGBA(bounds)
+		draw.Draw(prev, bounds, canvas, image.Point{}, draw.Src)
+
+		// Draw frame onto canvas
+		draw.Draw(canvas, frame.Bounds(), frame, image.Point{}, draw.Over)
+
+		// Capture the composited frame
+		out := image.NewRGBA(bounds)
+		draw.Draw(out, bounds, canvas, image.Point{}, draw.Src)
+		frames = append(frames, out)
+
+		// Handle disposal
+		switch g.Disposal[i] {
+		case gif.DisposalBackground:
+			draw.Draw(canvas, frame.Bounds(), image.Transparent, image.Point{}, draw.Src)
+		case gif.DisposalPrevious:
+			draw.Draw(canvas, bounds, prev, image.Point{}, draw.Src)
+		case gif.DisposalNone:
+			// keep canvas as-is
+		}
+	}
+
+	return frames
+}
@@ -0,0 +1,156 @@
+package graphics
+
+// The icon library holds the 16x16 icons that come with PixelBox. Static icons
+// are PNG files, animated icons are GIF files. The name of an icon is its file
+// name without the extension.
+
+import (
+	"fmt"
+	"image"
+	"image/color"
+	"image/draw"
+	"image/gif"
+	"image/png"
+	"io/fs"
+	"path"
+	"slices"
+	"strings"
+	"sync"
+)
+
+type Icon struct {
+	Name      string        `json:"name"`
+	Animated  bool          `json:"animated"`
+	Frames    []*image.RGBA `json:"-"`
+	Durations []int         `json:"durations,omitempty"` // Milliseconds
+
+	source fs.FS // Where the icon was loaded from
+	file   string
+}
+
+var icons = map[string]*Icon{}
+var iconsMu sync.RWMutex
+
+// LoadIcons adds all PNG and GIF files in the root of the file system to the
+// icon library
+func LoadIcons(fsys fs.FS) error {
+	entries, err := fs.ReadDir(fsys, ".")
+	if err != nil {
+		return err
+	}
+
+	for _, entry := range entries {
+		extension := path.Ext(entry.Name())
+		if entry.IsDir() || (extension != ".png" && extension != ".gif") {
+			continue
+		}
+		icon, err := loadIcon(fsys, entry.Name())
+		if err != nil {
+			return fmt.Errorf("could not load icon %s: %w", entry.Name(), err)
+		}
+		iconsMu.Lock()
+		icons[icon.Name] = icon
+		iconsMu.Unlock()
+	}
+	return nil
+}
+
+func loadIcon(fsys fs.FS, file string) (*Icon, error) {
+	f, err := fsys.Open(file)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	icon := Icon{Name: strings.TrimSuffix(file, path.Ext(file)), source: fsys, file: file}
+	if path.Ext(file) == ".gif" {
+		g, err := gif.DecodeAll(f)
+		if err != nil {
+			return nil, err
+		}
+		icon.Frames = GIFFrames(g)
+		for _, delay := range g.Delay {
+			icon.Durations = append(icon.Durations, delay*10)
+		}
+		icon.Animated = len(icon.Frames) > 1
+	} else {
+		img, err := png.Decode(f)
+		if err != nil {
+			return nil, err
+		}
+		rgba := image.NewRGBA(image.Rect(0, 0, img.Bounds().Dx(), img.Bounds().Dy()))
+		draw.Draw(rgba, rgba.Bounds(), img, img.Bounds().Min, draw.Src)
+		icon.Frames = []*image.RGBA{rgba}
+	}
+
+	for _, frame := range icon.Frames {
+		if frame.Bounds().Dx() != size || frame.Bounds().Dy() != size {
+			return nil, fmt.Errorf("icons should be 16x16 pixels")
+		}
+	}
+	return &icon, nil
+}
+
+// FindIcon returns the icon with the given name
+func FindIcon(name string) (*Icon, error) {
+	iconsMu.RLock()
+	defer iconsMu.RUnlock()
+	icon, ok := icons[name]
+	if !ok {
+		return nil, fmt.Errorf("icon %q not found", name)
+	}
+	return icon, nil
+}
+
+// File returns the name and the contents of the file the icon was loaded from
+func (icon *Icon) File() (string, []byte, error) {
+	if icon.source == nil {
+		return "", nil, fmt.Errorf("icon %q has no file", icon.Name)
+	}
+	data, err := fs.ReadFile(icon.source, icon.file)
+	return icon.file, data, err
+}
+
+// AllIcons returns every icon in the library, sorted by name
+func AllIcons() []*Icon {
+	iconsMu.RLock()
+	defer iconsMu.RUnlock()
+	result := make([]*Icon, 0, len(icons))
+	for _, icon := range icons {
+		result = append(result, icon)
+	}
+	slices.SortFunc(result, func(a, b *Icon) int { return strings.Compare(a.Name, b.Name) })
+	return result
+}
+
+// Recolor returns a copy of the icon in a single color. The brightness of each
+// pixel is kept, so shading in the icon stays visible.
+func (icon *Icon) Recolor(c color.RGBA) *Icon {
+	result := *icon
+	result.Frames = make([]*image.RGBA, len(icon.Frames))
+	for i, frame := range icon.Frames {
+		recolored := image.NewRGBA(frame.Rect)
+		for p := 0; p < len(frame.Pix); p += 4 {
+			brightness := int(max(frame.Pix[p+0], frame.Pix[p+1], frame.Pix[p+2]))
+			recolored.Pix[p+0] = byte(int(c.R) * brightness / 255)
+			recolored.Pix[p+1] = byte(int(c.G) * brightness / 255)
+			recolored.Pix[p+2] = byte(int(c.B) * brightness / 255)
+			recolored.Pix[p+3] = frame.Pix[p+3]
+		}
+		result.Frames[i] = recolored
+	}
+	return &result
+}
+
+// WithBackground returns a copy of the icon with the transparent parts filled
+// with the given color
+func (icon *Icon) WithBackground(c color.RGBA) *Icon {
+	result := *icon
+	result.Frames = make([]*image.RGBA, len(icon.Frames))
+	for i, frame := range icon.Frames {
+		filled := NewFrame(c)
+		draw.Draw(filled, filled.Bounds(), frame, image.Point{}, draw.Over)
+		result.Frames[i] = filled
+	}
+	return &result
+}
@@ -0,0 +1,68 @@
+package graphics
+
+import (
+	"image"
+	"image/draw"
+	"math"
+
+	xdraw "golang.org/x/image/draw"
+)
+
+// ToScaledRGBA scales the image to fit 16x16 pixels, keeping its aspect ratio
+// and centering it
+func ToScaledRGBA(img image.Image) *image.RGBA {
+	const target = 16
+
+	src := img.Bounds()
+	sw, sh := src.Dx(), src.Dy()
+
+	// Don't scale the image if it is already the right resolution
+	// (Do we need this? Not for the result, but it is faster...)
+	if sw == 16 && sh == 16 {
+		// Fast path: already RGBA
+		if rgba, ok := img.(*image.RGBA); ok {
+			return rgba
+		}
+
+		rgba := image.NewRGBA(src)
+		// Draw copies pixels and handles colorspace conversion
+		draw.Draw(rgba, src, img, src.Min, draw.Src)
+
+		return rgba
+	}
+
+	// Scale to fit within 16x16, preserving aspect ratio
+	scale := math.Min(
+		float64(target)/float64(sw),
+		float64(target)/float64(sh),
+	)
+
+	dw := int(math.Round(float64(sw) * scale))
+	dh := int(math.Round(float64(sh) * scale))
+	if dw < 1 {
+		dw = 1
+	}
+	if dh < 1 {
+		dh = 1
+	}
+
+	// 1) Resize into a temporary image of size dw x dh
+	scaled := image.NewRGBA(image.Rect(0, 0, dw, dh))
+	xdraw.CatmullRom.Scale(scaled, scaled.Bounds(), img, src, xdraw.Over, nil)
+
+	// 2) Composite onto a 16x16 canvas, centered (letterbox)
+	out := image.NewRGBA(image.Rect(0, 0, target, target))
+
+	ox := (target - dw) / 2
+	oy := (target - dh) / 2
+
+	draw.Draw(
+		out,
+		image.Rect(ox, oy, ox+dw, oy+dh),
+		scaled,
+		image.Point{},
+		draw.Over,
+	)
+
+	return out
+}
@@ -0,0 +1,252 @@
+package graphics
+
+// Renderers for data-driven widgets. Each function draws a complete 16x16
+// frame for one or more values.
+
+import (
+	"image"
+	"image/color"
+	"math"
+	"strconv"
+)
+
+const size = 16
+
+// Larger digits, for when there's only a few of them to show
+var bigGlyphs = map[rune][]string{
+	'0': {".##.", "#..#", "#..#", "#..#", "#..#", "#..#", ".##."},
+	'1': {"..#.", ".##.", "..#.", "..#.", "..#.", "..#.", ".###"},
+	'2': {".##.", "#..#", "...#", "..#.", ".#..", "#...", "####"},
+	'3': {"###.", "...#", "...#", ".##.", "...#", "...#", "###."},
+	'4': {"..##", ".#.#", "#..#", "####", "...#", "...#", "...#"},
+	'5': {"####", "#...", "###.", "...#", "...#", "#..#", ".##."},
+	'6': {".##.", "#...", "#...", "###.", "#..#", "#..#", ".##."},
+	'7': {"####", "...#", "..#.", "..#.", ".#..", ".#..", ".#.."},
+	'8': {".##.", "#..#", "#..#", ".##.", "#..#", "#..#", ".##."},
+	'9': {".##.", "#..#", "#..#", ".###", "...#", "...#", ".##."},
+	'-': {"....", "....", "....", "####", "....", "....", "...."},
+	'.': {".", ".", ".", ".", ".", ".", "#"},
+}
+
+// NewFrame returns a 16x16 frame filled with the background color
+func NewFrame(background color.Color) *image.RGBA {
+	img := image.NewRGBA(image.Rect(0, 0, size, size))
+	for y := 0; y < size; y++ {
+		for x := 0; x < size; x++ {
+			img.Set(x, y, background)
+		}
+	}
+	return img
+}
+
+// FormatValue shows a number with at most one decimal, and abbreviates it with
+// k or M if it wouldn't fit in the given number of characters
+func FormatValue(value float64, maxLength int) string {
+	text := strconv.FormatFloat(value, 'f', 1, 64)
+	if value == math.Trunc(value) || len(text) > maxLength {
+		text = strconv.FormatFloat(math.Round(value), 'f', 0, 64)
+	}
+	for _, unit := range []struct {
+		suffix string
+		size   float64
+	}{{"K", 1e3}, {"M", 1e6}, {"G", 1e9}} {
+		if len(text) <= maxLength {
+			break
+		}
+		text = strconv.FormatFloat(math.Round(value/unit.size), 'f', 0, 64) + unit.suffix
+	}
+	return text
+}
+
+// DrawCounter shows a single number, as large as it fits
+func DrawCounter(img *image.RGBA, value float64, c color.Color) {
+	text := FormatValue(value, 4)
+	if width, ok := bigTextWidth(text); ok && width <= size {
+		x := (size - width) / 2
+		for _, char := range text {
+			glyph := bigGlyphs[char]
+			for row, line := range glyph {
+				for column, pixel := range line {
+					if pixel == '#' {
+						setPixel(img, x+column, 4+row, c)
+					}
+				}
+			}
+			x += len(glyph[0]) + 1
+		}
+		return
+	}
+	DrawText(img, text, (size-TextWidth(text))/2, 5, c)
+}
+
+func bigTextWidth(text string) (int, bool) {
+	width := 0
+	for _, char := range text {
+		glyph, ok := bigGlyphs[char]
+		if !ok {
+			return 0, false
+		}
+		width += len(glyph[0]) + 1
+	}
+	return width - 1, true
+}
+
+// DrawProgressBar shows the fraction (zero to one) as a horizontal bar, with
+// the percentage above it
+func DrawProgressBar(img *image.RGBA, fraction float64, c, dim color.Color) {
+	fraction = min(max(fraction, 0), 1)
+	text := strconv.Itoa(int(math.Round(fraction*100))) + "%"
+	DrawText(img, text, (size-TextWidth(text))/2, 2, c)
+
+	filled := int(math.Round(fraction * 14))
+	for x := 0; x < size; x++ {
+		setPixel(img, x, 9, dim)
+		setPixel(img, x, 14, dim)
+	}
+	for y := 9; y < 15; y++ {
+		setPixel(img, 0, y, dim)
+		setPixel(img, size-1, y, dim)
+	}
+	for y := 10; y < 14; y++ {
+		for x := 1; x <= filled; x++ {
+			setPixel(img, x, y, c)
+		}
+	}
+}
+
+// DrawRadialProgress shows the fraction (zero to one) as a ring that fills up
+// clockwise from the top, with the percentage in the middle
+func DrawRadialProgress(img *image.RGBA, fraction float64, c, dim color.Color) {
+	fraction = min(max(fraction, 0), 1)
+	center := float64(size-1) / 2
+	for y := 0; y < size; y++ {
+		for x := 0; x < size; x++ {
+			dx, dy := float64(x)-center, float64(y)-center
+			distance := math.Hypot(dx, dy)
+			if distance < 5.8 || distance > 7.8 {
+				continue
+			}
+			angle := math.Atan2(dx, -dy) / (2 * math.Pi)
+			if angle < 0 {
+				angle += 1
+			}
+			if angle < fraction {
+				setPixel(img, x, y, c)
+			} else {
+				setPixel(img, x, y, dim)
+			}
+		}
+	}
+	text := strconv.Itoa(int(math.Round(fraction * 100)))
+	if fraction >= 1 {
+		text = "OK"
+	}
+	DrawText(img, text, (size-TextWidth(text))/2, 5, c)
+}
+
+// DrawSparkline draws the most recent values as a line, scaled between low and
+// high
+func DrawSparkline(img *image.RGBA, values []float64, low, high float64, c color.Color) {
+	values = lastValues(values)
+	offset := size - len(values)
+	previous := -1
+	for i, value := range values {
+		y := scaleToRow(value, low, high)
+		from, to := y, y
+		if previous >= 0 {
+			from, to = min(previous, y), max(previous, y)
+		}
+		for row := from; row <= to; row++ {
+			setPixel(img, offset+i, row, c)
+		}
+		previous = y
+	}
+}
+
+// DrawBarChart draws the most recent values as columns, scaled between low
+// and high
+func DrawBarChart(img *image.RGBA, values []float64, low, high float64, c color.Color) {
+	values = lastValues(values)
+	offset := size - len(values)
+	for i, value := range values {
+		for row := scaleToRow(value, low, high); row < size; row++ {
+			setPixel(img, offset+i, row, c)
+		}
+	}
+}
+
+// DrawTrend draws an arrow pointing up, down or sideways depending on the
+// direction from the previous to the current value, with the current value
+// below it
+func DrawTrend(img *image.RGBA, previous, current float64, up, down, flat color.Color) {
+	arrow := []string{
+		"....#....",
+		"...###...",
+		"..#####..",
+		".###.###.",
+		"###.#.###",
+		"....#....",
+		"....#....",
+		"....#....",
+		"....#....",
+	}
+	c := up
+	transform := func(x, y int) (int, int) { return x, y }
+	switch {
+	case current < previous:
+		c = down
+		transform = func(x, y int) (int, int) { return x, len(arrow) - 1 - y }
+	case current == previous:
+		c = flat
+		transform = func(x, y int) (int, int) { return len(arrow) - 1 - y, x }
+	}
+
+	for row, line := range arrow {
+		for column, pixel := range line {
+			if pixel == '#' {
+				x, y := transform(column, row)
+				setPixel(img, x+(size-len(line))/2, y, c)
+			}
+		}
+	}
+
+	text := FormatValue(current, 4)
+	DrawText(img, text, (size-TextWidth(text))/2, 11, c)
+}
+
+// SeriesRange returns the lowest and highest value in the series, making sure
+// they're not the same
+func SeriesRange(values []float64) (float64, float64) {
+	values = lastValues(values)
+	if len(values) == 0 {
+		return 0, 1
+	}
+	low, high := values[0], values[0]
+	for _, value := range values {
+		low, high = min(low, value), max(high, value)
+	}
+	if low == high {
+		low, high = low-1, high+1
+	}
+	return low, high
+}
+
+// Dim returns a darker version of the color, for backgrounds of bars
+func Dim(c color.RGBA) color.RGBA {
+	return color.RGBA{c.R / 5, c.G / 5, c.B / 5, c.A}
+}
+
+func lastValues(values []float64) []float64 {
+	if len(values) > size {
+		return values[len(values)-size:]
+	}
+	return values
+}
+
+func scaleToRow(value, low, high float64) int {
+	if high <= low {
+		return size - 1
+	}
+	fraction := min(max((value-low)/(high-low), 0), 1)
+	return size - 1 - int(math.Round(fraction*float64(size-1)))
+}
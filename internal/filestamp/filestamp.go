@@ -0,0 +1,24 @@
+package filestamp
+
+// A stamp tells whether a file changed since we last read or wrote it, without
+// reading it. It's used to notice changes to files that are edited by hand, like
+// the scenes and config.json.
+
+import (
+	"os"
+	"time"
+)
+
+type Stamp struct {
+	modTime time.Time
+	size    int64
+}
+
+// Of returns the stamp of the file, or the zero stamp if it doesn't exist
+func Of(path string) Stamp {
+	info, err := os.Stat(path)
+	if err != nil {
+		return Stamp{}
+	}
+	return Stamp{info.ModTime(), info.Size()}
+}
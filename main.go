@@ -7,8 +7,13 @@ import (
 	_ "image/png"
 	"io/fs"
 	"log"
+	"os"
+	"time"
+	_ "time/tzdata" // Time zones for the scheduler, even if the system has none
 
 	"github.com/timendus/pixelbox/controllers"
+	"github.com/timendus/pixelbox/graphics"
+	"github.com/timendus/pixelbox/models"
 	"github.com/timendus/pixelbox/protocol"
 
 	// Allow controllers to initialize themselves
@@ -20,18 +25,75 @@ import (
 //go:embed client
 var client embed.FS
 
+//go:embed icons
+var icons embed.FS
+
+const (
+	sceneDir     = "scenes"
+	playlistDir  = "playlists"
+	scheduleFile = "schedule.json"
+	varsFile     = "vars.json"
+)
+
 func main() {
+	if len(os.Args) > 1 && os.Args[1] == "migrate" {
+		os.Exit(migrate(os.Args[2:]))
+	}
+
+	configureScenes(server.GetConfig())
+	server.RegisterConfigListener(configureScenes)
+	if err := models.LoadScenes(sceneDir); err != nil {
+		log.Fatal(err)
+	}
+	if err := models.LoadAssets(sceneDir); err != nil {
+		log.Fatal(err)
+	}
+	if err := models.LoadPlaylists(playlistDir); err != nil {
+		log.Fatal(err)
+	}
+	if err := models.LoadSchedule(scheduleFile); err != nil {
+		log.Fatal(err)
+	}
+	if err := models.LoadVars(varsFile); err != nil {
+		log.Fatal(err)
+	}
+
 	subDir, err := fs.Sub(client, "client")
 	if err != nil {
 		panic(err)
 	}
 	server.StaticFS("/client", subDir)
+
+	iconDir, err := fs.Sub(icons, "icons")
+	if err != nil {
+		panic(err)
+	}
+	if err := graphics.LoadIcons(iconDir); err != nil {
+		log.Println("Could not load icons:", err)
+	}
+
 	server.Root("/client")
 	server.RegisterMessageListener(callback)
+	controllers.StartScheduler()
+	controllers.StartAssetCollector()
+	controllers.StartReloader()
 	defer server.Stop()
 	server.Start()
 }
 
+// configureScenes applies the scene settings from config.json
+func configureScenes(config server.Config) {
+	models.KeepRevisions.Set(config.Scenes.Revisions)
+	models.AnimationBudget.Set(protocol.AnimationBudget{
+		MaxFrames:    config.Animation.MaxFrames,
+		MaxBytes:     config.Animation.MaxBytes,
+		MinDuration:  config.Animation.MinDuration,
+		MaxDuration:  config.Animation.MaxDuration,
+		ZeroDuration: config.Animation.ZeroDuration,
+	})
+	models.AssetGracePeriod.Set(time.Duration(config.Scenes.UnusedAssetDays) * 24 * time.Hour)
+}
+
 func callback(message []byte) {
 	commands, err := protocol.ParseIncoming(message)
 	if err != nil {
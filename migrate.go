@@ -0,0 +1,57 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"os"
+	"strings"
+
+	"github.com/timendus/pixelbox/models"
+)
+
+// migrate implements `pixelbox migrate [--dry-run] [--dir scenes]`, which
+// upgrades the scene files to the current schema version without starting the
+// server. It returns the exit code.
+func migrate(args []string) int {
+	flags := flag.NewFlagSet("migrate", flag.ContinueOnError)
+	dryRun := flags.Bool("dry-run", false, "only report what would change")
+	dir := flags.String("dir", sceneDir, "directory holding the scene files")
+	if err := flags.Parse(args); err != nil {
+		return 2
+	}
+
+	reports, err := models.MigrateScenes(*dir, *dryRun)
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		return 1
+	}
+
+	failed := false
+	for _, report := range reports {
+		if report.Steps == nil {
+			fmt.Printf("%s: can't be read: %s\n", report.File, report.Error)
+			failed = true
+			continue
+		}
+		fmt.Printf("%s: schema version %d -> %d\n", report.File, report.From, report.To)
+		for _, step := range report.Steps {
+			fmt.Printf("  - %s\n", step)
+		}
+		fmt.Printf("  changes: %s\n", strings.Join(report.Changed, ", "))
+		if report.Error != "" {
+			fmt.Printf("  failed: %s\n", report.Error)
+			failed = true
+		}
+	}
+
+	switch {
+	case len(reports) == 0:
+		fmt.Printf("All scenes in %s are at schema version %d\n", *dir, models.SchemaVersion)
+	case *dryRun:
+		fmt.Println("Dry run, nothing was changed")
+	}
+	if failed {
+		return 1
+	}
+	return 0
+}
@@ -0,0 +1,319 @@
+package models
+
+// The asset library keeps the images and GIFs that are uploaded, so they can be
+// shown again and used in scenes. Assets are stored in the assets directory of
+// the scenes, named after the SHA-256 hash of their contents, so uploading the
+// same file twice stores it only once. What we know about them is kept in
+// `assets/index.json`.
+//
+// Scenes refer to assets by their hash, like `"image": { "asset": "<hash>" }`
+// (see storage.go). Assets that no scene, revision or scene in the trash uses
+// any more are removed by Collect, once they are older than AssetGracePeriod.
+// That way an upload that was only shown stays around for a while in case
+// someone wants to use it after all.
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"image"
+	"image/gif"
+	_ "image/jpeg"
+	"log"
+	"maps"
+	"os"
+	"path/filepath"
+	"regexp"
+	"slices"
+	"sync"
+	"time"
+)
+
+const assetIndex = "index.json"
+
+var assetHash = regexp.MustCompile(`^[0-9a-f]{64}$`)
+
+// AssetGracePeriod is how long unused assets are kept after they were uploaded
+var AssetGracePeriod = NewSetting(7 * 24 * time.Hour)
+
+type Asset struct {
+	Hash     string    `json:"hash"`
+	Type     string    `json:"type"`     // "png", "gif" or "jpeg"
+	Filename string    `json:"filename"` // The name it was uploaded with
+	Width    int       `json:"width"`
+	Height   int       `json:"height"`
+	Frames   int       `json:"frames"`
+	Size     int       `json:"size"` // In bytes
+	Uploaded time.Time `json:"uploaded"`
+}
+
+// File is the name of the asset in the assets directory
+func (asset Asset) File() string {
+	return asset.Hash + "." + asset.Type
+}
+
+type AssetRepository struct {
+	mu     sync.RWMutex
+	dir    string
+	assets map[string]Asset
+}
+
+// Assets is the repository the application uses. It is set by LoadAssets.
+var Assets *AssetRepository
+
+// LoadAssets loads the asset library of the scenes in the given directory into
+// Assets
+func LoadAssets(sceneDir string) error {
+	repository, err := NewAssetRepository(sceneDir)
+	if err != nil {
+		return err
+	}
+	Assets = repository
+	log.Printf("Loaded %d assets from file\n", len(Assets.assets))
+	return nil
+}
+
+// NewAssetRepository loads the index of the asset library of the scenes in the
+// given directory. A library that doesn't exist yet is empty.
+func NewAssetRepository(sceneDir string) (*AssetRepository, error) {
+	dir := filepath.Join(sceneDir, assetDir)
+	var assets []Asset
+	err := readJSONFile(filepath.Join(dir, assetIndex), &assets)
+	if err != nil && !os.IsNotExist(err) {
+		return nil, fmt.Errorf("can't read asset index from %s: %w", dir, err)
+	}
+	repository := AssetRepository{dir: dir, assets: make(map[string]Asset)}
+	for _, asset := range assets {
+		repository.assets[asset.Hash] = asset
+	}
+	return &repository, nil
+}
+
+// All returns the assets, most recently uploaded first
+func (r *AssetRepository) All() []Asset {
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+	result := slices.Collect(maps.Values(r.assets))
+	slices.SortFunc(result, func(a, b Asset) int { return b.Uploaded.Compare(a.Uploaded) })
+	return result
+}
+
+func (r *AssetRepository) Find(hash string) (Asset, error) {
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+	asset, ok := r.assets[hash]
+	if !ok {
+		return Asset{}, fmt.Errorf("asset not found")
+	}
+	return asset, nil
+}
+
+// Read returns the asset and the contents of its file
+func (r *AssetRepository) Read(hash string) (Asset, []byte, error) {
+	asset, err := r.Find(hash)
+	if err != nil {
+		return Asset{}, nil, err
+	}
+	data, err := os.ReadFile(filepath.Join(r.dir, asset.File()))
+	return asset, data, err
+}
+
+// Add stores the uploaded file, unless we already have it, and returns the
+// asset. Only PNG, GIF and JPEG images are accepted.
+func (r *AssetRepository) Add(data []byte, filename string) (Asset, error) {
+	config, format, err := image.DecodeConfig(bytes.NewReader(data))
+	if err != nil {
+		return Asset{}, fmt.Errorf("not a valid image: %w", err)
+	}
+	frames := 1
+	switch format {
+	case "png", "jpeg":
+	case "gif":
+		animation, err := gif.DecodeAll(bytes.NewReader(data))
+		if err != nil {
+			return Asset{}, fmt.Errorf("not a valid GIF file: %w", err)
+		}
+		frames = len(animation.Image)
+	default:
+		return Asset{}, fmt.Errorf("%s images are not supported, use PNG, GIF or JPEG", format)
+	}
+
+	sum := sha256.Sum256(data)
+	asset := Asset{
+		Hash:     hex.EncodeToString(sum[:]),
+		Type:     format,
+		Filename: filepath.Base(filename),
+		Width:    config.Width,
+		Height:   config.Height,
+		Frames:   frames,
+		Size:     len(data),
+		Uploaded: time.Now().UTC(),
+	}
+
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if existing, ok := r.assets[asset.Hash]; ok {
+		return existing, nil
+	}
+	if err := os.MkdirAll(r.dir, 0755); err != nil {
+		return Asset{}, err
+	}
+	if err := writeFileAtomic(filepath.Join(r.dir, asset.File()), data); err != nil {
+		return Asset{}, err
+	}
+	assets := maps.Clone(r.assets)
+	assets[asset.Hash] = asset
+	if err := r.writeIndex(assets); err != nil {
+		return Asset{}, err
+	}
+	r.assets = assets
+	return asset, nil
+}
+
+// Delete removes the asset, whether scenes use it or not
+func (r *AssetRepository) Delete(hash string) error {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	return r.remove(hash)
+}
+
+// Collect removes the assets that are older than AssetGracePeriod and that
+// aren't used by the scenes, their revisions or the scenes in the trash. It
+// returns the assets that were removed.
+func (r *AssetRepository) Collect(scenes *SceneRepository) ([]Asset, error) {
+	used, err := scenes.AssetReferences()
+	if err != nil {
+		return nil, err
+	}
+	cutoff := time.Now().Add(-AssetGracePeriod.Get())
+
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	removed := make([]Asset, 0)
+	for _, asset := range r.assets {
+		if used[asset.Hash] || asset.Uploaded.After(cutoff) {
+			continue
+		}
+		if err := r.remove(asset.Hash); err != nil {
+			return removed, err
+		}
+		removed = append(removed, asset)
+	}
+	return removed, nil
+}
+
+// remove deletes the file and the index entry of the asset. The caller should
+// hold the lock.
+func (r *AssetRepository) remove(hash string) error {
+	asset, ok := r.assets[hash]
+	if !ok {
+		return fmt.Errorf("asset not found")
+	}
+	assets := maps.Clone(r.assets)
+	delete(assets, hash)
+	if err := r.writeIndex(assets); err != nil {
+		return err
+	}
+	r.assets = assets
+	if err := os.Remove(filepath.Join(r.dir, asset.File())); err != nil && !os.IsNotExist(err) {
+		log.Println("Could not remove asset file "+asset.File(), err)
+	}
+	return nil
+}
+
+func (r *AssetRepository) writeIndex(assets map[string]Asset) error {
+	list := slices.SortedFunc(maps.Values(assets), func(a, b Asset) int { return a.Uploaded.Compare(b.Uploaded) })
+	return writeJSONFile(filepath.Join(r.dir, assetIndex), list)
+}
+
+/* References from scenes */
+
+// ScenesByAsset returns the scenes that use each asset, by asset name or hash
+func (r *SceneRepository) ScenesByAsset() map[string][]*Scene {
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+	result := make(map[string][]*Scene)
+	for _, scene := range r.scenes {
+		for _, name := range scene.assets() {
+			if !slices.Contains(result[name], scene) {
+				result[name] = append(result[name], scene)
+			}
+		}
+	}
+	return result
+}
+
+// AssetReferences returns the names and hashes of all assets that are used by
+// the scenes, their revisions and the scenes in the trash
+func (r *SceneRepository) AssetReferences() (map[string]bool, error) {
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+	result := make(map[string]bool)
+	for _, scene := range r.scenes {
+		for _, name := range scene.assets() {
+			result[name] = true
+		}
+	}
+
+	var files []string
+	for _, pattern := range []string{
+		filepath.Join(r.dir, revisionsDir, "*", "*.json"),
+		filepath.Join(r.dir, trashDir, "*.json"),
+		filepath.Join(r.dir, trashDir, revisionsDir, "*", "*.json"),
+	} {
+		matches, err := filepath.Glob(pattern)
+		if err != nil {
+			return nil, err
+		}
+		files = append(files, matches...)
+	}
+	for _, file := range files {
+		data, err := os.ReadFile(file)
+		if err != nil {
+			return nil, err
+		}
+		// Decoding the whole scene would load its assets, we only need their
+		// names
+		var doc any
+		if err := json.Unmarshal(data, &doc); err != nil {
+			log.Println("Can't decode JSON file "+file, err)
+			continue
+		}
+		findAssetReferences(doc, result)
+	}
+	return result, nil
+}
+
+// assets returns the names and hashes of the assets the scene uses
+func (scene *Scene) assets() []string {
+	var result []string
+	for _, img := range scene.images() {
+		if img.Asset != "" {
+			result = append(result, img.Asset)
+		}
+	}
+	for _, animation := range scene.animations() {
+		if animation.Asset != "" {
+			result = append(result, animation.Asset)
+		}
+	}
+	return result
+}
+
+func findAssetReferences(value any, result map[string]bool) {
+	switch v := value.(type) {
+	case map[string]any:
+		if asset, _ := v["asset"].(string); asset != "" {
+			result[asset] = true
+		}
+		for _, child := range v {
+			findAssetReferences(child, result)
+		}
+	case []any:
+		for _, child := range v {
+			findAssetReferences(child, result)
+		}
+	}
+}
@@ -0,0 +1,281 @@
+package models
+
+// Scene settings can be bound to variables by using a template instead of a
+// value, like `"temperature": "{{outside_temp}}"` or `"color": "{{accent}}"`.
+// A template that is the whole value is replaced by the value of the variable,
+// whatever its type. Templates inside a longer string, like `"{{temp}} C"` in a
+// text layer, are replaced by the variable as text.
+//
+// When decoding a scene, the templates are taken out of the document and kept
+// by the path of the setting, like `composite.layers[0].text.text`, so the
+// rest of the scene decodes as usual. When encoding, they are put back. When
+// compiling, they are replaced by the current values of the variables.
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"math"
+	"reflect"
+	"regexp"
+	"slices"
+	"strconv"
+	"strings"
+)
+
+var (
+	templatePattern = regexp.MustCompile(`\{\{\s*([A-Za-z0-9_.-]+)\s*\}\}`)
+	wholeTemplate   = regexp.MustCompile(`^\{\{\s*([A-Za-z0-9_.-]+)\s*\}\}$`)
+)
+
+// plainScene is a Scene without the JSON methods below
+type plainScene Scene
+
+func (scene Scene) MarshalJSON() ([]byte, error) {
+	data, err := json.Marshal(plainScene(scene))
+	if err != nil || len(scene.bindings) == 0 {
+		return data, err
+	}
+	values := make(map[string]any, len(scene.bindings))
+	for path, template := range scene.bindings {
+		values[path] = template
+	}
+	return setJSONPaths(data, values)
+}
+
+func (scene *Scene) UnmarshalJSON(data []byte) error {
+	bindings := make(map[string]string)
+	if bytes.Contains(data, []byte("{{")) {
+		var doc any
+		if err := json.Unmarshal(data, &doc); err != nil {
+			return err
+		}
+		extractBindings(doc, "", bindings)
+		var err error
+		if data, err = json.Marshal(doc); err != nil {
+			return err
+		}
+	}
+
+	var plain plainScene
+	if err := json.Unmarshal(data, &plain); err != nil {
+		return err
+	}
+	*scene = Scene(plain)
+	if len(bindings) > 0 {
+		scene.bindings = bindings
+		// The stored message has the values the variables had back then
+		scene.MessageDirty = true
+	}
+	return nil
+}
+
+// Variables returns the names of the variables the scene uses
+func (scene *Scene) Variables() []string {
+	result := make([]string, 0)
+	for _, template := range scene.bindings {
+		for _, match := range templatePattern.FindAllStringSubmatch(template, -1) {
+			if !slices.Contains(result, match[1]) {
+				result = append(result, match[1])
+			}
+		}
+	}
+	slices.Sort(result)
+	return result
+}
+
+// Uses tells whether the scene uses the given variable
+func (scene *Scene) Uses(variable string) bool {
+	return slices.Contains(scene.Variables(), variable)
+}
+
+// isBound tells whether the setting with the given path, or the setting it is
+// part of, is bound to a variable
+func (scene *Scene) isBound(field string) bool {
+	for path := range scene.bindings {
+		if field == path || strings.HasPrefix(field, path+".") || strings.HasPrefix(field, path+"[") {
+			return true
+		}
+	}
+	return false
+}
+
+// resolve returns a copy of the scene with the templates replaced by the
+// current values of the variables
+func (scene *Scene) resolve() (*Scene, error) {
+	if len(scene.bindings) == 0 {
+		return scene, nil
+	}
+	values := make(map[string]any, len(scene.bindings))
+	for path, template := range scene.bindings {
+		value, err := fillTemplate(template)
+		if err != nil {
+			return nil, fmt.Errorf("%s: %w", path, err)
+		}
+		// Sensors often report numbers like 12.3, round them for settings
+		// that are whole numbers
+		if number, ok := value.(float64); ok && isIntegerField(path) {
+			value = math.Round(number)
+		}
+		values[path] = value
+	}
+
+	data, err := json.Marshal(plainScene(*scene))
+	if err != nil {
+		return nil, err
+	}
+	if data, err = setJSONPaths(data, values); err != nil {
+		return nil, err
+	}
+	var resolved plainScene
+	if err := json.Unmarshal(data, &resolved); err != nil {
+		return nil, fmt.Errorf("variable has the wrong type: %w", err)
+	}
+	result := Scene(resolved)
+	return &result, nil
+}
+
+func fillTemplate(template string) (any, error) {
+	if match := wholeTemplate.FindStringSubmatch(template); match != nil {
+		value, ok := Vars.Get(match[1])
+		if !ok {
+			return nil, fmt.Errorf("variable %q is not set", match[1])
+		}
+		return value, nil
+	}
+
+	var err error
+	result := templatePattern.ReplaceAllStringFunc(template, func(match string) string {
+		name := templatePattern.FindStringSubmatch(match)[1]
+		value, ok := Vars.Get(name)
+		if !ok {
+			err = fmt.Errorf("variable %q is not set", name)
+			return ""
+		}
+		return fmt.Sprint(value)
+	})
+	return result, err
+}
+
+// extractBindings replaces the strings with templates in the decoded JSON
+// document with null, and adds them to the bindings by their path
+func extractBindings(value any, path string, bindings map[string]string) any {
+	switch v := value.(type) {
+	case map[string]any:
+		for key, child := range v {
+			childPath := key
+			if path != "" {
+				childPath = path + "." + key
+			}
+			v[key] = extractBindings(child, childPath, bindings)
+		}
+	case []any:
+		for i, child := range v {
+			v[i] = extractBindings(child, fmt.Sprintf("%s[%d]", path, i), bindings)
+		}
+	case string:
+		if templatePattern.MatchString(v) {
+			bindings[path] = v
+			return nil
+		}
+	}
+	return value
+}
+
+// setJSONPaths sets the values at the given paths in the JSON document
+func setJSONPaths(data []byte, values map[string]any) ([]byte, error) {
+	var doc any
+	if err := json.Unmarshal(data, &doc); err != nil {
+		return nil, err
+	}
+	for path, value := range values {
+		if err := setJSONPath(doc, path, value); err != nil {
+			return nil, err
+		}
+	}
+	return json.Marshal(doc)
+}
+
+func setJSONPath(doc any, path string, value any) error {
+	steps := splitPath(path)
+	current := doc
+	for i, step := range steps {
+		last := i == len(steps)-1
+		switch c := current.(type) {
+		case map[string]any:
+			if last {
+				c[step] = value
+				return nil
+			}
+			if c[step] == nil {
+				c[step] = make(map[string]any)
+			}
+			current = c[step]
+		case []any:
+			index, err := strconv.Atoi(step)
+			if err != nil || index < 0 || index >= len(c) {
+				return fmt.Errorf("%s doesn't exist", path)
+			}
+			if last {
+				c[index] = value
+				return nil
+			}
+			current = c[index]
+		default:
+			return fmt.Errorf("%s doesn't exist", path)
+		}
+	}
+	return nil
+}
+
+// isIntegerField tells whether the setting with the given path is a whole
+// number, like the temperature or the brightness
+func isIntegerField(path string) bool {
+	t := reflect.TypeFor[plainScene]()
+	for _, step := range splitPath(path) {
+		for t.Kind() == reflect.Pointer {
+			t = t.Elem()
+		}
+		switch t.Kind() {
+		case reflect.Slice, reflect.Array:
+			t = t.Elem()
+		case reflect.Struct:
+			field, ok := jsonField(t, step)
+			if !ok {
+				return false
+			}
+			t = field.Type
+		default:
+			return false
+		}
+	}
+	for t.Kind() == reflect.Pointer {
+		t = t.Elem()
+	}
+	switch t.Kind() {
+	case reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64,
+		reflect.Uint, reflect.Uint8, reflect.Uint16, reflect.Uint32, reflect.Uint64:
+		return true
+	}
+	return false
+}
+
+// jsonField finds the field of the struct type with the given JSON name
+func jsonField(t reflect.Type, name string) (reflect.StructField, bool) {
+	for i := range t.NumField() {
+		field := t.Field(i)
+		tag, _, _ := strings.Cut(field.Tag.Get("json"), ",")
+		if tag == name || (tag == "" && field.Name == name) {
+			return field, true
+		}
+	}
+	return reflect.StructField{}, false
+}
+
+// splitPath splits a path like `composite.layers[0].text` into its steps:
+// `composite`, `layers`, `0` and `text`
+func splitPath(path string) []string {
+	path = strings.ReplaceAll(path, "[", ".")
+	path = strings.ReplaceAll(path, "]", "")
+	return strings.Split(path, ".")
+}
@@ -0,0 +1,291 @@
+package models
+
+// A bundle is a zip file with scenes, to move them from one PixelBox to
+// another. It holds a manifest, the scene files and the icons the scenes use:
+//
+//	manifest.json
+//	scenes/<uuid>.json
+//	icons/<name>.png
+//
+// Icons are built into PixelBox, so importing doesn't install them. They are
+// in the bundle so nothing is lost when the other PixelBox is missing one.
+
+import (
+	"archive/zip"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"slices"
+	"strconv"
+	"time"
+
+	"github.com/google/uuid"
+	"github.com/timendus/pixelbox/graphics"
+)
+
+const (
+	bundleFormat       = 1
+	maxBundleSceneSize = 16 << 20 // Bytes, against zip bombs
+)
+
+type BundleManifest struct {
+	Format        int           `json:"format"`
+	SchemaVersion int           `json:"schemaVersion"`
+	Exported      time.Time     `json:"exported"`
+	Scenes        []BundleScene `json:"scenes"`
+	Icons         []string      `json:"icons"`
+}
+
+type BundleScene struct {
+	Uuid uuid.UUID `json:"uuid"`
+	Id   string    `json:"id"`
+	Name string    `json:"name"`
+	File string    `json:"file"`
+}
+
+// What to do with an imported scene that has the same UUID or ID as a scene we
+// already have
+const (
+	ConflictSkip      = "skip"      // Keep our scene, ignore the imported one
+	ConflictOverwrite = "overwrite" // Replace our scene with the imported one
+	ConflictKeepBoth  = "keep"      // Add the imported scene with a new UUID or ID
+)
+
+// ImportReport tells what happened to a scene from a bundle
+type ImportReport struct {
+	File     string           `json:"file"`
+	Uuid     uuid.UUID        `json:"uuid"` // The UUID the scene has here
+	Id       string           `json:"id"`
+	Name     string           `json:"name"`
+	Result   string           `json:"result"`             // "created", "overwritten", "copied", "skipped" or "failed"
+	Conflict string           `json:"conflict,omitempty"` // "uuid" or "id"
+	Error    string           `json:"error,omitempty"`
+	Fields   ValidationErrors `json:"fields,omitempty"` // If the scene is invalid
+}
+
+// WriteBundle writes a zip file with the given scenes and the icons they use
+func WriteBundle(w io.Writer, scenes []*Scene) error {
+	archive := zip.NewWriter(w)
+	manifest := BundleManifest{
+		Format:        bundleFormat,
+		SchemaVersion: SchemaVersion,
+		Exported:      time.Now(),
+		Scenes:        make([]BundleScene, 0, len(scenes)),
+		Icons:         make([]string, 0),
+	}
+
+	for _, scene := range scenes {
+		file := "scenes/" + scene.Uuid.String() + ".json"
+		data, err := encodeScene(scene, true)
+		if err != nil {
+			return err
+		}
+		if err := writeBundleFile(archive, file, data); err != nil {
+			return err
+		}
+		manifest.Scenes = append(manifest.Scenes, BundleScene{scene.Uuid, scene.Id, scene.Name, file})
+
+		for _, name := range scene.icons() {
+			if !slices.Contains(manifest.Icons, name) {
+				manifest.Icons = append(manifest.Icons, name)
+			}
+		}
+	}
+
+	for _, name := range manifest.Icons {
+		icon, err := graphics.FindIcon(name)
+		if err != nil {
+			continue // The scene can't be shown here either, but it's still exported
+		}
+		file, data, err := icon.File()
+		if err != nil {
+			return err
+		}
+		f, err := createInBundle(archive, "icons/"+file)
+		if err != nil {
+			return err
+		}
+		if _, err := f.Write(data); err != nil {
+			return err
+		}
+	}
+
+	if err := writeBundleJSON(archive, "manifest.json", manifest); err != nil {
+		return err
+	}
+	return archive.Close()
+}
+
+func writeBundleJSON(archive *zip.Writer, file string, value any) error {
+	data, err := json.MarshalIndent(value, "", "  ")
+	if err != nil {
+		return err
+	}
+	return writeBundleFile(archive, file, append(data, '\n'))
+}
+
+func writeBundleFile(archive *zip.Writer, file string, data []byte) error {
+	f, err := createInBundle(archive, file)
+	if err != nil {
+		return err
+	}
+	_, err = f.Write(data)
+	return err
+}
+
+func createInBundle(archive *zip.Writer, file string) (io.Writer, error) {
+	return archive.CreateHeader(&zip.FileHeader{Name: file, Method: zip.Deflate, Modified: time.Now()})
+}
+
+// ImportBundle adds the scenes in the bundle to the repository, upgrading them
+// to the current schema version, and resolving conflicts with the given policy.
+// It returns a report for each scene in the bundle. An error means the bundle
+// itself is unusable.
+func (r *SceneRepository) ImportBundle(bundle *zip.Reader, policy string) ([]ImportReport, error) {
+	if !slices.Contains([]string{ConflictSkip, ConflictOverwrite, ConflictKeepBoth}, policy) {
+		return nil, fmt.Errorf("unknown conflict policy %q, use skip, overwrite or keep", policy)
+	}
+
+	var manifest BundleManifest
+	f, err := bundle.Open("manifest.json")
+	if err != nil {
+		return nil, fmt.Errorf("not a scene bundle: %w", err)
+	}
+	err = json.NewDecoder(f).Decode(&manifest)
+	f.Close()
+	if err != nil {
+		return nil, fmt.Errorf("invalid manifest: %w", err)
+	}
+	if manifest.Format > bundleFormat {
+		return nil, fmt.Errorf("bundle was made by a newer version of PixelBox (format %d)", manifest.Format)
+	}
+
+	reports := make([]ImportReport, len(manifest.Scenes))
+	scenes := make([]*Scene, len(manifest.Scenes))
+	for i, entry := range manifest.Scenes {
+		reports[i] = ImportReport{File: entry.File, Uuid: entry.Uuid, Id: entry.Id, Name: entry.Name}
+		scenes[i], err = readBundleScene(bundle, entry.File)
+		if err != nil {
+			reports[i].Result = "failed"
+			reports[i].Error = err.Error()
+		}
+	}
+
+	// Sequences go last, so the scenes they show are there, and we know which
+	// of those got a new UUID or ID
+	renamed := make(map[string]string)
+	for _, sequences := range []bool{false, true} {
+		for i, scene := range scenes {
+			if scene == nil || (scene.SceneType == "sequence") != sequences {
+				continue
+			}
+			if err := r.importScene(scene, policy, renamed, &reports[i]); err != nil {
+				reports[i].Result = "failed"
+				reports[i].Error = err.Error()
+				errors.As(err, &reports[i].Fields)
+			}
+		}
+	}
+	return reports, nil
+}
+
+func readBundleScene(bundle *zip.Reader, file string) (*Scene, error) {
+	data, err := readZipFile(bundle, file)
+	if err != nil {
+		return nil, err
+	}
+	scene, _, err := migrateScene(data)
+	return scene, err
+}
+
+// importScene adds a scene from a bundle. Renamed maps the UUIDs and IDs of
+// scenes from the bundle that were copied under a new one, so the steps of
+// sequences keep showing the imported scenes.
+func (r *SceneRepository) importScene(scene *Scene, policy string, renamed map[string]string, report *ImportReport) error {
+	report.Uuid, report.Id, report.Name = scene.Uuid, scene.Id, scene.Name
+	for i, step := range scene.Sequence.Steps {
+		if name, ok := renamed[step.Scene]; ok {
+			scene.Sequence.Steps[i].Scene = name
+		}
+	}
+
+	existing, err := r.FindByUUID(scene.Uuid)
+	uuidTaken := err == nil
+	if uuidTaken {
+		report.Conflict = "uuid"
+	} else if existing, err = r.FindById(scene.Id); err == nil {
+		report.Conflict = "id"
+	}
+	_, err = r.FindById(scene.Id)
+	idTaken := err == nil
+
+	switch {
+	case existing == nil:
+		report.Result = "created"
+		return r.Add(scene)
+
+	case policy == ConflictSkip:
+		report.Result = "skipped"
+		report.Uuid, report.Id = existing.Uuid, existing.Id
+		return nil
+
+	case policy == ConflictOverwrite:
+		report.Result = "overwritten"
+		report.Uuid = existing.Uuid
+		_, err := r.Update(existing, scene)
+		return err
+
+	default:
+		report.Result = "copied"
+		if uuidTaken {
+			id, err := uuid.NewV7()
+			if err != nil {
+				return err
+			}
+			renamed[scene.Uuid.String()] = id.String()
+			scene.Uuid = id
+		}
+		if idTaken {
+			id := r.uniqueId(scene.Id)
+			renamed[scene.Id] = id
+			scene.Id = id
+		}
+		report.Uuid, report.Id = scene.Uuid, scene.Id
+		return r.Add(scene)
+	}
+}
+
+// uniqueId returns the ID with a number added, like `clock-2`, so no scene has
+// it yet
+func (r *SceneRepository) uniqueId(id string) string {
+	for i := 2; ; i++ {
+		candidate := id + "-" + strconv.Itoa(i)
+		if _, err := r.FindById(candidate); err != nil {
+			return candidate
+		}
+	}
+}
+
+func readZipFile(bundle *zip.Reader, file string) ([]byte, error) {
+	f, err := bundle.Open(file)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	return io.ReadAll(io.LimitReader(f, maxBundleSceneSize))
+}
+
+// icons returns the names of the library icons the scene uses
+func (scene *Scene) icons() []string {
+	result := make([]string, 0)
+	if scene.SceneType != "composite" {
+		return result
+	}
+	for _, layer := range scene.Composite.Layers {
+		if layer.LType == "icon" && !slices.Contains(result, layer.Icon.Name) {
+			result = append(result, layer.Icon.Name)
+		}
+	}
+	return result
+}
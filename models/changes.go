@@ -0,0 +1,61 @@
+package models
+
+// Every version of a scene has an ETag, a hash of its contents, so clients can
+// tell whether a scene changed since they last saw it. Listeners get told about
+// every change to the scenes in the repository.
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+
+	"github.com/google/uuid"
+)
+
+// SceneChange describes a change to the scenes in the repository
+type SceneChange struct {
+	Change string    `json:"change"` // "created", "updated" or "deleted"
+	Uuid   uuid.UUID `json:"uuid"`
+	Id     string    `json:"id"`
+	ETag   string    `json:"etag,omitempty"` // Of the new version
+}
+
+var sceneListeners []func(SceneChange)
+
+// RegisterSceneListener registers a function to call whenever a scene is
+// created, updated or deleted. It is called while the repository is locked, so
+// it shouldn't use the repository itself.
+func RegisterSceneListener(listener func(SceneChange)) {
+	sceneListeners = append(sceneListeners, listener)
+}
+
+func notifySceneListeners(change string, scene *Scene) {
+	sceneChange := SceneChange{Change: change, Uuid: scene.Uuid, Id: scene.Id}
+	if change != "deleted" {
+		sceneChange.ETag = scene.ETag()
+	}
+	for _, listener := range sceneListeners {
+		listener(sceneChange)
+	}
+}
+
+// ETag returns a quoted hash of the contents of the scene, as used in the HTTP
+// ETag header
+func (scene *Scene) ETag() string {
+	if scene.etag != "" {
+		return scene.etag
+	}
+	return scene.computeETag()
+}
+
+func (scene *Scene) computeETag() string {
+	contents := *scene
+	contents.Message = nil
+	contents.MessageDirty = false
+	data, err := json.Marshal(&contents)
+	if err != nil {
+		return ""
+	}
+	hash := sha256.Sum256(data)
+	return `"` + hex.EncodeToString(hash[:8]) + `"`
+}
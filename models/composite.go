@@ -0,0 +1,312 @@
+package models
+
+// A composite scene stacks multiple layers into a single 16x16 image or
+// animation. The first layer is at the bottom. Every layer has a position, an
+// opacity and a blend mode, and one of the sources below.
+//
+// If layers are animated, their animations loop independently. The resulting
+// animation lasts long enough for all the animations to line up again, but at
+// most four times the duration of the longest animation. After that, shorter
+// animations may jump back to their first frame early. Composites that would
+// need more than maxCompositeFrames frames for that are refused.
+
+import (
+	"fmt"
+	"image"
+	"image/color"
+	"image/draw"
+	"slices"
+
+	"github.com/timendus/pixelbox/graphics"
+	"github.com/timendus/pixelbox/protocol"
+)
+
+type Composite struct {
+	Layers []Layer `json:"layers"`
+}
+
+type Layer struct {
+	LType     string             `json:"type"`
+	X         int                `json:"x"`
+	Y         int                `json:"y"`
+	Opacity   *float64           `json:"opacity"`
+	Blend     graphics.BlendMode `json:"blend"`
+	Image     Image              `json:"image"`
+	Animation Animation          `json:"animation"`
+	Text      Text               `json:"text"`
+	Progress  Progress           `json:"progress"`
+	Icon      LayerIcon          `json:"icon"`
+}
+
+type Text struct {
+	Text   string `json:"text"`
+	Color  string `json:"color"`
+	Scroll bool   `json:"scroll"`
+	Speed  int    `json:"speed"` // Milliseconds per pixel when scrolling
+}
+
+type LayerIcon struct {
+	Name  string `json:"name"`
+	Color string `json:"color"` // Optional, recolors the icon
+}
+
+type Progress struct {
+	Value      int    `json:"value"` // Percentage
+	Width      int    `json:"width"`
+	Height     int    `json:"height"`
+	Color      string `json:"color"`
+	Background string `json:"background"`
+}
+
+const (
+	defaultScrollSpeed   = 100
+	maxCompositeDuration = 4    // Times the longest layer animation
+	maxCompositeFrames   = 2048 // Before fitting them within AnimationBudget
+	maxCompositeLayers   = 16
+	maxLayerFrames       = 256
+
+	// MaxTextLength is the longest text a layer can show, in characters
+	MaxTextLength = 200
+)
+
+// A layer rendered to one or more frames. A static layer has a single frame
+// and no durations.
+type layerFrames struct {
+	frames    []*image.RGBA
+	durations []int
+}
+
+func (l *layerFrames) total() int {
+	total := 0
+	for _, duration := range l.durations {
+		total += duration
+	}
+	return total
+}
+
+// frameAt returns the frame that is showing at the given moment, looping the
+// animation if needed
+func (l *layerFrames) frameAt(moment int) *image.RGBA {
+	total := l.total()
+	if total == 0 {
+		return l.frames[0]
+	}
+	moment %= total
+	for i, duration := range l.durations {
+		if moment < duration {
+			return l.frames[i]
+		}
+		moment -= duration
+	}
+	return l.frames[len(l.frames)-1]
+}
+
+// Render flattens the layers into frames and their durations. If nothing in
+// the composite is animated, a single frame is returned with no durations.
+func (composite *Composite) Render() ([]*image.RGBA, []int, error) {
+	layers := make([]layerFrames, len(composite.Layers))
+	longest := 0
+	for i := range composite.Layers {
+		rendered, err := composite.Layers[i].render()
+		if err != nil {
+			return nil, nil, fmt.Errorf("layer %d: %w", i, err)
+		}
+		layers[i] = *rendered
+		longest = max(longest, rendered.total())
+	}
+
+	// Find the length of the output animation
+	length := 0
+	for _, layer := range layers {
+		if total := layer.total(); total > 0 {
+			if length == 0 {
+				length = total
+			} else {
+				length = lcm(length, total)
+			}
+			if length > longest*maxCompositeDuration {
+				length = longest * maxCompositeDuration
+				break
+			}
+		}
+	}
+
+	// Every moment a frame changes in any of the layers, we need a new frame
+	moments := []int{0}
+	for _, layer := range layers {
+		total := layer.total()
+		if total == 0 {
+			continue
+		}
+		for start := 0; start < length; start += total {
+			moment := start
+			for _, duration := range layer.durations {
+				moment += duration
+				if moment < length {
+					moments = append(moments, moment)
+				}
+			}
+		}
+	}
+	slices.Sort(moments)
+	moments = slices.Compact(moments)
+	if len(moments) > maxCompositeFrames {
+		return nil, nil, fmt.Errorf("the layers need %d frames together, the maximum is %d", len(moments), maxCompositeFrames)
+	}
+
+	frames := make([]*image.RGBA, 0, len(moments))
+	durations := make([]int, 0, len(moments))
+	for i, moment := range moments {
+		canvas := image.NewRGBA(image.Rect(0, 0, Width, Height))
+		for p := 3; p < len(canvas.Pix); p += 4 {
+			canvas.Pix[p] = 0xFF
+		}
+		for l, layer := range layers {
+			source := composite.Layers[l]
+			opacity := 1.0
+			if source.Opacity != nil {
+				opacity = *source.Opacity
+			}
+			if err := graphics.Blend(canvas, layer.frameAt(moment), source.X, source.Y, opacity, source.Blend); err != nil {
+				return nil, nil, fmt.Errorf("layer %d: %w", l, err)
+			}
+		}
+		frames = append(frames, canvas)
+		if length > 0 {
+			next := length
+			if i+1 < len(moments) {
+				next = moments[i+1]
+			}
+			durations = append(durations, next-moment)
+		}
+	}
+
+	if length == 0 {
+		return frames, nil, nil
+	}
+	return frames, durations, nil
+}
+
+// ToMessage renders the composite to either a static image or an animation,
+// fitted within AnimationBudget
+func (composite *Composite) ToMessage() ([]byte, error) {
+	frames, durations, err := composite.Render()
+	if err != nil {
+		return nil, err
+	}
+	if len(durations) == 0 {
+		return protocol.ShowImage(frames[0])
+	}
+	message, _, err := protocol.FitAnimation(frames, durations, AnimationBudget.Get())
+	return message, err
+}
+
+func (layer *Layer) render() (*layerFrames, error) {
+	switch layer.LType {
+	case "image":
+		return &layerFrames{frames: []*image.RGBA{PixelsToRGBA(layer.Image.Pixels)}}, nil
+
+	case "animation":
+		if len(layer.Animation.Frames) == 0 {
+			return nil, fmt.Errorf("animation has no frames")
+		}
+		result := layerFrames{}
+		for _, frame := range layer.Animation.Frames {
+			result.frames = append(result.frames, PixelsToRGBA(frame.Pixels))
+			result.durations = append(result.durations, max(frame.Duration, 1))
+		}
+		return &result, nil
+
+	case "text":
+		return layer.Text.render(Width - layer.X), nil
+
+	case "progress":
+		return &layerFrames{frames: []*image.RGBA{layer.Progress.render()}}, nil
+
+	case "icon":
+		icon, err := graphics.FindIcon(layer.Icon.Name)
+		if err != nil {
+			return nil, err
+		}
+		if layer.Icon.Color != "" {
+			icon = icon.Recolor(hexColor(layer.Icon.Color, ""))
+		}
+		if !icon.Animated {
+			return &layerFrames{frames: icon.Frames[:1]}, nil
+		}
+		result := layerFrames{frames: icon.Frames}
+		for _, duration := range icon.Durations {
+			result.durations = append(result.durations, max(duration, 1))
+		}
+		return &result, nil
+
+	default:
+		return nil, fmt.Errorf("unknown layer type %q", layer.LType)
+	}
+}
+
+// render draws the text. If the text is set to scroll and doesn't fit in the
+// available width, it scrolls in from the right until it has disappeared on
+// the left.
+func (text *Text) render(available int) *layerFrames {
+	strip := graphics.RenderText(text.Text, hexColor(text.Color, "#FFFFFF"))
+	width := strip.Bounds().Dx()
+	if !text.Scroll || width <= available || available <= 0 {
+		return &layerFrames{frames: []*image.RGBA{strip}}
+	}
+
+	speed := text.Speed
+	if speed <= 0 {
+		speed = defaultScrollSpeed
+	}
+	result := layerFrames{}
+	for offset := available; offset > -width; offset-- {
+		frame := image.NewRGBA(image.Rect(0, 0, available, graphics.GlyphHeight))
+		draw.Draw(frame, strip.Bounds().Add(image.Pt(offset, 0)), strip, image.Point{}, draw.Src)
+		result.frames = append(result.frames, frame)
+		result.durations = append(result.durations, speed)
+	}
+	return &result
+}
+
+// render draws a horizontal progress bar, filling from the left
+func (progress *Progress) render() *image.RGBA {
+	width, height := progress.Width, progress.Height
+	if width <= 0 {
+		width = Width
+	}
+	if height <= 0 {
+		height = 2
+	}
+	value := min(max(progress.Value, 0), 100)
+	filled := (width*value + 50) / 100
+
+	img := image.NewRGBA(image.Rect(0, 0, width, height))
+	for y := 0; y < height; y++ {
+		for x := 0; x < width; x++ {
+			if x < filled {
+				img.Set(x, y, hexColor(progress.Color, "#FFFFFF"))
+			} else if progress.Background != "" {
+				img.Set(x, y, hexColor(progress.Background, ""))
+			}
+		}
+	}
+	return img
+}
+
+// hexColor converts a color like "#FF0000" to an opaque RGBA color, using the
+// fallback if the color is empty
+func hexColor(hex, fallback string) color.RGBA {
+	if hex == "" {
+		hex = fallback
+	}
+	return graphics.ParseColor(hex)
+}
+
+func lcm(a, b int) int {
+	x, y := a, b
+	for y != 0 {
+		x, y = y, x%y
+	}
+	return a / x * b
+}
@@ -0,0 +1,180 @@
+package models
+
+// A parser for the usual five field cron expressions: minute, hour, day of the
+// month, month and day of the week. Fields can hold `*`, numbers, ranges like
+// `1-5`, lists like `1,15` and steps like `*/10` or `8-18/2`. Months and days
+// of the week can be given by their first three letters. The shortcuts
+// `@yearly`, `@monthly`, `@weekly`, `@daily` and `@hourly` work too.
+//
+// Like in cron, if both the day of the month and the day of the week are
+// restricted, a day matches if either of them matches.
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+	"time"
+)
+
+type CronExpression struct {
+	minute     uint64
+	hour       uint64
+	dayOfMonth uint64
+	month      uint64
+	dayOfWeek  uint64
+	anyDay     bool // Day of the month is `*`
+	anyWeekday bool // Day of the week is `*`
+}
+
+type cronField struct {
+	name  string
+	min   int
+	max   int
+	names []string
+}
+
+var cronFields = []cronField{
+	{name: "minute", min: 0, max: 59},
+	{name: "hour", min: 0, max: 23},
+	{name: "day of the month", min: 1, max: 31},
+	{name: "month", min: 1, max: 12, names: []string{"jan", "feb", "mar", "apr", "may", "jun", "jul", "aug", "sep", "oct", "nov", "dec"}},
+	{name: "day of the week", min: 0, max: 7, names: []string{"sun", "mon", "tue", "wed", "thu", "fri", "sat"}},
+}
+
+var cronShortcuts = map[string]string{
+	"@yearly":   "0 0 1 1 *",
+	"@annually": "0 0 1 1 *",
+	"@monthly":  "0 0 1 * *",
+	"@weekly":   "0 0 * * 0",
+	"@daily":    "0 0 * * *",
+	"@midnight": "0 0 * * *",
+	"@hourly":   "0 * * * *",
+}
+
+func ParseCron(expression string) (*CronExpression, error) {
+	expression = strings.TrimSpace(expression)
+	if shortcut, ok := cronShortcuts[strings.ToLower(expression)]; ok {
+		expression = shortcut
+	}
+	parts := strings.Fields(expression)
+	if len(parts) != len(cronFields) {
+		return nil, fmt.Errorf("expected %d fields in cron expression, got %d", len(cronFields), len(parts))
+	}
+
+	bits := make([]uint64, len(parts))
+	for i, part := range parts {
+		var err error
+		bits[i], err = cronFields[i].parse(part)
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	// Sunday is both 0 and 7
+	if bits[4]&(1<<7) != 0 {
+		bits[4] |= 1
+	}
+
+	return &CronExpression{
+		minute:     bits[0],
+		hour:       bits[1],
+		dayOfMonth: bits[2],
+		month:      bits[3],
+		dayOfWeek:  bits[4],
+		anyDay:     strings.HasPrefix(parts[2], "*"),
+		anyWeekday: strings.HasPrefix(parts[4], "*"),
+	}, nil
+}
+
+// parse turns a field into a bit set of the values it matches
+func (field *cronField) parse(expression string) (uint64, error) {
+	var bits uint64
+	for _, item := range strings.Split(expression, ",") {
+		rangePart, stepPart, hasStep := strings.Cut(item, "/")
+		step := 1
+		if hasStep {
+			var err error
+			step, err = strconv.Atoi(stepPart)
+			if err != nil || step < 1 {
+				return 0, fmt.Errorf("invalid step %q in %s", stepPart, field.name)
+			}
+		}
+
+		from, to := field.min, field.max
+		if rangePart != "*" {
+			start, end, isRange := strings.Cut(rangePart, "-")
+			var err error
+			if from, err = field.value(start); err != nil {
+				return 0, err
+			}
+			to = from
+			if isRange {
+				if to, err = field.value(end); err != nil {
+					return 0, err
+				}
+			} else if hasStep {
+				to = field.max
+			}
+			if to < from {
+				return 0, fmt.Errorf("invalid range %q in %s", rangePart, field.name)
+			}
+		}
+
+		for value := from; value <= to; value += step {
+			bits |= 1 << value
+		}
+	}
+	return bits, nil
+}
+
+func (field *cronField) value(text string) (int, error) {
+	for i, name := range field.names {
+		if strings.EqualFold(text, name) {
+			return i + field.min, nil
+		}
+	}
+	value, err := strconv.Atoi(text)
+	if err != nil || value < field.min || value > field.max {
+		return 0, fmt.Errorf("%s should be between %d and %d, got %q", field.name, field.min, field.max, text)
+	}
+	return value, nil
+}
+
+// Next returns the first moment after the given time that matches the
+// expression, in the time zone of the given time. It returns the zero time if
+// nothing matches in the next five years, which can happen for dates like the
+// 31st of February.
+func (cron *CronExpression) Next(after time.Time) time.Time {
+	t := after.Truncate(time.Minute).Add(time.Minute)
+	limit := t.AddDate(5, 0, 0)
+	for t.Before(limit) {
+		switch {
+		case cron.month&(1<<int(t.Month())) == 0:
+			t = time.Date(t.Year(), t.Month()+1, 1, 0, 0, 0, 0, t.Location())
+		case !cron.matchesDay(t):
+			t = time.Date(t.Year(), t.Month(), t.Day()+1, 0, 0, 0, 0, t.Location())
+		case cron.hour&(1<<t.Hour()) == 0:
+			t = t.Add(time.Duration(60-t.Minute()) * time.Minute)
+		case cron.minute&(1<<t.Minute()) == 0:
+			t = t.Add(time.Minute)
+		default:
+			return t
+		}
+	}
+	return time.Time{}
+}
+
+func (cron *CronExpression) matchesDay(t time.Time) bool {
+	day := cron.dayOfMonth&(1<<t.Day()) != 0
+	weekday := cron.dayOfWeek&(1<<int(t.Weekday())) != 0
+	switch {
+	case cron.anyDay && cron.anyWeekday:
+		return true
+	case cron.anyDay:
+		return weekday
+	case cron.anyWeekday:
+		return day
+	default:
+		return day || weekday
+	}
+}
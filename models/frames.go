@@ -0,0 +1,198 @@
+package models
+
+// Frame editing works on the frames of animation scenes. The functions return
+// new frames and leave the frames they were given alone, because those belong
+// to a stored scene.
+
+import (
+	"fmt"
+	"image"
+	"image/color"
+	"image/draw"
+	"math"
+	"slices"
+	"strings"
+
+	"github.com/timendus/pixelbox/protocol"
+)
+
+// WithFrames returns a copy of the scene with the given animation frames
+func (scene *Scene) WithFrames(frames []Frame) (*Scene, error) {
+	for path := range scene.bindings {
+		if strings.HasPrefix(path, "animation.frames") {
+			return nil, fmt.Errorf("the frames are bound to variables, edit the scene as a whole instead")
+		}
+	}
+	result := *scene
+	result.Animation = Animation{Frames: frames}
+	return &result, nil
+}
+
+func checkFrameIndex(frames []Frame, index int) error {
+	if index < 0 || index >= len(frames) {
+		return fmt.Errorf("frame %d doesn't exist, the animation has %d frames", index, len(frames))
+	}
+	return nil
+}
+
+// InsertFrame inserts the frame before the frame at the index. An index equal
+// to the number of frames adds it to the end.
+func InsertFrame(frames []Frame, index int, frame Frame) ([]Frame, error) {
+	if index < 0 || index > len(frames) {
+		return nil, fmt.Errorf("can't insert at %d, the animation has %d frames", index, len(frames))
+	}
+	return slices.Insert(slices.Clone(frames), index, frame), nil
+}
+
+// DuplicateFrame inserts a copy of the frame right after it
+func DuplicateFrame(frames []Frame, index int) ([]Frame, error) {
+	if err := checkFrameIndex(frames, index); err != nil {
+		return nil, err
+	}
+	frame := Frame{Duration: frames[index].Duration, Pixels: slices.Clone(frames[index].Pixels)}
+	return slices.Insert(slices.Clone(frames), index+1, frame), nil
+}
+
+func DeleteFrame(frames []Frame, index int) ([]Frame, error) {
+	if err := checkFrameIndex(frames, index); err != nil {
+		return nil, err
+	}
+	return slices.Delete(slices.Clone(frames), index, index+1), nil
+}
+
+// MoveFrame moves the frame at from, so it ends up at the index to
+func MoveFrame(frames []Frame, from, to int) ([]Frame, error) {
+	if err := checkFrameIndex(frames, from); err != nil {
+		return nil, err
+	}
+	if err := checkFrameIndex(frames, to); err != nil {
+		return nil, err
+	}
+	frame := frames[from]
+	result := slices.Delete(slices.Clone(frames), from, from+1)
+	return slices.Insert(result, to, frame), nil
+}
+
+/* Transforms of the whole animation */
+
+func ReverseFrames(frames []Frame) []Frame {
+	result := slices.Clone(frames)
+	slices.Reverse(result)
+	return result
+}
+
+// PingPong adds the frames in reverse order after the frames, so the animation
+// plays forwards and then backwards. The first and the last frame aren't
+// repeated, so it loops smoothly.
+func PingPong(frames []Frame) []Frame {
+	result := slices.Clone(frames)
+	for i := len(frames) - 2; i > 0; i-- {
+		result = append(result, frames[i])
+	}
+	return result
+}
+
+// ScaleSpeed makes the animation play the given factor faster, so a factor of
+// 2 halves the durations and a factor of 0.5 doubles them
+func ScaleSpeed(frames []Frame, factor float64) ([]Frame, error) {
+	if factor <= 0 || math.IsInf(factor, 0) || math.IsNaN(factor) {
+		return nil, fmt.Errorf("the speed factor should be more than 0")
+	}
+	result := slices.Clone(frames)
+	for i, frame := range result {
+		duration := math.Round(float64(frame.Duration) / factor)
+		if duration > protocol.MaxFrameDuration {
+			return nil, fmt.Errorf("frame %d would take longer than %d milliseconds", i, protocol.MaxFrameDuration)
+		}
+		result[i].Duration = int(duration)
+	}
+	return result, nil
+}
+
+// ShiftFrames moves the pixels of all frames dx to the right and dy down. The
+// pixels that fall off one side come back on the other side.
+func ShiftFrames(frames []Frame, dx, dy int) []Frame {
+	return mapPixels(frames, func(x, y int) (int, int) {
+		return mod(x-dx, Width), mod(y-dy, Height)
+	})
+}
+
+// FlipFrames mirrors all frames, left to right or top to bottom
+func FlipFrames(frames []Frame, vertical bool) []Frame {
+	return mapPixels(frames, func(x, y int) (int, int) {
+		if vertical {
+			return x, Height - 1 - y
+		}
+		return Width - 1 - x, y
+	})
+}
+
+// RotateFrames turns all frames clockwise by 90, 180 or 270 degrees
+func RotateFrames(frames []Frame, degrees int) ([]Frame, error) {
+	switch mod(degrees, 360) {
+	case 0:
+		return slices.Clone(frames), nil
+	case 90:
+		return mapPixels(frames, func(x, y int) (int, int) { return y, Width - 1 - x }), nil
+	case 180:
+		return mapPixels(frames, func(x, y int) (int, int) { return Width - 1 - x, Height - 1 - y }), nil
+	case 270:
+		return mapPixels(frames, func(x, y int) (int, int) { return Height - 1 - y, x }), nil
+	default:
+		return nil, fmt.Errorf("frames can only be rotated by multiples of 90 degrees")
+	}
+}
+
+// mapPixels creates new frames in which every pixel is taken from the place in
+// the old frame that source returns
+func mapPixels(frames []Frame, source func(x, y int) (int, int)) []Frame {
+	result := make([]Frame, len(frames))
+	for i, frame := range frames {
+		from := PixelsToRGBA(frame.Pixels)
+		to := image.NewRGBA(from.Rect)
+		for y := 0; y < Height; y++ {
+			for x := 0; x < Width; x++ {
+				sx, sy := source(x, y)
+				to.SetRGBA(x, y, from.RGBAAt(sx, sy))
+			}
+		}
+		result[i] = Frame{Duration: frame.Duration, Pixels: PixelsFromRGBA(to)}
+	}
+	return result
+}
+
+func mod(a, b int) int {
+	return (a%b + b) % b
+}
+
+// MaxOnionDistance is the furthest frame away that OnionSkin can show. Frames
+// further away would be completely faded.
+const MaxOnionDistance = 8
+
+// OnionSkin renders the frame at the index on top of faded versions of the
+// frames before and after it, to see how the animation moves. Every frame
+// further away is faded twice as much.
+func OnionSkin(frames []Frame, index, before, after int) (*image.RGBA, error) {
+	if err := checkFrameIndex(frames, index); err != nil {
+		return nil, err
+	}
+	before = min(before, MaxOnionDistance)
+	after = min(after, MaxOnionDistance)
+	result := image.NewRGBA(image.Rect(0, 0, Width, Height))
+	for distance := max(before, after); distance > 0; distance-- {
+		opacity := uint8(128 >> (distance - 1))
+		if distance <= before && index-distance >= 0 {
+			fade(result, frames[index-distance], opacity)
+		}
+		if distance <= after && index+distance < len(frames) {
+			fade(result, frames[index+distance], opacity)
+		}
+	}
+	draw.Draw(result, result.Rect, PixelsToRGBA(frames[index].Pixels), image.Point{}, draw.Over)
+	return result, nil
+}
+
+func fade(dst *image.RGBA, frame Frame, opacity uint8) {
+	mask := image.NewUniform(color.Alpha{A: opacity})
+	draw.DrawMask(dst, dst.Rect, PixelsToRGBA(frame.Pixels), image.Point{}, mask, image.Point{}, draw.Over)
+}
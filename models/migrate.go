@@ -0,0 +1,177 @@
+package models
+
+// Scene files have a schema version. When the Scene model changes in a way
+// that older files can't just be decoded into, we add a migration below that
+// upgrades the raw JSON document by one version, and bump SchemaVersion.
+// Migrations run when scenes are loaded. The original file is copied to the
+// backup directory before it is rewritten.
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"reflect"
+	"slices"
+	"strings"
+
+	"github.com/google/uuid"
+)
+
+// SchemaVersion is the version of the scene files that we write. It should be
+// equal to the number of migrations.
+const SchemaVersion = 2
+
+const backupDir = "backup"
+
+type migration struct {
+	description string
+	apply       func(doc map[string]any)
+}
+
+// migrations[i] upgrades a document from version i to version i + 1. Files
+// without a version are version 0.
+var migrations = []migration{
+	{
+		description: "drop the stored device message, so it gets recreated by the current code",
+		apply: func(doc map[string]any) {
+			delete(doc, "message")
+			doc["messageDirty"] = true
+		},
+	},
+	{
+		description: "store images and frames as PNG data, and stop storing the device message",
+		apply: func(doc map[string]any) {
+			delete(doc, "message")
+			delete(doc, "messageDirty")
+			compactPixels(doc, false)
+		},
+	},
+}
+
+var ErrNewerSchema = errors.New("scene was written by a newer version of PixelBox")
+
+// MigrationReport describes what a migration does, or did, to a scene file
+type MigrationReport struct {
+	File    string   `json:"file"`
+	From    int      `json:"from"`
+	To      int      `json:"to"`
+	Steps   []string `json:"steps"`
+	Changed []string `json:"changed"` // Top level fields
+	Error   string   `json:"error,omitempty"`
+}
+
+// MigrateScenes upgrades the scene files in the directory to the current
+// schema version, backing up every file it changes. It returns a report for
+// each file that needs to change. With dryRun set, nothing is written.
+func MigrateScenes(dir string, dryRun bool) ([]MigrationReport, error) {
+	entries, err := os.ReadDir(dir)
+	if err != nil {
+		return nil, fmt.Errorf("can't read directory %s: %w", dir, err)
+	}
+
+	reports := make([]MigrationReport, 0)
+	for _, e := range entries {
+		if e.IsDir() || strings.HasPrefix(e.Name(), ".") || filepath.Ext(e.Name()) != ".json" {
+			continue
+		}
+		path := filepath.Join(dir, e.Name())
+
+		data, err := os.ReadFile(path)
+		if err != nil {
+			reports = append(reports, MigrationReport{File: path, Error: err.Error()})
+			continue
+		}
+		scene, report, err := migrateScene(data)
+		if err != nil {
+			reports = append(reports, MigrationReport{File: path, Error: err.Error()})
+			continue
+		}
+		if report == nil {
+			continue
+		}
+		report.File = path
+
+		if !dryRun {
+			if err := backup(dir, e.Name(), report.From, data); err != nil {
+				report.Error = "could not make backup: " + err.Error()
+			} else if err := writeScene(path, scene); err != nil {
+				report.Error = "could not write migrated scene: " + err.Error()
+			}
+		}
+		reports = append(reports, *report)
+	}
+	return reports, nil
+}
+
+// migrateScene decodes a scene file, upgrading it to the current schema version
+// first if needed. The report is nil if the file was already up to date.
+func migrateScene(data []byte) (*Scene, *MigrationReport, error) {
+	var doc map[string]any
+	if err := json.Unmarshal(data, &doc); err != nil {
+		return nil, nil, err
+	}
+
+	version := 0
+	if value, ok := doc["schemaVersion"].(float64); ok {
+		version = int(value)
+	}
+	if version > SchemaVersion {
+		return nil, nil, fmt.Errorf("%w (schema version %d)", ErrNewerSchema, version)
+	}
+
+	var report *MigrationReport
+	if version < SchemaVersion {
+		var original map[string]any
+		json.Unmarshal(data, &original)
+
+		report = &MigrationReport{From: version, To: SchemaVersion}
+		for _, m := range migrations[version:SchemaVersion] {
+			m.apply(doc)
+			report.Steps = append(report.Steps, m.description)
+		}
+		doc["schemaVersion"] = SchemaVersion
+		report.Changed = changedFields(original, doc)
+
+		var err error
+		if data, err = json.Marshal(doc); err != nil {
+			return nil, nil, err
+		}
+	}
+
+	var scene Scene
+	if err := json.Unmarshal(data, &scene); err != nil {
+		return nil, nil, err
+	}
+	if scene.Uuid == uuid.Nil {
+		return nil, nil, fmt.Errorf("scene has no UUID")
+	}
+	scene.SchemaVersion = SchemaVersion
+	return &scene, report, nil
+}
+
+func changedFields(before, after map[string]any) []string {
+	changed := make([]string, 0)
+	for key, value := range after {
+		if !reflect.DeepEqual(before[key], value) {
+			changed = append(changed, key)
+		}
+	}
+	for key := range before {
+		if _, ok := after[key]; !ok {
+			changed = append(changed, key)
+		}
+	}
+	slices.Sort(changed)
+	return changed
+}
+
+// backup keeps a copy of the original file as `backup/<name>.v<version>`
+func backup(dir, name string, version int, data []byte) error {
+	target := filepath.Join(dir, backupDir)
+	if err := os.MkdirAll(target, 0755); err != nil {
+		return err
+	}
+	return writeFileAtomic(filepath.Join(target, fmt.Sprintf("%s.v%d", name, version)), data)
+}
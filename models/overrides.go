@@ -0,0 +1,132 @@
+package models
+
+// Overrides change the settings of a scene just for showing it once, like
+// "the weather scene, but with 12 degrees and rain". They are given by the path
+// of the setting, like `clock.color`, or by one of the short names below.
+
+import (
+	"encoding/json"
+	"fmt"
+	"maps"
+	"slices"
+	"strconv"
+	"strings"
+)
+
+var overrideNames = map[string]string{
+	"temperature": "temperature.temperature",
+	"weather":     "weather.type",
+	"color":       "clock.color",
+	"clockColor":  "clock.color",
+	"lightColor":  "light.color",
+	"red":         "effect.scoreRedPlayer",
+	"blue":        "effect.scoreBluePlayer",
+}
+
+// Settings that are switched on by overriding another setting, because the
+// override would do nothing otherwise
+var overrideSwitches = map[string]string{
+	"brightness":              "changeBrightness",
+	"volume":                  "changeVolume",
+	"temperature.temperature": "temperature.enabled",
+	"weather.type":            "weather.enabled",
+}
+
+// Settings that say which scene this is, rather than what it looks like
+var fixedSettings = []string{"uuid", "id", "schemaVersion", "message", "messageDirty"}
+
+// WithOverrides returns a copy of the scene with the settings in the JSON
+// merge patch and the values changed. The scene itself is left alone. Unknown
+// or invalid settings are refused with ValidationErrors.
+func (scene *Scene) WithOverrides(patch []byte, values map[string]any) (*Scene, error) {
+	data, err := json.Marshal(scene)
+	if err != nil {
+		return nil, err
+	}
+	var doc any
+	if err := json.Unmarshal(data, &doc); err != nil {
+		return nil, err
+	}
+
+	errs := ValidationErrors{}
+	if len(patch) > 0 {
+		var changes any
+		if err := json.Unmarshal(patch, &changes); err != nil {
+			return nil, fmt.Errorf("invalid JSON: %w", err)
+		}
+		if object, ok := changes.(map[string]any); ok {
+			for _, setting := range fixedSettings {
+				if _, ok := object[setting]; ok {
+					errs.add(setting, "can't be overridden")
+				}
+			}
+		}
+		doc = mergePatch(doc, changes)
+	}
+
+	for _, name := range slices.Sorted(maps.Keys(values)) {
+		value := values[name]
+		path := name
+		if full, ok := overrideNames[name]; ok {
+			path = full
+		}
+		if !hasJSONPath(doc, path) || isFixedSetting(path) {
+			errs.add(name, "unknown setting")
+			continue
+		}
+		setJSONPath(doc, path, value)
+		if setting, ok := overrideSwitches[path]; ok {
+			setJSONPath(doc, setting, true)
+		}
+	}
+	if len(errs) > 0 {
+		return nil, errs
+	}
+
+	if data, err = json.Marshal(doc); err != nil {
+		return nil, err
+	}
+	var result Scene
+	if err := json.Unmarshal(data, &result); err != nil {
+		return nil, fmt.Errorf("invalid override: %w", err)
+	}
+	result.Message = nil
+	result.MessageDirty = true
+	if err := result.Validate(); err != nil {
+		return nil, err
+	}
+	return &result, nil
+}
+
+func isFixedSetting(path string) bool {
+	for _, setting := range fixedSettings {
+		if path == setting || strings.HasPrefix(path, setting+".") {
+			return true
+		}
+	}
+	return false
+}
+
+// hasJSONPath tells whether the decoded JSON document has a value at the path
+func hasJSONPath(doc any, path string) bool {
+	current := doc
+	for _, step := range splitPath(path) {
+		switch c := current.(type) {
+		case map[string]any:
+			value, ok := c[step]
+			if !ok {
+				return false
+			}
+			current = value
+		case []any:
+			index, err := strconv.Atoi(step)
+			if err != nil || index < 0 || index >= len(c) {
+				return false
+			}
+			current = c[index]
+		default:
+			return false
+		}
+	}
+	return true
+}
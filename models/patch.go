@@ -0,0 +1,325 @@
+package models
+
+// Partial changes to scenes, as JSON documents: JSON merge patches (RFC 7396)
+// and JSON Patches (RFC 6902)
+
+import (
+	"encoding/json"
+	"fmt"
+	"reflect"
+	"slices"
+	"strconv"
+	"strings"
+)
+
+// mergePatch applies a JSON merge patch (RFC 7396) to a decoded JSON
+// document: objects are merged, null removes a member and anything else
+// replaces what was there
+func mergePatch(target, patch any) any {
+	patchObject, ok := patch.(map[string]any)
+	if !ok {
+		return patch
+	}
+	targetObject, ok := target.(map[string]any)
+	if !ok {
+		targetObject = make(map[string]any)
+	}
+	for key, value := range patchObject {
+		if value == nil {
+			delete(targetObject, key)
+		} else {
+			targetObject[key] = mergePatch(targetObject[key], value)
+		}
+	}
+	return targetObject
+}
+
+// MergePatch applies a JSON merge patch (RFC 7396) to a JSON document
+func MergePatch(data, patch []byte) ([]byte, error) {
+	var doc, changes any
+	if err := json.Unmarshal(data, &doc); err != nil {
+		return nil, err
+	}
+	if err := json.Unmarshal(patch, &changes); err != nil {
+		return nil, fmt.Errorf("invalid merge patch: %w", err)
+	}
+	return json.Marshal(mergePatch(doc, changes))
+}
+
+type patchOperation struct {
+	Op    string          `json:"op"`
+	Path  string          `json:"path"`
+	From  string          `json:"from"`
+	Value json.RawMessage `json:"value"`
+}
+
+// JSONPatch applies a JSON Patch (RFC 6902) to a JSON document. If any of the
+// operations fails, the whole patch fails.
+func JSONPatch(data, patch []byte) ([]byte, error) {
+	var doc any
+	if err := json.Unmarshal(data, &doc); err != nil {
+		return nil, err
+	}
+	var operations []patchOperation
+	if err := json.Unmarshal(patch, &operations); err != nil {
+		return nil, fmt.Errorf("invalid JSON patch: %w", err)
+	}
+
+	for i, operation := range operations {
+		var err error
+		doc, err = operation.apply(doc)
+		if err != nil {
+			return nil, fmt.Errorf("operation %d (%s %s): %w", i, operation.Op, operation.Path, err)
+		}
+	}
+	return json.Marshal(doc)
+}
+
+func (operation *patchOperation) apply(doc any) (any, error) {
+	value := func() (any, error) {
+		if len(operation.Value) == 0 {
+			return nil, fmt.Errorf("value is missing")
+		}
+		var value any
+		err := json.Unmarshal(operation.Value, &value)
+		return value, err
+	}
+
+	switch operation.Op {
+	case "add":
+		v, err := value()
+		if err != nil {
+			return nil, err
+		}
+		return pointerAdd(doc, operation.Path, v)
+
+	case "remove":
+		doc, _, err := pointerRemove(doc, operation.Path)
+		return doc, err
+
+	case "replace":
+		v, err := value()
+		if err != nil {
+			return nil, err
+		}
+		if doc, _, err = pointerRemove(doc, operation.Path); err != nil {
+			return nil, err
+		}
+		return pointerAdd(doc, operation.Path, v)
+
+	case "move":
+		if operation.Path == operation.From || strings.HasPrefix(operation.Path, operation.From+"/") {
+			return nil, fmt.Errorf("can't move a value into itself")
+		}
+		doc, v, err := pointerRemove(doc, operation.From)
+		if err != nil {
+			return nil, err
+		}
+		return pointerAdd(doc, operation.Path, v)
+
+	case "copy":
+		v, err := pointerGet(doc, operation.From)
+		if err != nil {
+			return nil, err
+		}
+		// Copy the value, so changing one later doesn't change the other
+		data, err := json.Marshal(v)
+		if err != nil {
+			return nil, err
+		}
+		var copied any
+		json.Unmarshal(data, &copied)
+		return pointerAdd(doc, operation.Path, copied)
+
+	case "test":
+		v, err := value()
+		if err != nil {
+			return nil, err
+		}
+		current, err := pointerGet(doc, operation.Path)
+		if err != nil {
+			return nil, err
+		}
+		if !reflect.DeepEqual(current, v) {
+			return nil, fmt.Errorf("test failed")
+		}
+		return doc, nil
+
+	default:
+		return nil, fmt.Errorf("unknown operation")
+	}
+}
+
+// splitPointer splits a JSON pointer (RFC 6901) like `/clock/color` into its
+// reference tokens
+func splitPointer(pointer string) ([]string, error) {
+	if pointer == "" {
+		return []string{}, nil
+	}
+	if !strings.HasPrefix(pointer, "/") {
+		return nil, fmt.Errorf("invalid path %q, it should start with /", pointer)
+	}
+	tokens := strings.Split(pointer[1:], "/")
+	for i, token := range tokens {
+		tokens[i] = strings.ReplaceAll(strings.ReplaceAll(token, "~1", "/"), "~0", "~")
+	}
+	return tokens, nil
+}
+
+func arrayIndex(token string, length int, appending bool) (int, error) {
+	if token == "-" && appending {
+		return length, nil
+	}
+	index, err := strconv.Atoi(token)
+	if err != nil || index < 0 || index > length || (index == length && !appending) || (len(token) > 1 && token[0] == '0') {
+		return 0, fmt.Errorf("invalid array index %q", token)
+	}
+	return index, nil
+}
+
+func pointerGet(doc any, pointer string) (any, error) {
+	tokens, err := splitPointer(pointer)
+	if err != nil {
+		return nil, err
+	}
+	current := doc
+	for _, token := range tokens {
+		switch c := current.(type) {
+		case map[string]any:
+			value, ok := c[token]
+			if !ok {
+				return nil, fmt.Errorf("%s doesn't exist", pointer)
+			}
+			current = value
+		case []any:
+			index, err := arrayIndex(token, len(c), false)
+			if err != nil {
+				return nil, err
+			}
+			current = c[index]
+		default:
+			return nil, fmt.Errorf("%s doesn't exist", pointer)
+		}
+	}
+	return current, nil
+}
+
+// pointerAdd adds the value at the location, and returns the changed document
+func pointerAdd(doc any, pointer string, value any) (any, error) {
+	tokens, err := splitPointer(pointer)
+	if err != nil {
+		return nil, err
+	}
+	if len(tokens) == 0 {
+		return value, nil
+	}
+	parentPointer := pointer[:strings.LastIndex(pointer, "/")]
+	parent, err := pointerGet(doc, parentPointer)
+	if err != nil {
+		return nil, err
+	}
+	last := tokens[len(tokens)-1]
+
+	switch p := parent.(type) {
+	case map[string]any:
+		p[last] = value
+		return doc, nil
+	case []any:
+		index, err := arrayIndex(last, len(p), true)
+		if err != nil {
+			return nil, err
+		}
+		// Arrays can't grow in place, so replace the whole array in its parent
+		return pointerSet(doc, parentPointer, slices.Insert(p, index, value))
+	default:
+		return nil, fmt.Errorf("%s doesn't exist", parentPointer)
+	}
+}
+
+// pointerRemove removes the value at the location, and returns the changed
+// document and the removed value
+func pointerRemove(doc any, pointer string) (any, any, error) {
+	tokens, err := splitPointer(pointer)
+	if err != nil {
+		return nil, nil, err
+	}
+	if len(tokens) == 0 {
+		return nil, doc, nil
+	}
+	parentPointer := pointer[:strings.LastIndex(pointer, "/")]
+	parent, err := pointerGet(doc, parentPointer)
+	if err != nil {
+		return nil, nil, err
+	}
+	last := tokens[len(tokens)-1]
+
+	switch p := parent.(type) {
+	case map[string]any:
+		value, ok := p[last]
+		if !ok {
+			return nil, nil, fmt.Errorf("%s doesn't exist", pointer)
+		}
+		delete(p, last)
+		return doc, value, nil
+	case []any:
+		index, err := arrayIndex(last, len(p), false)
+		if err != nil {
+			return nil, nil, err
+		}
+		value := p[index]
+		doc, err = pointerSet(doc, parentPointer, slices.Delete(slices.Clone(p), index, index+1))
+		return doc, value, err
+	default:
+		return nil, nil, fmt.Errorf("%s doesn't exist", parentPointer)
+	}
+}
+
+// pointerSet replaces the existing value at the location
+func pointerSet(doc any, pointer string, value any) (any, error) {
+	tokens, err := splitPointer(pointer)
+	if err != nil {
+		return nil, err
+	}
+	if len(tokens) == 0 {
+		return value, nil
+	}
+	parentPointer := pointer[:strings.LastIndex(pointer, "/")]
+	parent, err := pointerGet(doc, parentPointer)
+	if err != nil {
+		return nil, err
+	}
+	last := tokens[len(tokens)-1]
+	switch p := parent.(type) {
+	case map[string]any:
+		p[last] = value
+	case []any:
+		index, err := arrayIndex(last, len(p), false)
+		if err != nil {
+			return nil, err
+		}
+		p[index] = value
+	}
+	return doc, nil
+}
+
+// Patched returns a copy of the scene with the JSON Patch, or the JSON merge
+// patch, applied. The result isn't validated yet.
+func (scene *Scene) Patched(patch []byte, jsonPatch bool) (*Scene, error) {
+	data, err := json.Marshal(scene)
+	if err != nil {
+		return nil, err
+	}
+	if jsonPatch {
+		data, err = JSONPatch(data, patch)
+	} else {
+		data, err = MergePatch(data, patch)
+	}
+	if err != nil {
+		return nil, err
+	}
+	var result Scene
+	if err := json.Unmarshal(data, &result); err != nil {
+		return nil, fmt.Errorf("patch gives an invalid scene: %w", err)
+	}
+	return &result, nil
+}
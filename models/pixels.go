@@ -0,0 +1,43 @@
+package models
+
+// Images and animation frames are stored in scenes as flat arrays of RGBA
+// values, four entries per pixel, row by row. This is the same layout as the
+// `Pix` slice of a 16x16 `image.RGBA`, and as `ImageData` in the browser.
+
+import (
+	"image"
+)
+
+const (
+	Width      = 16
+	Height     = 16
+	PixelCount = Width * Height * 4
+)
+
+// PixelsToRGBA converts a flat pixel array to a 16x16 RGBA image. Missing
+// values are left black and transparent, excess values are ignored.
+func PixelsToRGBA(pixels []int) *image.RGBA {
+	img := image.NewRGBA(image.Rect(0, 0, Width, Height))
+	for i, v := range pixels {
+		if i >= len(img.Pix) {
+			break
+		}
+		img.Pix[i] = byte(v)
+	}
+	return img
+}
+
+// PixelsFromRGBA converts a 16x16 RGBA image to a flat pixel array.
+func PixelsFromRGBA(img *image.RGBA) []int {
+	pixels := make([]int, PixelCount)
+	for y := 0; y < Height; y++ {
+		for x := 0; x < Width; x++ {
+			src := img.PixOffset(img.Rect.Min.X+x, img.Rect.Min.Y+y)
+			dst := (y*Width + x) * 4
+			for c := 0; c < 4; c++ {
+				pixels[dst+c] = int(img.Pix[src+c])
+			}
+		}
+	}
+	return pixels
+}
@@ -0,0 +1,254 @@
+package models
+
+// A playlist is an ordered list of scenes with a duration for each of them. The
+// player in the controllers package shows the entries one after the other,
+// either in order or shuffled. Playlists are stored the same way scenes are,
+// as JSON files named after their UUID in their own directory.
+
+import (
+	"fmt"
+	"log"
+	"math/rand/v2"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+
+	"github.com/google/uuid"
+)
+
+type Playlist struct {
+	Uuid    uuid.UUID       `json:"uuid"`
+	Name    string          `json:"name"`
+	Id      string          `json:"id"`
+	Mode    string          `json:"mode"` // "loop" or "shuffle"
+	Entries []PlaylistEntry `json:"entries"`
+}
+
+type PlaylistEntry struct {
+	Scene    string `json:"scene"`            // ID or UUID of the scene
+	Duration int    `json:"duration"`         // Milliseconds
+	Weight   *int   `json:"weight,omitempty"` // Relative chance of being picked when shuffling, default 1
+}
+
+// Next picks the entry to show after the entry at the given index. Pass -1 to
+// get the first entry. When shuffling, the same entry is never picked twice in
+// a row, unless it is the only one that can be picked.
+func (playlist *Playlist) Next(index int) int {
+	if len(playlist.Entries) == 0 {
+		return -1
+	}
+	if playlist.Mode != "shuffle" {
+		return (index + 1) % len(playlist.Entries)
+	}
+
+	total := 0
+	for i, entry := range playlist.Entries {
+		if i != index || len(playlist.Entries) == 1 {
+			total += entry.weight()
+		}
+	}
+	if total == 0 {
+		return (index + 1) % len(playlist.Entries)
+	}
+	pick := rand.IntN(total)
+	for i, entry := range playlist.Entries {
+		if i == index && len(playlist.Entries) > 1 {
+			continue
+		}
+		pick -= entry.weight()
+		if pick < 0 {
+			return i
+		}
+	}
+	return 0
+}
+
+func (entry *PlaylistEntry) weight() int {
+	if entry.Weight == nil {
+		return 1
+	}
+	return *entry.Weight
+}
+
+// Validate returns ValidationErrors if there's anything wrong with the
+// playlist, or nil if it's fine
+func (playlist *Playlist) Validate() error {
+	errs := ValidationErrors{}
+	switch playlist.Mode {
+	case "", "loop", "shuffle":
+	default:
+		errs.add("mode", "should be either loop or shuffle")
+	}
+	if len(playlist.Entries) == 0 {
+		errs.add("entries", "should have at least one entry")
+	}
+	for i, entry := range playlist.Entries {
+		prefix := fmt.Sprintf("entries[%d].", i)
+		if _, err := Scenes.Find(entry.Scene); err != nil {
+			errs.add(prefix+"scene", "unknown scene %q", entry.Scene)
+		}
+		if entry.Duration <= 0 {
+			errs.add(prefix+"duration", "should be a positive number of milliseconds")
+		}
+		if entry.Weight != nil && *entry.Weight < 0 {
+			errs.add(prefix+"weight", "should not be negative")
+		}
+	}
+	if len(errs) > 0 {
+		return errs
+	}
+	return nil
+}
+
+/* Storage */
+
+type PlaylistRepository struct {
+	mu        sync.RWMutex
+	dir       string
+	playlists []*Playlist
+}
+
+// Playlists is the repository the application uses. It is set by
+// LoadPlaylists.
+var Playlists *PlaylistRepository
+
+// LoadPlaylists loads the playlists in the given directory into Playlists
+func LoadPlaylists(dir string) error {
+	repository, err := NewPlaylistRepository(dir)
+	if err != nil {
+		return err
+	}
+	Playlists = repository
+	log.Printf("Loaded %d playlists from file\n", len(Playlists.playlists))
+	return nil
+}
+
+// NewPlaylistRepository loads all playlists from the given directory, creating
+// it if it doesn't exist yet
+func NewPlaylistRepository(dir string) (*PlaylistRepository, error) {
+	repository := PlaylistRepository{dir: dir}
+
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		return nil, err
+	}
+	entries, err := os.ReadDir(dir)
+	if err != nil {
+		return nil, fmt.Errorf("can't read directory %s: %w", dir, err)
+	}
+
+	for _, e := range entries {
+		path := filepath.Join(dir, e.Name())
+		if !e.IsDir() && strings.HasPrefix(e.Name(), ".") && strings.Contains(e.Name(), ".tmp-") {
+			os.Remove(path)
+			continue
+		}
+		if e.IsDir() || filepath.Ext(e.Name()) != ".json" {
+			continue
+		}
+
+		var playlist Playlist
+		err := readJSONFile(path, &playlist)
+		if err == nil && playlist.Uuid == uuid.Nil {
+			err = fmt.Errorf("playlist has no UUID")
+		}
+		if err != nil {
+			log.Println("Can't decode JSON file "+path, err)
+			if err := quarantine(dir, path); err != nil {
+				log.Println("Could not quarantine file "+path, err)
+			}
+			continue
+		}
+		repository.playlists = append(repository.playlists, &playlist)
+	}
+
+	return &repository, nil
+}
+
+func (r *PlaylistRepository) All() []*Playlist {
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+	return append([]*Playlist{}, r.playlists...)
+}
+
+// Find looks up a playlist by either its human readable ID or its UUID
+func (r *PlaylistRepository) Find(ref string) (*Playlist, error) {
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+	for _, p := range r.playlists {
+		if p.Id == ref || p.Uuid.String() == ref {
+			return p, nil
+		}
+	}
+	return nil, fmt.Errorf("playlist not found")
+}
+
+// Create gives the playlist a new UUID and stores it. Invalid playlists are
+// refused with ValidationErrors.
+func (r *PlaylistRepository) Create(playlist *Playlist) error {
+	if err := playlist.Validate(); err != nil {
+		return err
+	}
+	id, err := uuid.NewV7()
+	if err != nil {
+		return err
+	}
+	playlist.Uuid = id
+
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if err := writeJSONFile(r.path(playlist), playlist); err != nil {
+		return err
+	}
+	r.playlists = append(r.playlists, playlist)
+	return nil
+}
+
+// Update replaces the playlist with the new playlist, keeping its UUID, and
+// returns the updated playlist. Invalid playlists are refused with
+// ValidationErrors.
+func (r *PlaylistRepository) Update(playlist *Playlist, newPlaylist *Playlist) (*Playlist, error) {
+	updated := *newPlaylist
+	updated.Uuid = playlist.Uuid
+	if err := updated.Validate(); err != nil {
+		return nil, err
+	}
+
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	index := r.indexOf(playlist.Uuid)
+	if index < 0 {
+		return nil, fmt.Errorf("playlist not found")
+	}
+	if err := writeJSONFile(r.path(&updated), &updated); err != nil {
+		return nil, err
+	}
+	r.playlists[index] = &updated
+	return &updated, nil
+}
+
+func (r *PlaylistRepository) Delete(playlist *Playlist) error {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	err := os.Remove(r.path(playlist))
+	if err != nil && !os.IsNotExist(err) {
+		return err
+	}
+	if index := r.indexOf(playlist.Uuid); index >= 0 {
+		r.playlists = append(r.playlists[:index], r.playlists[index+1:]...)
+	}
+	return nil
+}
+
+func (r *PlaylistRepository) indexOf(uuid uuid.UUID) int {
+	for i, p := range r.playlists {
+		if p.Uuid == uuid {
+			return i
+		}
+	}
+	return -1
+}
+
+func (r *PlaylistRepository) path(playlist *Playlist) string {
+	return filepath.Join(r.dir, playlist.Uuid.String()+".json")
+}
@@ -0,0 +1,97 @@
+package models
+
+// Queries find scenes by their type, tags, folder and name, and return short
+// summaries of them, a page at a time, so clients don't have to download every
+// pixel of every scene to show a list.
+
+import (
+	"cmp"
+	"fmt"
+	"slices"
+	"strings"
+
+	"github.com/google/uuid"
+)
+
+type SceneSummary struct {
+	Uuid      uuid.UUID `json:"uuid"`
+	Id        string    `json:"id"`
+	Name      string    `json:"name"`
+	SceneType string    `json:"sceneType"`
+	Folder    string    `json:"folder"`
+	Tags      []string  `json:"tags"`
+	ETag      string    `json:"etag"`
+}
+
+type SceneQuery struct {
+	Type   string   // Only scenes of this type
+	Tags   []string // Only scenes with all of these tags
+	Folder string   // Only scenes in this folder, or its subfolders
+	Search string   // Only scenes with this in their name or ID, ignoring case
+	Sort   string   // "name", "id", "type" or "folder", with "-" in front to reverse
+	Offset int
+	Limit  int
+}
+
+type SceneQueryResult struct {
+	Total  int            `json:"total"` // Of all matching scenes, not just this page
+	Offset int            `json:"offset"`
+	Limit  int            `json:"limit"`
+	Scenes []SceneSummary `json:"scenes"`
+}
+
+var sortKeys = map[string]func(*Scene) string{
+	"name":   func(s *Scene) string { return strings.ToLower(s.Name) },
+	"id":     func(s *Scene) string { return s.Id },
+	"type":   func(s *Scene) string { return s.SceneType },
+	"folder": func(s *Scene) string { return s.Folder },
+}
+
+func (scene *Scene) Summary() SceneSummary {
+	tags := scene.Tags
+	if tags == nil {
+		tags = []string{}
+	}
+	return SceneSummary{scene.Uuid, scene.Id, scene.Name, scene.SceneType, scene.Folder, tags, scene.ETag()}
+}
+
+// Query returns a page of summaries of the scenes that match the query
+func (r *SceneRepository) Query(query SceneQuery) (*SceneQueryResult, error) {
+	sort := strings.TrimPrefix(query.Sort, "-")
+	if sort == "" {
+		sort = "name"
+	}
+	key, ok := sortKeys[sort]
+	if !ok {
+		return nil, fmt.Errorf("can't sort by %q, use name, id, type or folder", sort)
+	}
+	if query.Offset < 0 || query.Limit < 0 {
+		return nil, fmt.Errorf("offset and limit can't be negative")
+	}
+
+	search := strings.ToLower(query.Search)
+	scenes := slices.DeleteFunc(r.All(), func(scene *Scene) bool {
+		return (query.Type != "" && scene.SceneType != query.Type) ||
+			(query.Folder != "" && scene.Folder != query.Folder && !strings.HasPrefix(scene.Folder, query.Folder+"/")) ||
+			(search != "" && !strings.Contains(strings.ToLower(scene.Name), search) && !strings.Contains(strings.ToLower(scene.Id), search)) ||
+			slices.ContainsFunc(query.Tags, func(tag string) bool { return !slices.Contains(scene.Tags, tag) })
+	})
+
+	slices.SortStableFunc(scenes, func(a, b *Scene) int {
+		// Ties are broken by name, so pages stay in the same order
+		result := cmp.Or(cmp.Compare(key(a), key(b)), cmp.Compare(strings.ToLower(a.Name), strings.ToLower(b.Name)), strings.Compare(a.Uuid.String(), b.Uuid.String()))
+		if strings.HasPrefix(query.Sort, "-") {
+			return -result
+		}
+		return result
+	})
+
+	result := SceneQueryResult{Total: len(scenes), Offset: query.Offset, Limit: query.Limit, Scenes: []SceneSummary{}}
+	// Offset plus limit can overflow, so don't add them up
+	start := min(query.Offset, len(scenes))
+	end := start + min(query.Limit, len(scenes)-start)
+	for _, scene := range scenes[start:end] {
+		result.Scenes = append(result.Scenes, scene.Summary())
+	}
+	return &result, nil
+}
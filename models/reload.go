@@ -0,0 +1,192 @@
+package models
+
+// Scene files can also be changed on disk while PixelBox is running, for
+// instance when they're deployed from git. Reload looks for files that were
+// added, changed or removed since the repository last read or wrote them, and
+// applies those changes like the API would: changed scenes get a revision, and
+// removed scenes go to the trash. Files with an invalid scene are refused, and
+// the version we have stays in use.
+
+import (
+	"errors"
+	"fmt"
+	"log"
+	"maps"
+	"os"
+	"path/filepath"
+	"strings"
+
+	"github.com/google/uuid"
+	"github.com/timendus/pixelbox/internal/filestamp"
+)
+
+// ReloadReport tells what happened to a scene file that changed on disk
+type ReloadReport struct {
+	File   string `json:"file"`
+	Change string `json:"change"` // "created", "updated", "deleted" or "rejected"
+	Id     string `json:"id,omitempty"`
+	Error  string `json:"error,omitempty"`
+}
+
+// sceneFile is a scene file as the repository last read or wrote it
+type sceneFile struct {
+	stamp filestamp.Stamp
+	uuid  uuid.UUID
+}
+
+// rejection is a changed file with a scene we refused, so we only report it
+// once
+type rejection struct {
+	stamp filestamp.Stamp
+	err   string
+}
+
+type reloadedFile struct {
+	path  string
+	stamp filestamp.Stamp
+	scene *Scene
+}
+
+// Reload applies the changes to the scene files since they were last read or
+// written, and returns what it did
+func (r *SceneRepository) Reload() []ReloadReport {
+	entries, err := os.ReadDir(r.dir)
+	if err != nil {
+		return []ReloadReport{{File: r.dir, Change: "rejected", Error: err.Error()}}
+	}
+	r.mu.RLock()
+	known := maps.Clone(r.files)
+	rejected := maps.Clone(r.rejected)
+	r.mu.RUnlock()
+
+	// Read the files outside of the lock, validating a scene looks up others
+	present := make(map[string]bool)
+	var changed []reloadedFile
+	var reports []ReloadReport
+	for _, e := range entries {
+		if e.IsDir() || strings.HasPrefix(e.Name(), ".") || filepath.Ext(e.Name()) != ".json" {
+			continue
+		}
+		path := filepath.Join(r.dir, e.Name())
+		present[path] = true
+		stamp := filestamp.Of(path)
+		if file, ok := known[path]; ok && file.stamp == stamp {
+			continue
+		}
+
+		scene, err := r.readChangedFile(path)
+		if err != nil {
+			// Try again next time, the scene may depend on a scene that
+			// isn't there yet, but only report it once
+			if rejected[path] != (rejection{stamp, err.Error()}) {
+				reports = append(reports, ReloadReport{File: path, Change: "rejected", Error: err.Error()})
+			}
+			r.mu.Lock()
+			r.rejected[path] = rejection{stamp, err.Error()}
+			r.mu.Unlock()
+			continue
+		}
+		changed = append(changed, reloadedFile{path, stamp, scene})
+	}
+
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	for _, file := range changed {
+		delete(r.rejected, file.path)
+		if r.files[file.path] != known[file.path] {
+			continue // We wrote it ourselves in the mean time
+		}
+		r.files[file.path] = sceneFile{file.stamp, file.scene.Uuid}
+
+		scene := file.scene
+		scene.etag = scene.computeETag()
+		index := r.indexOf(scene.Uuid)
+		switch {
+		case index < 0:
+			r.scenes = append(r.scenes, scene)
+			notifySceneListeners("created", scene)
+			reports = append(reports, ReloadReport{File: file.path, Change: "created", Id: scene.Id})
+		case r.scenes[index].ETag() != scene.etag:
+			if err := r.saveRevision(r.scenes[index]); err != nil {
+				log.Println("Could not save revision of scene "+scene.Uuid.String(), err)
+			}
+			r.scenes[index] = scene
+			notifySceneListeners("updated", scene)
+			reports = append(reports, ReloadReport{File: file.path, Change: "updated", Id: scene.Id})
+		}
+	}
+
+	for path, file := range known {
+		if present[path] {
+			continue
+		}
+		delete(r.rejected, path)
+		if r.files[path] != file {
+			continue // Deleted or written through the repository
+		}
+		delete(r.files, path)
+		if r.hasFile(file.uuid) {
+			continue // The file was renamed
+		}
+		index := r.indexOf(file.uuid)
+		if index < 0 {
+			continue
+		}
+		scene := r.scenes[index]
+		if err := r.trashRemoved(scene); err != nil {
+			log.Println("Could not move scene "+scene.Uuid.String()+" to the trash", err)
+		}
+		r.scenes = append(r.scenes[:index], r.scenes[index+1:]...)
+		notifySceneListeners("deleted", scene)
+		reports = append(reports, ReloadReport{File: path, Change: "deleted", Id: scene.Id})
+	}
+	return reports
+}
+
+// readChangedFile reads a scene file that changed on disk, and refuses it if
+// it's not a valid scene
+func (r *SceneRepository) readChangedFile(path string) (*Scene, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	scene, _, err := migrateScene(data)
+	if errors.Is(err, ErrNewerSchema) {
+		return nil, err
+	}
+	if err != nil {
+		return nil, fmt.Errorf("can't decode JSON: %w", err)
+	}
+	if scene.Uuid == uuid.Nil {
+		return nil, fmt.Errorf("the scene has no uuid")
+	}
+	if err := r.loadAssets(scene); err != nil {
+		return nil, err
+	}
+	if err := scene.Validate(); err != nil {
+		return nil, err
+	}
+	scene.Message = nil
+	scene.MessageDirty = true
+	return scene, nil
+}
+
+// hasFile returns whether a file we know has the scene with the given UUID.
+// The caller should hold the lock.
+func (r *SceneRepository) hasFile(id uuid.UUID) bool {
+	for _, file := range r.files {
+		if file.uuid == id {
+			return true
+		}
+	}
+	return false
+}
+
+// trashRemoved puts a scene whose file was removed in the trash, together with
+// its revisions. The caller should hold the lock.
+func (r *SceneRepository) trashRemoved(scene *Scene) error {
+	if err := r.moveToTrash(scene); err != nil {
+		return err
+	}
+	return writeScene(r.trashPath(scene.Uuid), scene)
+}
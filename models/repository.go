@@ -0,0 +1,407 @@
+package models
+
+// The scene repository keeps the scenes in memory and stores each scene as a
+// JSON file named after its UUID. All access goes through a mutex, so HTTP
+// handlers can safely use it concurrently. Updates never modify a scene in
+// place; they replace it with an updated copy, so a scene you got from the
+// repository never changes under your feet.
+//
+// Files are written to a temporary file first, and then renamed over the
+// original. That way a crash halfway through writing can't destroy a scene.
+// Files that can't be decoded are moved to a quarantine directory when loading.
+// Updates and deletions can be undone, see revisions.go.
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/google/uuid"
+	"github.com/timendus/pixelbox/internal/filestamp"
+)
+
+type SceneRepository struct {
+	mu     sync.RWMutex
+	dir    string
+	scenes []*Scene
+
+	// The scene files as we last read or wrote them, see reload.go
+	files    map[string]sceneFile
+	rejected map[string]rejection
+}
+
+const quarantineDir = "quarantine"
+
+var ErrConflict = errors.New("scene was changed by someone else")
+
+// Scenes is the repository the application uses. It is set by LoadScenes.
+var Scenes *SceneRepository
+
+// LoadScenes migrates and loads the scenes in the given directory into Scenes
+func LoadScenes(dir string) error {
+	repository, err := NewSceneRepository(dir)
+	if err != nil {
+		return err
+	}
+	Scenes = repository
+	log.Printf("Loaded %d scenes from file\n", len(Scenes.scenes))
+	return nil
+}
+
+// NewSceneRepository loads all scenes from the given directory, upgrading
+// files with an older schema version first
+func NewSceneRepository(dir string) (*SceneRepository, error) {
+	repository := SceneRepository{
+		dir:      dir,
+		files:    make(map[string]sceneFile),
+		rejected: make(map[string]rejection),
+	}
+
+	reports, err := MigrateScenes(dir, false)
+	if err != nil {
+		return nil, err
+	}
+	for _, report := range reports {
+		switch {
+		case report.Steps == nil:
+			// Files we can't read at all are dealt with below
+		case report.Error != "":
+			log.Println("Could not migrate "+report.File+":", report.Error)
+		default:
+			log.Printf("Migrated %s from schema version %d to %d\n", report.File, report.From, report.To)
+		}
+	}
+
+	entries, err := os.ReadDir(dir)
+	if err != nil {
+		return nil, fmt.Errorf("can't read directory %s: %w", dir, err)
+	}
+
+	for _, e := range entries {
+		path := filepath.Join(dir, e.Name())
+
+		// Clean up after writes that never finished
+		if !e.IsDir() && strings.HasPrefix(e.Name(), ".") && strings.Contains(e.Name(), ".tmp-") {
+			os.Remove(path)
+			continue
+		}
+
+		if e.IsDir() || filepath.Ext(e.Name()) != ".json" {
+			continue
+		}
+
+		scene, err := repository.readSceneFile(path)
+		if errors.Is(err, ErrNewerSchema) {
+			log.Println("Skipping "+path+":", err)
+			repository.rejected[path] = rejection{filestamp.Of(path), err.Error()}
+			continue
+		}
+		if err != nil {
+			log.Println("Can't decode JSON file "+path, err)
+			if err := quarantine(dir, path); err != nil {
+				log.Println("Could not quarantine file "+path, err)
+			}
+			continue
+		}
+
+		scene.etag = scene.computeETag()
+		repository.scenes = append(repository.scenes, scene)
+		repository.files[path] = sceneFile{filestamp.Of(path), scene.Uuid}
+	}
+
+	return &repository, nil
+}
+
+func (r *SceneRepository) All() []*Scene {
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+	return append([]*Scene{}, r.scenes...)
+}
+
+func (r *SceneRepository) FindByUUID(uuid uuid.UUID) (*Scene, error) {
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+	for _, s := range r.scenes {
+		if s.Uuid == uuid {
+			return s, nil
+		}
+	}
+	return nil, fmt.Errorf("scene not found")
+}
+
+func (r *SceneRepository) FindById(id string) (*Scene, error) {
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+	for _, s := range r.scenes {
+		if s.Id == id {
+			return s, nil
+		}
+	}
+	return nil, fmt.Errorf("scene not found")
+}
+
+// Find looks up a scene by either its human readable ID or its UUID
+func (r *SceneRepository) Find(ref string) (*Scene, error) {
+	if scene, err := r.FindById(ref); err == nil {
+		return scene, nil
+	}
+	id, err := uuid.Parse(ref)
+	if err != nil {
+		return nil, fmt.Errorf("scene not found")
+	}
+	return r.FindByUUID(id)
+}
+
+// Invalidate makes the scenes that use the variable recreate their message
+// the next time it's needed, and returns those scenes
+func (r *SceneRepository) Invalidate(variable string) []*Scene {
+	r.mu.RLock()
+	result := make([]*Scene, 0)
+	for _, scene := range r.scenes {
+		if scene.Uses(variable) {
+			result = append(result, scene)
+		}
+	}
+	r.mu.RUnlock()
+
+	// Never hold messageMu and r.mu at the same time, so they can't deadlock
+	for _, scene := range result {
+		scene.invalidateMessage()
+	}
+	return result
+}
+
+// Create gives the scene a new UUID and stores it. Invalid scenes are refused
+// with ValidationErrors.
+func (r *SceneRepository) Create(scene *Scene) error {
+	id, err := uuid.NewV7()
+	if err != nil {
+		return err
+	}
+	scene.Uuid = id
+	return r.Add(scene)
+}
+
+// Add stores a scene that already has a UUID, like one that is imported from
+// another PixelBox. Invalid scenes are refused with ValidationErrors.
+func (r *SceneRepository) Add(scene *Scene) error {
+	if err := r.loadAssets(scene); err != nil {
+		return err
+	}
+	if err := scene.Validate(); err != nil {
+		return err
+	}
+	scene.Message = nil
+	scene.MessageDirty = true
+
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if r.indexOf(scene.Uuid) >= 0 {
+		return fmt.Errorf("scene %s already exists", scene.Uuid)
+	}
+	if err := r.writeFile(scene); err != nil {
+		return err
+	}
+	r.scenes = append(r.scenes, scene)
+	notifySceneListeners("created", scene)
+	return nil
+}
+
+// Update replaces the contents of the scene with those of the new scene, and
+// returns the updated scene. Invalid scenes are refused with ValidationErrors.
+// If the scene was changed since it was read from the repository, ErrConflict
+// is returned, so changes by others don't get lost.
+func (r *SceneRepository) Update(scene *Scene, newScene *Scene) (*Scene, error) {
+	updated := *scene
+	updated.Name = newScene.Name
+	updated.Id = newScene.Id
+	updated.Folder = newScene.Folder
+	updated.Tags = newScene.Tags
+	updated.Message = nil
+	updated.MessageDirty = true
+
+	updated.ChangeBrightness = newScene.ChangeBrightness
+	updated.Brightness = newScene.Brightness
+	updated.ChangeVolume = newScene.ChangeVolume
+	updated.Volume = newScene.Volume
+
+	updated.SceneType = newScene.SceneType
+	updated.Clock = newScene.Clock
+	updated.Weather = newScene.Weather
+	updated.Temperature = newScene.Temperature
+	updated.Calendar = newScene.Calendar
+	updated.Light = newScene.Light
+	updated.Effect = newScene.Effect
+
+	updated.Image = newScene.Image
+	updated.Animation = newScene.Animation
+	updated.Composite = newScene.Composite
+	updated.Sequence = newScene.Sequence
+	updated.bindings = newScene.bindings
+
+	if err := r.loadAssets(&updated); err != nil {
+		return nil, err
+	}
+	if err := updated.Validate(); err != nil {
+		return nil, err
+	}
+
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	index := r.indexOf(scene.Uuid)
+	if index < 0 {
+		return nil, fmt.Errorf("scene not found")
+	}
+	if r.scenes[index] != scene {
+		return nil, ErrConflict
+	}
+	if err := r.saveRevision(r.scenes[index]); err != nil {
+		log.Println("Could not save revision of scene "+scene.Uuid.String(), err)
+		return nil, err
+	}
+	if err := r.writeFile(&updated); err != nil {
+		return nil, err
+	}
+	r.scenes[index] = &updated
+	notifySceneListeners("updated", &updated)
+	return &updated, nil
+}
+
+// Delete moves the scene to the trash. Like Update, it returns ErrConflict if
+// the scene was changed since it was read.
+func (r *SceneRepository) Delete(scene *Scene) error {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	index := r.indexOf(scene.Uuid)
+	if index >= 0 && r.scenes[index] != scene {
+		return ErrConflict
+	}
+	if err := r.moveToTrash(scene); err != nil {
+		log.Println("Could not move scene "+scene.Uuid.String()+" to the trash", err)
+		return err
+	}
+	if index >= 0 {
+		r.scenes = append(r.scenes[:index], r.scenes[index+1:]...)
+	}
+	notifySceneListeners("deleted", scene)
+	return nil
+}
+
+func (r *SceneRepository) indexOf(uuid uuid.UUID) int {
+	for i, s := range r.scenes {
+		if s.Uuid == uuid {
+			return i
+		}
+	}
+	return -1
+}
+
+func (r *SceneRepository) path(scene *Scene) string {
+	return filepath.Join(r.dir, scene.Uuid.String()+".json")
+}
+
+func (r *SceneRepository) writeFile(scene *Scene) error {
+	scene.SchemaVersion = SchemaVersion
+	scene.etag = scene.computeETag()
+	path := r.path(scene)
+	if err := writeScene(path, scene); err != nil {
+		log.Println("Could not write to file "+path, err)
+		return err
+	}
+	r.files[path] = sceneFile{filestamp.Of(path), scene.Uuid}
+	return nil
+}
+
+// quarantine moves a file we can't use out of the way, so it doesn't get lost
+// but also doesn't bother us again
+func quarantine(dir, path string) error {
+	dir = filepath.Join(dir, quarantineDir)
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		return err
+	}
+	target := filepath.Join(dir, time.Now().Format("20060102-150405")+"-"+filepath.Base(path))
+	log.Println("Moving " + path + " to " + target)
+	return os.Rename(path, target)
+}
+
+// readSceneFile reads a scene, or a revision of one, including the pixels it
+// takes from assets
+func (r *SceneRepository) readSceneFile(path string) (*Scene, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	scene, _, err := migrateScene(data)
+	if err != nil {
+		return nil, err
+	}
+	if err := r.loadAssets(scene); err != nil {
+		log.Println("Could not load assets of "+path+":", err)
+	}
+	return scene, nil
+}
+
+func readJSONFile(path string, value any) error {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return err
+	}
+	return json.Unmarshal(data, value)
+}
+
+// writeJSONFile atomically replaces the file at path with the JSON encoding of
+// value
+func writeJSONFile(path string, value any) error {
+	data, err := json.MarshalIndent(value, "", "  ")
+	if err != nil {
+		return err
+	}
+	return writeFileAtomic(path, append(data, '\n'))
+}
+
+// writeFileAtomic replaces the file at path with data: it writes to a
+// temporary file in the same directory, flushes it to disk and renames it over
+// the original.
+func writeFileAtomic(path string, data []byte) error {
+	dir, name := filepath.Split(path)
+	if dir == "" {
+		dir = "."
+	}
+	f, err := os.CreateTemp(dir, "."+name+".tmp-*")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(f.Name()) // Fails harmlessly after a successful rename
+
+	if err := f.Chmod(0644); err != nil {
+		f.Close()
+		return err
+	}
+	if _, err := f.Write(data); err != nil {
+		f.Close()
+		return err
+	}
+	if err := f.Sync(); err != nil {
+		f.Close()
+		return err
+	}
+	if err := f.Close(); err != nil {
+		return err
+	}
+	if err := os.Rename(f.Name(), path); err != nil {
+		return err
+	}
+
+	// Make sure the rename itself survives a crash too
+	if d, err := os.Open(dir); err == nil {
+		d.Sync()
+		d.Close()
+	}
+	return nil
+}
@@ -0,0 +1,254 @@
+package models
+
+// Every time a scene is updated, the previous version is kept as a revision in
+// `revisions/<uuid>/<number>.json`, so a bad save can be undone. Only the most
+// recent revisions are kept, see KeepRevisions.
+//
+// Deleted scenes go to the trash directory first, together with their
+// revisions, so they can be restored. Purging a scene from the trash removes it
+// for good.
+
+import (
+	"fmt"
+	"log"
+	"os"
+	"path/filepath"
+	"slices"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/google/uuid"
+)
+
+const (
+	revisionsDir = "revisions"
+	trashDir     = "trash"
+)
+
+// KeepRevisions is the number of revisions kept for each scene. Older ones are
+// removed when a new revision is added.
+var KeepRevisions = NewSetting(20)
+
+type Revision struct {
+	Number    int       `json:"revision"`
+	Saved     time.Time `json:"saved"` // When this revision was replaced
+	Name      string    `json:"name"`
+	SceneType string    `json:"sceneType"`
+}
+
+// TrashedScene is a scene in the trash
+type TrashedScene struct {
+	Uuid      uuid.UUID `json:"uuid"`
+	Id        string    `json:"id"`
+	Name      string    `json:"name"`
+	SceneType string    `json:"sceneType"`
+	Deleted   time.Time `json:"deleted"`
+}
+
+// Revisions returns the revisions of the scene, newest first
+func (r *SceneRepository) Revisions(scene *Scene) ([]Revision, error) {
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+	numbers, err := r.revisionNumbers(scene.Uuid)
+	if err != nil {
+		return nil, err
+	}
+
+	result := make([]Revision, 0, len(numbers))
+	for _, number := range slices.Backward(numbers) {
+		path := r.revisionPath(scene.Uuid, number)
+		revision, err := r.readSceneFile(path)
+		if err != nil {
+			log.Println("Can't read revision "+path, err)
+			continue
+		}
+		info, err := os.Stat(path)
+		if err != nil {
+			continue
+		}
+		result = append(result, Revision{number, info.ModTime(), revision.Name, revision.SceneType})
+	}
+	return result, nil
+}
+
+// Revision returns the given revision of the scene
+func (r *SceneRepository) Revision(scene *Scene, number int) (*Scene, error) {
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+	revision, err := r.readSceneFile(r.revisionPath(scene.Uuid, number))
+	if os.IsNotExist(err) {
+		return nil, fmt.Errorf("revision not found")
+	}
+	return revision, err
+}
+
+// saveRevision stores the current version of the scene as a new revision, and
+// removes revisions we don't need to keep anymore. The caller should hold the
+// lock.
+func (r *SceneRepository) saveRevision(scene *Scene) error {
+	keep := KeepRevisions.Get()
+	if keep <= 0 {
+		return os.RemoveAll(r.revisionDir(scene.Uuid))
+	}
+	if err := os.MkdirAll(r.revisionDir(scene.Uuid), 0755); err != nil {
+		return err
+	}
+	numbers, err := r.revisionNumbers(scene.Uuid)
+	if err != nil {
+		return err
+	}
+	next := 1
+	if len(numbers) > 0 {
+		next = numbers[len(numbers)-1] + 1
+	}
+
+	if err := writeScene(r.revisionPath(scene.Uuid, next), scene); err != nil {
+		return err
+	}
+
+	numbers = append(numbers, next)
+	for _, number := range numbers[:max(0, len(numbers)-keep)] {
+		os.Remove(r.revisionPath(scene.Uuid, number))
+	}
+	return nil
+}
+
+// revisionNumbers returns the numbers of the stored revisions of a scene, in
+// ascending order
+func (r *SceneRepository) revisionNumbers(id uuid.UUID) ([]int, error) {
+	entries, err := os.ReadDir(r.revisionDir(id))
+	if os.IsNotExist(err) {
+		return []int{}, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	numbers := make([]int, 0, len(entries))
+	for _, e := range entries {
+		if number, err := strconv.Atoi(strings.TrimSuffix(e.Name(), ".json")); err == nil && !e.IsDir() {
+			numbers = append(numbers, number)
+		}
+	}
+	slices.Sort(numbers)
+	return numbers, nil
+}
+
+func (r *SceneRepository) revisionDir(id uuid.UUID) string {
+	return filepath.Join(r.dir, revisionsDir, id.String())
+}
+
+func (r *SceneRepository) revisionPath(id uuid.UUID, number int) string {
+	return filepath.Join(r.revisionDir(id), strconv.Itoa(number)+".json")
+}
+
+/* The trash */
+
+// Trash returns the scenes in the trash, most recently deleted first
+func (r *SceneRepository) Trash() ([]TrashedScene, error) {
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+	entries, err := os.ReadDir(filepath.Join(r.dir, trashDir))
+	if os.IsNotExist(err) {
+		return []TrashedScene{}, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	result := make([]TrashedScene, 0, len(entries))
+	for _, e := range entries {
+		if e.IsDir() || filepath.Ext(e.Name()) != ".json" {
+			continue
+		}
+		path := filepath.Join(r.dir, trashDir, e.Name())
+		scene, err := r.readSceneFile(path)
+		if err != nil {
+			log.Println("Can't read scene in the trash "+path, err)
+			continue
+		}
+		info, err := e.Info()
+		if err != nil {
+			continue
+		}
+		result = append(result, TrashedScene{scene.Uuid, scene.Id, scene.Name, scene.SceneType, info.ModTime()})
+	}
+	slices.SortFunc(result, func(a, b TrashedScene) int { return b.Deleted.Compare(a.Deleted) })
+	return result, nil
+}
+
+// RestoreFromTrash puts the deleted scene with the given UUID back
+func (r *SceneRepository) RestoreFromTrash(id uuid.UUID) (*Scene, error) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	trashed := r.trashPath(id)
+	scene, err := r.readSceneFile(trashed)
+	if os.IsNotExist(err) {
+		return nil, fmt.Errorf("scene not found in the trash")
+	}
+	if err != nil {
+		return nil, err
+	}
+	if r.indexOf(id) >= 0 {
+		return nil, fmt.Errorf("scene %s already exists", id)
+	}
+
+	scene.Message = nil
+	scene.MessageDirty = true
+	if err := r.writeFile(scene); err != nil {
+		return nil, err
+	}
+	os.Remove(trashed)
+	os.MkdirAll(filepath.Join(r.dir, revisionsDir), 0755)
+	if err := os.Rename(r.trashedRevisionDir(id), r.revisionDir(id)); err != nil && !os.IsNotExist(err) {
+		log.Println("Could not restore revisions of scene "+id.String(), err)
+	}
+	r.scenes = append(r.scenes, scene)
+	notifySceneListeners("created", scene)
+	return scene, nil
+}
+
+// Purge removes the deleted scene with the given UUID and its revisions for
+// good
+func (r *SceneRepository) Purge(id uuid.UUID) error {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if err := os.Remove(r.trashPath(id)); err != nil {
+		if os.IsNotExist(err) {
+			return fmt.Errorf("scene not found in the trash")
+		}
+		return err
+	}
+	return os.RemoveAll(r.trashedRevisionDir(id))
+}
+
+// moveToTrash moves the file and the revisions of the scene to the trash. The
+// caller should hold the lock.
+func (r *SceneRepository) moveToTrash(scene *Scene) error {
+	if err := os.MkdirAll(filepath.Join(r.dir, trashDir, revisionsDir), 0755); err != nil {
+		return err
+	}
+	trashed := r.trashPath(scene.Uuid)
+	if err := os.Rename(r.path(scene), trashed); err != nil && !os.IsNotExist(err) {
+		return err
+	}
+	delete(r.files, r.path(scene))
+	// Renaming keeps the modification time, but that should be the time of
+	// deletion
+	now := time.Now()
+	os.Chtimes(trashed, now, now)
+
+	os.RemoveAll(r.trashedRevisionDir(scene.Uuid)) // From an earlier deletion
+	if err := os.Rename(r.revisionDir(scene.Uuid), r.trashedRevisionDir(scene.Uuid)); err != nil && !os.IsNotExist(err) {
+		log.Println("Could not move revisions of scene "+scene.Uuid.String()+" to the trash", err)
+	}
+	return nil
+}
+
+func (r *SceneRepository) trashPath(id uuid.UUID) string {
+	return filepath.Join(r.dir, trashDir, id.String()+".json")
+}
+
+func (r *SceneRepository) trashedRevisionDir(id uuid.UUID) string {
+	return filepath.Join(r.dir, trashDir, revisionsDir, id.String())
+}
@@ -1,12 +1,9 @@
 package models
 
 import (
-	"encoding/json"
 	"fmt"
 	"image"
-	"log"
-	"os"
-	"path/filepath"
+	"sync"
 
 	"github.com/google/uuid"
 	"github.com/timendus/pixelbox/protocol"
@@ -15,12 +12,15 @@ import (
 /* Model definitions */
 
 type Scene struct {
-	Uuid         uuid.UUID `json:"uuid"`
-	Message      []byte    `json:"message"`
-	MessageDirty bool      `json:"messageDirty"`
+	SchemaVersion int       `json:"schemaVersion"`
+	Uuid          uuid.UUID `json:"uuid"`
+	Message       []byte    `json:"message"`
+	MessageDirty  bool      `json:"messageDirty"`
 
 	Name             string      `json:"name"`
 	Id               string      `json:"id"`
+	Folder           string      `json:"folder"` // Like "holidays/christmas", empty for the top level
+	Tags             []string    `json:"tags"`
 	ChangeBrightness bool        `json:"changeBrightness"`
 	Brightness       *int        `json:"brightness"`
 	ChangeVolume     bool        `json:"changeVolume"`
@@ -34,6 +34,12 @@ type Scene struct {
 	Effect           Effect      `json:"effect"`
 	Image            Image       `json:"image"`
 	Animation        Animation   `json:"animation"`
+	Composite        Composite   `json:"composite"`
+	Sequence         Sequence    `json:"sequence"`
+
+	bindings       map[string]string // Settings bound to variables, by path
+	etag           string            // Set by the repository, see ETag
+	messageVersion int               // Goes up when the message is invalidated
 }
 
 type Clock struct {
@@ -70,10 +76,12 @@ type Effect struct {
 }
 
 type Image struct {
-	Pixels []int `json:"pixels"`
+	Asset  string `json:"asset,omitempty"` // PNG or GIF file to take the pixels from, see storage.go
+	Pixels []int  `json:"pixels"`
 }
 
 type Animation struct {
+	Asset  string  `json:"asset,omitempty"` // GIF file to take the frames from, see storage.go
 	Frames []Frame `json:"frames"`
 }
 
@@ -82,157 +90,62 @@ type Frame struct {
 	Pixels   []int `json:"pixels"`
 }
 
-/* Scene storage stuff */
-
-var scenes = []*Scene{}
-var dir = "scenes"
-
-func init() {
-	entries, err := os.ReadDir(dir)
-	if err != nil {
-		log.Fatal("Can't read directory " + dir)
-	}
-
-	for _, e := range entries {
-		if e.IsDir() || filepath.Ext(e.Name()) != ".json" {
-			continue
-		}
-
-		path := filepath.Join(dir, e.Name())
-		f, err := os.Open(path)
-		if err != nil {
-			log.Println("Can't read JSON file " + path)
-			continue
-		}
-
-		var scene Scene
-		if err := json.NewDecoder(f).Decode(&scene); err != nil {
-			f.Close()
-			log.Println("Can't decode JSON file "+path, err)
-			continue
-		}
-		f.Close()
-
-		scenes = append(scenes, &scene)
-	}
-
-	log.Printf("Loaded %d scenes from file\n", len(scenes))
-}
+/* Conversion to Divoom Timebox Evo message stuff */
 
-func AllScenes() []*Scene {
-	return scenes
-}
+// Guards the cached message of all scenes
+var messageMu sync.Mutex
 
-func FindSceneByUUID(uuid uuid.UUID) (*Scene, error) {
-	for _, s := range scenes {
-		if s.Uuid == uuid {
-			return s, nil
-		}
-	}
-	return nil, fmt.Errorf("scene not found")
-}
+// AnimationBudget is what animations are fitted within when they are compiled to
+// a message, see protocol/budget.go
+var AnimationBudget = NewSetting(protocol.DefaultAnimationBudget)
 
-func FindSceneById(id string) (*Scene, error) {
-	for _, s := range scenes {
-		if s.Id == id {
-			return s, nil
-		}
-	}
-	return nil, fmt.Errorf("scene not found")
-}
-
-func (scene *Scene) Create() error {
-	id, err := uuid.NewV7()
-	if err != nil {
-		return err
-	}
-	scene.Uuid = id
-	err = scene.writeToFile()
-	if err != nil {
-		return err
+func (scene *Scene) GetMessage() ([]byte, error) {
+	messageMu.Lock()
+	if !scene.MessageDirty && scene.Message != nil {
+		defer messageMu.Unlock()
+		return scene.Message, nil
 	}
-	scenes = append(scenes, scene)
-	return nil
-}
-
-func (scene *Scene) Update(newScene *Scene) error {
-	scene.Name = newScene.Name
-	scene.Id = newScene.Id
-	scene.MessageDirty = true
-
-	scene.ChangeBrightness = newScene.ChangeBrightness
-	scene.Brightness = newScene.Brightness
-	scene.ChangeVolume = newScene.ChangeVolume
-	scene.Volume = newScene.Volume
-
-	scene.SceneType = newScene.SceneType
-	scene.Clock = newScene.Clock
-	scene.Weather = newScene.Weather
-	scene.Temperature = newScene.Temperature
-	scene.Calendar = newScene.Calendar
-	scene.Light = newScene.Light
-	scene.Effect = newScene.Effect
-
-	scene.Image = newScene.Image
-	scene.Animation = newScene.Animation
+	version := scene.messageVersion
+	messageMu.Unlock()
 
-	return scene.writeToFile()
-}
-
-func (scene *Scene) Delete() error {
-	err := scene.deleteFile()
+	// Compile without holding the lock, so a slow scene doesn't hold up the
+	// others. Compiling can look up other scenes in the repository too.
+	message, err := scene.ToMessage()
 	if err != nil {
-		return err
-	}
-	for i, s := range scenes {
-		if s.Uuid == scene.Uuid {
-			scenes = append(scenes[:i], scenes[i+1:]...)
-			return nil
-		}
+		return nil, err
 	}
-	return nil
-}
 
-func (scene *Scene) writeToFile() error {
-	path := filepath.Join(dir, scene.Uuid.String()+".json")
-	f, err := os.Create(path)
-	if err != nil {
-		log.Println("Could not write to file " + path)
-		return err
+	messageMu.Lock()
+	defer messageMu.Unlock()
+	// Don't cache the message if it was invalidated in the mean time
+	if scene.messageVersion == version {
+		scene.Message = message
+		scene.MessageDirty = false
 	}
-	defer f.Close()
-
-	enc := json.NewEncoder(f)
-	enc.SetIndent("", "  ")
-
-	return enc.Encode(scene)
+	return message, nil
 }
 
-func (scene *Scene) deleteFile() error {
-	path := filepath.Join(dir, scene.Uuid.String()+".json")
-	err := os.Remove(path)
-	if err != nil && !os.IsNotExist(err) {
-		log.Println("Could not delete file " + path)
-		return err
-	}
-	return nil
+// invalidateMessage makes the scene recreate its message the next time it's
+// needed
+func (scene *Scene) invalidateMessage() {
+	messageMu.Lock()
+	defer messageMu.Unlock()
+	scene.MessageDirty = true
+	scene.messageVersion++
 }
 
-/* Conversion to Divoom Timebox Evo message stuff */
-
-func (scene *Scene) GetMessage() ([]byte, error) {
-	if scene.MessageDirty {
-		var err error
-		scene.Message, err = scene.ToMessage()
+func (scene *Scene) ToMessage() ([]byte, error) {
+	if len(scene.bindings) > 0 {
+		resolved, err := scene.resolve()
 		if err != nil {
 			return nil, err
 		}
-		scene.MessageDirty = false
+		if err := resolved.Validate(); err != nil {
+			return nil, fmt.Errorf("invalid with the current variables: %w", err)
+		}
+		return resolved.ToMessage()
 	}
-	return scene.Message, nil
-}
 
-func (scene *Scene) ToMessage() ([]byte, error) {
 	result := make([]byte, 0)
 
 	// Brightness setting
@@ -331,14 +244,7 @@ func (scene *Scene) ToMessage() ([]byte, error) {
 		}
 
 	case "image":
-		img := image.NewRGBA(image.Rectangle{
-			Min: image.Point{X: 0, Y: 0},
-			Max: image.Point{X: 16, Y: 16},
-		})
-		for i, v := range scene.Image.Pixels {
-			img.Pix[i] = byte(v)
-		}
-		msg, err := protocol.ShowImage(img)
+		msg, err := protocol.ShowImage(PixelsToRGBA(scene.Image.Pixels))
 		if err != nil {
 			return nil, err
 		}
@@ -348,22 +254,25 @@ func (scene *Scene) ToMessage() ([]byte, error) {
 		frames := make([]*image.RGBA, 0)
 		durations := make([]int, 0)
 		for _, f := range scene.Animation.Frames {
-			img := image.NewRGBA(image.Rectangle{
-				Min: image.Point{X: 0, Y: 0},
-				Max: image.Point{X: 16, Y: 16},
-			})
-			for i, v := range f.Pixels {
-				img.Pix[i] = byte(v)
-			}
-			frames = append(frames, img)
+			frames = append(frames, PixelsToRGBA(f.Pixels))
 			durations = append(durations, f.Duration)
 		}
-		msg, err := protocol.ShowAnimation(frames, durations)
+		msg, _, err := protocol.FitAnimation(frames, durations, AnimationBudget.Get())
 		if err != nil {
 			return nil, err
 		}
 		result = append(result, msg...)
 
+	case "composite":
+		msg, err := scene.Composite.ToMessage()
+		if err != nil {
+			return nil, err
+		}
+		result = append(result, msg...)
+
+	case "sequence":
+		return nil, fmt.Errorf("a sequence can't be sent as a single message, it runs step by step")
+
 	}
 
 	return result, nil
@@ -0,0 +1,228 @@
+package models
+
+// The schedule is a list of rules that perform an action whenever their cron
+// expression matches, like "dim the display at 22:00" or "show the clock at
+// 07:00 on weekdays". The scheduler in the controllers package runs them. The
+// whole schedule is stored in a single JSON file.
+
+import (
+	"fmt"
+	"log"
+	"os"
+	"sync"
+	"time"
+
+	"github.com/google/uuid"
+	"github.com/timendus/pixelbox/protocol"
+)
+
+type ScheduleRule struct {
+	Uuid     uuid.UUID `json:"uuid"`
+	Name     string    `json:"name"`
+	Cron     string    `json:"cron,omitempty"`
+	Sun      string    `json:"sun,omitempty"` // Like "sunset-30m", instead of Cron
+	Disabled bool      `json:"disabled"`
+	Action   string    `json:"action"` // "scene", "playlist", "brightness", "volume" or "off"
+	Scene    string    `json:"scene,omitempty"`
+	Playlist string    `json:"playlist,omitempty"`
+	Value    *int      `json:"value,omitempty"` // For brightness and volume
+}
+
+// Actions that change what is showing on the display, as opposed to settings
+// like the brightness
+var displayActions = map[string]bool{"scene": true, "playlist": true, "off": true}
+
+// Kind groups the actions that undo each other. Only the most recent action
+// of each kind matters to what the device looks like.
+func (rule *ScheduleRule) Kind() string {
+	if displayActions[rule.Action] {
+		return "display"
+	}
+	return rule.Action
+}
+
+// A Trigger tells when a rule should run
+type Trigger interface {
+	// Next returns the first moment after the given time that the rule should
+	// run, or the zero time if it never runs again
+	Next(after time.Time) time.Time
+}
+
+// Trigger returns the parsed cron expression or sun trigger of the rule
+func (rule *ScheduleRule) Trigger() (Trigger, error) {
+	if rule.Sun != "" {
+		position := Position.Get()
+		if position == nil {
+			return nil, fmt.Errorf("sun triggers need a location in config.json")
+		}
+		return ParseSunTrigger(rule.Sun, *position)
+	}
+	return ParseCron(rule.Cron)
+}
+
+// When describes when the rule runs
+func (rule *ScheduleRule) When() string {
+	if rule.Sun != "" {
+		return rule.Sun
+	}
+	return rule.Cron
+}
+
+// Validate returns ValidationErrors if there's anything wrong with the rule, or
+// nil if it's fine
+func (rule *ScheduleRule) Validate() error {
+	errs := ValidationErrors{}
+	field := "cron"
+	if rule.Sun != "" {
+		field = "sun"
+	}
+	if rule.Cron != "" && rule.Sun != "" {
+		errs.add("sun", "can't be combined with cron")
+	} else if trigger, err := rule.Trigger(); err != nil {
+		errs.add(field, "%s", err)
+	} else if trigger.Next(time.Now()).IsZero() {
+		errs.add(field, "never matches")
+	}
+
+	switch rule.Action {
+	case "scene":
+		if _, err := Scenes.Find(rule.Scene); err != nil {
+			errs.add("scene", "unknown scene %q", rule.Scene)
+		}
+	case "playlist":
+		if _, err := Playlists.Find(rule.Playlist); err != nil {
+			errs.add("playlist", "unknown playlist %q", rule.Playlist)
+		}
+	case "brightness":
+		checkRequiredRange(&errs, "value", rule.Value, 0, protocol.MaxBrightness)
+	case "volume":
+		checkRequiredRange(&errs, "value", rule.Value, 0, protocol.MaxVolume)
+	case "off":
+	default:
+		errs.add("action", "should be one of scene, playlist, brightness, volume or off")
+	}
+
+	if len(errs) > 0 {
+		return errs
+	}
+	return nil
+}
+
+/* Storage */
+
+type ScheduleRepository struct {
+	mu    sync.RWMutex
+	path  string
+	rules []*ScheduleRule
+}
+
+// Schedule is the repository the application uses. It is set by LoadSchedule.
+var Schedule *ScheduleRepository
+
+// LoadSchedule loads the schedule from the given file into Schedule
+func LoadSchedule(path string) error {
+	repository, err := NewScheduleRepository(path)
+	if err != nil {
+		return err
+	}
+	Schedule = repository
+	log.Printf("Loaded %d schedule rules from file\n", len(Schedule.rules))
+	return nil
+}
+
+// NewScheduleRepository loads the schedule from the given file. A file that
+// doesn't exist yet is an empty schedule.
+func NewScheduleRepository(path string) (*ScheduleRepository, error) {
+	repository := ScheduleRepository{path: path, rules: make([]*ScheduleRule, 0)}
+	err := readJSONFile(path, &repository.rules)
+	if err != nil && !os.IsNotExist(err) {
+		return nil, fmt.Errorf("can't read schedule from %s: %w", path, err)
+	}
+	return &repository, nil
+}
+
+func (r *ScheduleRepository) All() []*ScheduleRule {
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+	return append([]*ScheduleRule{}, r.rules...)
+}
+
+func (r *ScheduleRepository) FindByUUID(uuid uuid.UUID) (*ScheduleRule, error) {
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+	if index := r.indexOf(uuid); index >= 0 {
+		return r.rules[index], nil
+	}
+	return nil, fmt.Errorf("rule not found")
+}
+
+// Create gives the rule a new UUID and stores it. Invalid rules are refused
+// with ValidationErrors.
+func (r *ScheduleRepository) Create(rule *ScheduleRule) error {
+	if err := rule.Validate(); err != nil {
+		return err
+	}
+	id, err := uuid.NewV7()
+	if err != nil {
+		return err
+	}
+	rule.Uuid = id
+
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	return r.save(append(append([]*ScheduleRule{}, r.rules...), rule))
+}
+
+// Update replaces the rule with the new rule, keeping its UUID, and returns
+// the updated rule. Invalid rules are refused with ValidationErrors.
+func (r *ScheduleRepository) Update(rule *ScheduleRule, newRule *ScheduleRule) (*ScheduleRule, error) {
+	updated := *newRule
+	updated.Uuid = rule.Uuid
+	if err := updated.Validate(); err != nil {
+		return nil, err
+	}
+
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	index := r.indexOf(rule.Uuid)
+	if index < 0 {
+		return nil, fmt.Errorf("rule not found")
+	}
+	rules := append([]*ScheduleRule{}, r.rules...)
+	rules[index] = &updated
+	if err := r.save(rules); err != nil {
+		return nil, err
+	}
+	return &updated, nil
+}
+
+func (r *ScheduleRepository) Delete(rule *ScheduleRule) error {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	index := r.indexOf(rule.Uuid)
+	if index < 0 {
+		return nil
+	}
+	rules := append([]*ScheduleRule{}, r.rules[:index]...)
+	return r.save(append(rules, r.rules[index+1:]...))
+}
+
+// save writes the new list of rules to file, and only then makes it the
+// current list. The caller should hold the lock.
+func (r *ScheduleRepository) save(rules []*ScheduleRule) error {
+	if err := writeJSONFile(r.path, rules); err != nil {
+		log.Println("Could not write to file "+r.path, err)
+		return err
+	}
+	r.rules = rules
+	return nil
+}
+
+func (r *ScheduleRepository) indexOf(uuid uuid.UUID) int {
+	for i, rule := range r.rules {
+		if rule.Uuid == uuid {
+			return i
+		}
+	}
+	return -1
+}
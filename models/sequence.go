@@ -0,0 +1,78 @@
+package models
+
+// A sequence is a scene that runs a list of steps, like flashing a red light,
+// showing an animation and then a clock. Steps show other scenes or send a
+// single command to the device, and wait a while before the next step.
+// Sequences can't be compiled into a single message, so they are run by the
+// controllers instead.
+
+import (
+	"fmt"
+
+	"github.com/google/uuid"
+	"github.com/timendus/pixelbox/protocol"
+)
+
+const MaxStepDelay = 60 * 60 * 1000 // Milliseconds
+
+type Sequence struct {
+	Steps []Step `json:"steps"`
+}
+
+type Step struct {
+	Action string `json:"action"` // "scene", "brightness", "volume", "off" or "time"
+	Scene  string `json:"scene"`  // ID or UUID of the scene to show
+	Value  *int   `json:"value"`  // Brightness or volume to set
+	Delay  int    `json:"delay"`  // Milliseconds to wait before the next step
+}
+
+func (sequence *Sequence) validate(errs *ValidationErrors, field string, self *Scene) {
+	if len(sequence.Steps) == 0 {
+		errs.add(field+".steps", "should have at least one step")
+	}
+	for i, step := range sequence.Steps {
+		prefix := fmt.Sprintf("%s.steps[%d].", field, i)
+		checkRange(errs, prefix+"delay", step.Delay, 0, MaxStepDelay)
+
+		switch step.Action {
+		case "scene":
+			scene, err := Scenes.Find(step.Scene)
+			switch {
+			case step.Scene == self.Id || step.Scene == self.Uuid.String():
+				errs.add(prefix+"scene", "a sequence can't show itself")
+			case err != nil:
+				errs.add(prefix+"scene", "unknown scene %q", step.Scene)
+			case scene.reaches(self.Uuid, make(map[uuid.UUID]bool)):
+				errs.add(prefix+"scene", "scene %q runs this sequence again", step.Scene)
+			}
+		case "brightness":
+			checkRequiredRange(errs, prefix+"value", step.Value, 0, protocol.MaxBrightness)
+		case "volume":
+			checkRequiredRange(errs, prefix+"value", step.Value, 0, protocol.MaxVolume)
+		case "off", "time":
+		default:
+			errs.add(prefix+"action", "should be one of scene, brightness, volume, off or time")
+		}
+	}
+}
+
+// reaches tells whether running the scene would, through the sequences it
+// shows, end up showing the scene with the given UUID
+func (scene *Scene) reaches(target uuid.UUID, seen map[uuid.UUID]bool) bool {
+	if scene.Uuid == target {
+		return true
+	}
+	if scene.SceneType != "sequence" || seen[scene.Uuid] {
+		return false
+	}
+	seen[scene.Uuid] = true
+	for _, step := range scene.Sequence.Steps {
+		if step.Action != "scene" {
+			continue
+		}
+		if next, err := Scenes.Find(step.Scene); err == nil && next.reaches(target, seen) {
+			return true
+		}
+	}
+	return false
+}
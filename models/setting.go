@@ -0,0 +1,26 @@
+package models
+
+import "sync"
+
+// Setting holds a value from config.json that can change while PixelBox is
+// running, when the file is reloaded
+type Setting[T any] struct {
+	mu    sync.RWMutex
+	value T
+}
+
+func NewSetting[T any](value T) *Setting[T] {
+	return &Setting[T]{value: value}
+}
+
+func (s *Setting[T]) Get() T {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	return s.value
+}
+
+func (s *Setting[T]) Set(value T) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.value = value
+}
@@ -0,0 +1,317 @@
+package models
+
+// Scene files store images and animation frames as base64 encoded PNG data,
+// in a `png` field instead of a `pixels` array, which keeps the files small.
+// The compiled device message isn't stored at all, it's recreated when the
+// scene is first shown.
+//
+// Images and animations can also refer to a PNG or GIF file in the assets
+// directory, like `"animation": { "asset": "walk.gif" }`, or to an uploaded file
+// in the asset library by its hash (see assets.go). The repository loads
+// the pixels from the file. As long as they aren't edited, only the reference is
+// stored. Once they are, the edited pixels are stored in the scene instead.
+
+import (
+	"bytes"
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"image"
+	"image/color"
+	"image/gif"
+	"image/png"
+	"maps"
+	"os"
+	"path/filepath"
+	"regexp"
+	"slices"
+
+	"github.com/timendus/pixelbox/graphics"
+)
+
+const assetDir = "assets"
+
+var assetName = regexp.MustCompile(`^[A-Za-z0-9_.-]+\.(png|gif)$`)
+
+type plainImage Image
+
+// UnmarshalJSON accepts the pixels either as a `pixels` array, or as PNG data
+// in `png`
+func (img *Image) UnmarshalJSON(data []byte) error {
+	var stored struct {
+		plainImage
+		PNG []byte `json:"png"`
+	}
+	if err := json.Unmarshal(data, &stored); err != nil {
+		return err
+	}
+	*img = Image(stored.plainImage)
+	if stored.PNG != nil {
+		pixels, err := decodePixels(stored.PNG)
+		if err != nil {
+			return err
+		}
+		img.Pixels = pixels
+	}
+	return nil
+}
+
+type plainFrame Frame
+
+// UnmarshalJSON accepts the pixels either as a `pixels` array, or as PNG data
+// in `png`
+func (frame *Frame) UnmarshalJSON(data []byte) error {
+	var stored struct {
+		plainFrame
+		PNG []byte `json:"png"`
+	}
+	if err := json.Unmarshal(data, &stored); err != nil {
+		return err
+	}
+	*frame = Frame(stored.plainFrame)
+	if stored.PNG != nil {
+		pixels, err := decodePixels(stored.PNG)
+		if err != nil {
+			return err
+		}
+		frame.Pixels = pixels
+	}
+	return nil
+}
+
+// encodeScene returns the document we store for the scene. With inlineAssets
+// set, images and animations from assets are stored in full, so the document
+// can be used without the asset files.
+func encodeScene(scene *Scene, inlineAssets bool) ([]byte, error) {
+	data, err := json.Marshal(scene)
+	if err != nil {
+		return nil, err
+	}
+	var doc map[string]any
+	if err := json.Unmarshal(data, &doc); err != nil {
+		return nil, err
+	}
+	delete(doc, "message")
+	delete(doc, "messageDirty")
+	compactPixels(doc, inlineAssets)
+
+	if data, err = json.MarshalIndent(doc, "", "  "); err != nil {
+		return nil, err
+	}
+	return append(data, '\n'), nil
+}
+
+// writeScene atomically replaces the file at path with the stored document of
+// the scene
+func writeScene(path string, scene *Scene) error {
+	data, err := encodeScene(scene, false)
+	if err != nil {
+		return err
+	}
+	return writeFileAtomic(path, data)
+}
+
+// compactPixels replaces the pixel arrays in the decoded JSON document with PNG
+// data, and leaves out the pixels of images and animations from assets
+func compactPixels(value any, inlineAssets bool) {
+	switch v := value.(type) {
+	case map[string]any:
+		if asset, _ := v["asset"].(string); asset != "" {
+			if inlineAssets {
+				delete(v, "asset")
+			} else {
+				delete(v, "pixels")
+				delete(v, "frames")
+			}
+		}
+		if pixels, ok := pixelArray(v["pixels"]); ok {
+			if data, err := encodePixels(pixels); err == nil {
+				delete(v, "pixels")
+				v["png"] = base64.StdEncoding.EncodeToString(data)
+			}
+		}
+		for _, child := range v {
+			compactPixels(child, inlineAssets)
+		}
+	case []any:
+		for _, child := range v {
+			compactPixels(child, inlineAssets)
+		}
+	}
+}
+
+// pixelArray returns the value as pixels, if it is a complete array of valid
+// pixel values. Anything else, like a template, is stored as it is.
+func pixelArray(value any) ([]int, bool) {
+	values, ok := value.([]any)
+	if !ok || len(values) != PixelCount {
+		return nil, false
+	}
+	pixels := make([]int, len(values))
+	for i, value := range values {
+		number, ok := value.(float64)
+		if !ok || number != float64(int(number)) || number < 0 || number > 255 {
+			return nil, false
+		}
+		pixels[i] = int(number)
+	}
+	return pixels, true
+}
+
+// encodePixels stores the pixels as a PNG image. The pixels aren't
+// premultiplied by their alpha, like in NRGBA, so they survive unchanged.
+func encodePixels(pixels []int) ([]byte, error) {
+	img := image.NewNRGBA(image.Rect(0, 0, Width, Height))
+	for i, value := range pixels {
+		img.Pix[i] = byte(value)
+	}
+	var buffer bytes.Buffer
+	if err := png.Encode(&buffer, img); err != nil {
+		return nil, err
+	}
+	return buffer.Bytes(), nil
+}
+
+func decodePixels(data []byte) ([]int, error) {
+	img, err := png.Decode(bytes.NewReader(data))
+	if err != nil {
+		return nil, fmt.Errorf("invalid PNG data: %w", err)
+	}
+	bounds := img.Bounds()
+	if bounds.Dx() != Width || bounds.Dy() != Height {
+		return nil, fmt.Errorf("PNG data should be %dx%d pixels, not %dx%d", Width, Height, bounds.Dx(), bounds.Dy())
+	}
+	pixels := make([]int, 0, PixelCount)
+	for y := bounds.Min.Y; y < bounds.Max.Y; y++ {
+		for x := bounds.Min.X; x < bounds.Max.X; x++ {
+			c := color.NRGBAModel.Convert(img.At(x, y)).(color.NRGBA)
+			pixels = append(pixels, int(c.R), int(c.G), int(c.B), int(c.A))
+		}
+	}
+	return pixels, nil
+}
+
+/* Assets */
+
+// loadAssets fills in the pixels of the images and animations of the scene
+// that come from assets. If the pixels were edited, the reference to the asset
+// is dropped, so the edits get stored.
+func (r *SceneRepository) loadAssets(scene *Scene) error {
+	// The layers may be shared with the scene this one is a copy of
+	scene.Composite.Layers = slices.Clone(scene.Composite.Layers)
+
+	errs := ValidationErrors{}
+	images := scene.images()
+	for _, field := range slices.Sorted(maps.Keys(images)) {
+		img := images[field]
+		if img.Asset == "" {
+			continue
+		}
+		pixels, err := r.assetImage(img.Asset)
+		switch {
+		case err != nil:
+			errs.add(field+".asset", "%s", err)
+		case len(img.Pixels) == 0:
+			img.Pixels = pixels
+		case !slices.Equal(img.Pixels, pixels):
+			img.Asset = ""
+		}
+	}
+	animations := scene.animations()
+	for _, field := range slices.Sorted(maps.Keys(animations)) {
+		animation := animations[field]
+		if animation.Asset == "" {
+			continue
+		}
+		frames, err := r.assetAnimation(animation.Asset)
+		switch {
+		case err != nil:
+			errs.add(field+".asset", "%s", err)
+		case len(animation.Frames) == 0:
+			animation.Frames = frames
+		case !slices.EqualFunc(animation.Frames, frames, equalFrames):
+			animation.Asset = ""
+		}
+	}
+	if len(errs) > 0 {
+		return errs
+	}
+	return nil
+}
+
+// images returns the images of the scene by their path
+func (scene *Scene) images() map[string]*Image {
+	result := map[string]*Image{"image": &scene.Image}
+	for i := range scene.Composite.Layers {
+		result[fmt.Sprintf("composite.layers[%d].image", i)] = &scene.Composite.Layers[i].Image
+	}
+	return result
+}
+
+// animations returns the animations of the scene by their path
+func (scene *Scene) animations() map[string]*Animation {
+	result := map[string]*Animation{"animation": &scene.Animation}
+	for i := range scene.Composite.Layers {
+		result[fmt.Sprintf("composite.layers[%d].animation", i)] = &scene.Composite.Layers[i].Animation
+	}
+	return result
+}
+
+func equalFrames(a, b Frame) bool {
+	return a.Duration == b.Duration && slices.Equal(a.Pixels, b.Pixels)
+}
+
+func (r *SceneRepository) readAsset(name string) ([]byte, error) {
+	file := name
+	switch {
+	case assetHash.MatchString(name):
+		// The file name has the type of the asset, so look it up
+		matches, _ := filepath.Glob(filepath.Join(r.dir, assetDir, name+".*"))
+		if len(matches) == 0 {
+			return nil, fmt.Errorf("asset %q doesn't exist", name)
+		}
+		file = filepath.Base(matches[0])
+	case !assetName.MatchString(name):
+		return nil, fmt.Errorf("%q is not a PNG or GIF file name, or the hash of an asset", name)
+	}
+	data, err := os.ReadFile(filepath.Join(r.dir, assetDir, file))
+	if os.IsNotExist(err) {
+		return nil, fmt.Errorf("asset %q doesn't exist", name)
+	}
+	return data, err
+}
+
+// assetImage returns the pixels of the image in the asset, or of the first
+// frame if it's animated, scaled to fit the display
+func (r *SceneRepository) assetImage(name string) ([]int, error) {
+	data, err := r.readAsset(name)
+	if err != nil {
+		return nil, err
+	}
+	img, _, err := image.Decode(bytes.NewReader(data))
+	if err != nil {
+		return nil, fmt.Errorf("asset %q is not a valid image: %w", name, err)
+	}
+	return PixelsFromRGBA(graphics.ToScaledRGBA(img)), nil
+}
+
+// assetAnimation returns the frames of the animated GIF in the asset, scaled to
+// fit the display
+func (r *SceneRepository) assetAnimation(name string) ([]Frame, error) {
+	data, err := r.readAsset(name)
+	if err != nil {
+		return nil, err
+	}
+	animation, err := gif.DecodeAll(bytes.NewReader(data))
+	if err != nil {
+		return nil, fmt.Errorf("asset %q is not a valid GIF file: %w", name, err)
+	}
+	frames := make([]Frame, 0, len(animation.Image))
+	for i, img := range graphics.GIFFrames(animation) {
+		frames = append(frames, Frame{
+			Duration: animation.Delay[i] * 10, // GIF delays are in hundredths of a second
+			Pixels:   PixelsFromRGBA(graphics.ToScaledRGBA(img)),
+		})
+	}
+	return frames, nil
+}
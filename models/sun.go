@@ -0,0 +1,174 @@
+package models
+
+// Sunrise, sunset and civil twilight, computed with the sunrise equation (see
+// https://en.wikipedia.org/wiki/Sunrise_equation). The results are within a
+// minute or so of what the almanacs say, which is plenty for switching scenes.
+//
+// Schedule rules can use these as triggers, like `sunset-30m`.
+
+import (
+	"fmt"
+	"math"
+	"strings"
+	"time"
+)
+
+type Coordinates struct {
+	Latitude  float64 `json:"latitude"`  // Degrees, north is positive
+	Longitude float64 `json:"longitude"` // Degrees, east is positive
+}
+
+// Position is where the device is, for the sun triggers. It is nil if it's not
+// configured.
+var Position = NewSetting[*Coordinates](nil)
+
+// SunTimes holds the moments of one day. Moments that don't happen on that day,
+// like the sunset during the polar summer, are nil.
+type SunTimes struct {
+	Dawn    *time.Time `json:"dawn"` // Start of civil twilight
+	Sunrise *time.Time `json:"sunrise"`
+	Noon    *time.Time `json:"noon"`
+	Sunset  *time.Time `json:"sunset"`
+	Dusk    *time.Time `json:"dusk"` // End of civil twilight
+}
+
+const (
+	j2000          = 2451545.0 // Julian date of 2000-01-01 12:00 UTC
+	unixEpochJD    = 2440587.5 // Julian date of 1970-01-01 00:00 UTC
+	sunriseAngle   = -0.833    // Degrees, corrected for refraction and the size of the sun
+	civilTwilight  = -6.0      // Degrees
+	earthObliquity = 23.4397   // Degrees
+)
+
+// Sun computes the sun times at the given position for the day of the given
+// time, in the time zone of that time
+func (position Coordinates) Sun(day time.Time) SunTimes {
+	// Find the solar noon closest to noon on the local clock
+	localNoon := time.Date(day.Year(), day.Month(), day.Day(), 12, 0, 0, 0, day.Location())
+	n := math.Round(julianDate(localNoon) - j2000 + position.Longitude/360)
+	meanNoon := n - position.Longitude/360
+
+	anomaly := normalizeDegrees(357.5291 + 0.98560028*meanNoon)
+	m := radians(anomaly)
+	center := 1.9148*math.Sin(m) + 0.0200*math.Sin(2*m) + 0.0003*math.Sin(3*m)
+	longitude := radians(normalizeDegrees(anomaly + center + 180 + 102.9372))
+	transit := j2000 + meanNoon + 0.0053*math.Sin(m) - 0.0069*math.Sin(2*longitude)
+	declination := math.Asin(math.Sin(longitude) * math.Sin(radians(earthObliquity)))
+
+	// hourAngle returns the Julian dates at which the sun is at the given
+	// altitude, or false if it doesn't get there on this day
+	latitude := radians(position.Latitude)
+	hourAngle := func(altitude float64) (float64, float64, bool) {
+		cos := (math.Sin(radians(altitude)) - math.Sin(latitude)*math.Sin(declination)) /
+			(math.Cos(latitude) * math.Cos(declination))
+		if cos < -1 || cos > 1 {
+			return 0, 0, false
+		}
+		offset := degrees(math.Acos(cos)) / 360
+		return transit - offset, transit + offset, true
+	}
+
+	moment := func(jd float64) *time.Time {
+		t := fromJulianDate(jd).In(day.Location()).Truncate(time.Second)
+		return &t
+	}
+
+	times := SunTimes{Noon: moment(transit)}
+	if rise, set, ok := hourAngle(sunriseAngle); ok {
+		times.Sunrise, times.Sunset = moment(rise), moment(set)
+	}
+	if dawn, dusk, ok := hourAngle(civilTwilight); ok {
+		times.Dawn, times.Dusk = moment(dawn), moment(dusk)
+	}
+	return times
+}
+
+// Get returns the moment of the event with the given name
+func (times SunTimes) Get(event string) *time.Time {
+	switch event {
+	case "dawn":
+		return times.Dawn
+	case "sunrise":
+		return times.Sunrise
+	case "noon":
+		return times.Noon
+	case "sunset":
+		return times.Sunset
+	case "dusk":
+		return times.Dusk
+	}
+	return nil
+}
+
+// SunTrigger is a schedule trigger like `sunset-30m`: a sun event, optionally
+// followed by an offset
+type SunTrigger struct {
+	event    string
+	offset   time.Duration
+	position Coordinates
+}
+
+var sunEvents = []string{"dawn", "sunrise", "noon", "sunset", "dusk"}
+
+const maxSunOffset = 24 * time.Hour
+
+func ParseSunTrigger(trigger string, position Coordinates) (*SunTrigger, error) {
+	trigger = strings.ToLower(strings.TrimSpace(trigger))
+	for _, event := range sunEvents {
+		rest, found := strings.CutPrefix(trigger, event)
+		if !found {
+			continue
+		}
+		result := SunTrigger{event: event, position: position}
+		if rest == "" {
+			return &result, nil
+		}
+		if rest[0] != '+' && rest[0] != '-' {
+			break
+		}
+		offset, err := time.ParseDuration(rest)
+		if err != nil {
+			return nil, fmt.Errorf("invalid offset %q, use something like +1h or -30m", rest)
+		}
+		// Next only looks a day before and after the event
+		if offset < -maxSunOffset || offset > maxSunOffset {
+			return nil, fmt.Errorf("offset %q should be at most 24 hours", rest)
+		}
+		result.offset = offset
+		return &result, nil
+	}
+	return nil, fmt.Errorf("expected one of %s, optionally followed by an offset like -30m", strings.Join(sunEvents, ", "))
+}
+
+// Next returns the first moment after the given time that the trigger fires,
+// in the time zone of the given time. Near the poles, where the sun may not
+// rise or set for months, it returns the zero time if that doesn't happen in
+// the next year.
+func (trigger *SunTrigger) Next(after time.Time) time.Time {
+	// Start a day early, because the offset can move an event to the day
+	// before or after
+	day := after.AddDate(0, 0, -1)
+	for i := 0; i < 367; i++ {
+		if moment := trigger.position.Sun(day.AddDate(0, 0, i)).Get(trigger.event); moment != nil {
+			if at := moment.Add(trigger.offset).Truncate(time.Minute); at.After(after) {
+				return at
+			}
+		}
+	}
+	return time.Time{}
+}
+
+func julianDate(t time.Time) float64 {
+	return float64(t.Unix())/86400 + unixEpochJD
+}
+
+func fromJulianDate(jd float64) time.Time {
+	return time.Unix(int64(math.Round((jd-unixEpochJD)*86400)), 0)
+}
+
+func normalizeDegrees(value float64) float64 {
+	return math.Mod(math.Mod(value, 360)+360, 360)
+}
+
+func radians(value float64) float64 { return value * math.Pi / 180 }
+func degrees(value float64) float64 { return value * 180 / math.Pi }
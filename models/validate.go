@@ -0,0 +1,226 @@
+package models
+
+// Validation checks a scene before we store it, so mistakes are reported right
+// away instead of when the scene is applied. Only the settings that the scene
+// type actually uses are checked, because the user interface sends the
+// settings of all the other scene types along too.
+
+import (
+	"fmt"
+	"slices"
+	"strings"
+	"unicode/utf8"
+
+	"github.com/timendus/pixelbox/graphics"
+	"github.com/timendus/pixelbox/protocol"
+)
+
+type FieldError struct {
+	Field   string `json:"field"`
+	Message string `json:"message"`
+}
+
+// ValidationErrors is the list of everything that is wrong with a scene
+type ValidationErrors []FieldError
+
+func (errs ValidationErrors) Error() string {
+	messages := make([]string, len(errs))
+	for i, err := range errs {
+		messages[i] = err.Field + ": " + err.Message
+	}
+	return strings.Join(messages, ", ")
+}
+
+func (errs *ValidationErrors) add(field, format string, args ...any) {
+	*errs = append(*errs, FieldError{Field: field, Message: fmt.Sprintf(format, args...)})
+}
+
+// Validate returns ValidationErrors if there's anything wrong with the scene,
+// or nil if it's fine
+func (scene *Scene) Validate() error {
+	errs := ValidationErrors{}
+
+	checkFolder(&errs, "folder", scene.Folder)
+	for i, tag := range scene.Tags {
+		if tag == "" || strings.TrimSpace(tag) != tag || strings.Contains(tag, ",") {
+			errs.add(fmt.Sprintf("tags[%d]", i), "should not be empty, have spaces around it or contain commas")
+		}
+	}
+
+	if scene.Brightness != nil {
+		checkRange(&errs, "brightness", *scene.Brightness, 0, protocol.MaxBrightness)
+	} else if scene.ChangeBrightness || scene.SceneType == "light" {
+		errs.add("brightness", "is required")
+	}
+	if scene.Volume != nil {
+		checkRange(&errs, "volume", *scene.Volume, 0, protocol.MaxVolume)
+	} else if scene.ChangeVolume {
+		errs.add("volume", "is required")
+	}
+
+	switch scene.SceneType {
+	case "clock":
+		if !protocol.ClockType(scene.Clock.CType).Valid() {
+			errs.add("clock.type", "unknown clock type %q", scene.Clock.CType)
+		}
+		checkColor(&errs, "clock.color", scene.Clock.Color)
+		if scene.Weather.Enabled || scene.Temperature.Enabled {
+			if !protocol.WeatherType(scene.Weather.WType).Valid() {
+				errs.add("weather.type", "unknown weather type %q", scene.Weather.WType)
+			}
+			if scene.Temperature.Temperature != nil {
+				checkRange(&errs, "temperature.temperature", *scene.Temperature.Temperature, -protocol.MaxTemperature, protocol.MaxTemperature)
+			}
+		}
+
+	case "light":
+		if !protocol.LightType(scene.Light.LType).Valid() {
+			errs.add("light.type", "unknown light type %q", scene.Light.LType)
+		}
+		checkColor(&errs, "light.color", scene.Light.Color)
+
+	case "effects":
+		effect := scene.Effect
+		switch effect.EType {
+		case "CLOUD":
+		case "VJ":
+			checkRequiredRange(&errs, "effect.vjType", effect.VJType, 0, protocol.MaxVJEffect)
+		case "VISUALISATION":
+			checkRequiredRange(&errs, "effect.visualisationType", effect.VisualisationType, 0, protocol.MaxVisualisation)
+		case "SCOREBOARD":
+			checkRequiredRange(&errs, "effect.scoreRedPlayer", effect.ScoreRedPlayer, 0, protocol.MaxScore)
+			checkRequiredRange(&errs, "effect.scoreBluePlayer", effect.ScoreBluePlayer, 0, protocol.MaxScore)
+		default:
+			errs.add("effect.type", "unknown effect type %q", effect.EType)
+		}
+
+	case "image":
+		checkPixels(&errs, "image.pixels", scene.Image.Pixels)
+
+	case "animation":
+		checkFrames(&errs, "animation.frames", scene.Animation.Frames)
+
+	case "composite":
+		scene.Composite.validate(&errs, "composite")
+
+	case "sequence":
+		scene.Sequence.validate(&errs, "sequence", scene)
+
+	default:
+		errs.add("sceneType", "unknown scene type %q", scene.SceneType)
+	}
+
+	// Settings that are bound to variables get their values later
+	errs = slices.DeleteFunc(errs, func(err FieldError) bool { return scene.isBound(err.Field) })
+
+	if len(errs) > 0 {
+		return errs
+	}
+	return nil
+}
+
+func (composite *Composite) validate(errs *ValidationErrors, field string) {
+	if len(composite.Layers) > maxCompositeLayers {
+		errs.add(field+".layers", "should have at most %d layers", maxCompositeLayers)
+	}
+	for i, layer := range composite.Layers {
+		prefix := fmt.Sprintf("%s.layers[%d].", field, i)
+
+		if layer.Opacity != nil && (*layer.Opacity < 0 || *layer.Opacity > 1) {
+			errs.add(prefix+"opacity", "should be between 0 and 1")
+		}
+		if !layer.Blend.Valid() {
+			errs.add(prefix+"blend", "unknown blend mode %q", layer.Blend)
+		}
+
+		switch layer.LType {
+		case "image":
+			checkPixels(errs, prefix+"image.pixels", layer.Image.Pixels)
+		case "animation":
+			checkFrames(errs, prefix+"animation.frames", layer.Animation.Frames)
+			if len(layer.Animation.Frames) > maxLayerFrames {
+				errs.add(prefix+"animation.frames", "should have at most %d frames", maxLayerFrames)
+			}
+		case "text":
+			if length := utf8.RuneCountInString(layer.Text.Text); length > MaxTextLength {
+				errs.add(prefix+"text.text", "should be at most %d characters, got %d", MaxTextLength, length)
+			}
+			checkOptionalColor(errs, prefix+"text.color", layer.Text.Color)
+		case "progress":
+			checkRange(errs, prefix+"progress.value", layer.Progress.Value, 0, 100)
+			checkRange(errs, prefix+"progress.width", layer.Progress.Width, 0, Width)
+			checkRange(errs, prefix+"progress.height", layer.Progress.Height, 0, Height)
+			checkOptionalColor(errs, prefix+"progress.color", layer.Progress.Color)
+			checkOptionalColor(errs, prefix+"progress.background", layer.Progress.Background)
+		case "icon":
+			if _, err := graphics.FindIcon(layer.Icon.Name); err != nil {
+				errs.add(prefix+"icon.name", "unknown icon %q", layer.Icon.Name)
+			}
+			checkOptionalColor(errs, prefix+"icon.color", layer.Icon.Color)
+		default:
+			errs.add(prefix+"type", "unknown layer type %q", layer.LType)
+		}
+	}
+}
+
+func checkRange(errs *ValidationErrors, field string, value, min, max int) {
+	if value < min || value > max {
+		errs.add(field, "should be between %d and %d", min, max)
+	}
+}
+
+func checkRequiredRange(errs *ValidationErrors, field string, value *int, min, max int) {
+	if value == nil {
+		errs.add(field, "is required")
+		return
+	}
+	checkRange(errs, field, *value, min, max)
+}
+
+func checkColor(errs *ValidationErrors, field, color string) {
+	if !protocol.ValidHexColor(color) {
+		errs.add(field, "should be a color like #FF0000")
+	}
+}
+
+func checkOptionalColor(errs *ValidationErrors, field, color string) {
+	if color != "" {
+		checkColor(errs, field, color)
+	}
+}
+
+func checkFolder(errs *ValidationErrors, field, folder string) {
+	if folder == "" {
+		return
+	}
+	for _, part := range strings.Split(folder, "/") {
+		if part == "" || part == "." || part == ".." || strings.TrimSpace(part) != part {
+			errs.add(field, "should be a path like holidays/christmas, without a slash at the start or the end")
+			return
+		}
+	}
+}
+
+func checkPixels(errs *ValidationErrors, field string, pixels []int) {
+	if len(pixels) != PixelCount {
+		errs.add(field, "should have %d values, got %d", PixelCount, len(pixels))
+		return
+	}
+	for _, value := range pixels {
+		if value < 0 || value > 255 {
+			errs.add(field, "values should be between 0 and 255")
+			return
+		}
+	}
+}
+
+func checkFrames(errs *ValidationErrors, field string, frames []Frame) {
+	if len(frames) == 0 {
+		errs.add(field, "should have at least one frame")
+	}
+	for i, frame := range frames {
+		prefix := fmt.Sprintf("%s[%d].", field, i)
+		checkRange(errs, prefix+"duration", frame.Duration, 0, protocol.MaxFrameDuration)
+		checkPixels(errs, prefix+"pixels", frame.Pixels)
+	}
+}
@@ -0,0 +1,104 @@
+package models
+
+// Variables are named values, like the temperature outside, that scenes can
+// use in their settings (see bindings.go). They are pushed to PixelBox by other
+// systems and stored in a single JSON file, so they survive a restart.
+
+import (
+	"fmt"
+	"log"
+	"maps"
+	"os"
+	"regexp"
+	"sync"
+)
+
+type VariableRepository struct {
+	mu     sync.RWMutex
+	path   string
+	values map[string]any
+}
+
+// Vars is the repository the application uses. It is set by LoadVars.
+var Vars *VariableRepository
+
+var variableName = regexp.MustCompile(`^[A-Za-z0-9_.-]+$`)
+
+// LoadVars loads the variables from the given file into Vars
+func LoadVars(path string) error {
+	repository, err := NewVariableRepository(path)
+	if err != nil {
+		return err
+	}
+	Vars = repository
+	log.Printf("Loaded %d variables from file\n", len(Vars.values))
+	return nil
+}
+
+// NewVariableRepository loads the variables from the given file. A file that
+// doesn't exist yet means there are no variables.
+func NewVariableRepository(path string) (*VariableRepository, error) {
+	repository := VariableRepository{path: path, values: make(map[string]any)}
+	err := readJSONFile(path, &repository.values)
+	if err != nil && !os.IsNotExist(err) {
+		return nil, fmt.Errorf("can't read variables from %s: %w", path, err)
+	}
+	return &repository, nil
+}
+
+func (r *VariableRepository) All() map[string]any {
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+	return maps.Clone(r.values)
+}
+
+func (r *VariableRepository) Get(name string) (any, bool) {
+	if r == nil {
+		return nil, false
+	}
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+	value, ok := r.values[name]
+	return value, ok
+}
+
+// Set stores the value of the variable. Values can be numbers, strings or
+// booleans.
+func (r *VariableRepository) Set(name string, value any) error {
+	if !variableName.MatchString(name) {
+		return fmt.Errorf("invalid variable name %q, use letters, digits, dots, dashes and underscores", name)
+	}
+	switch value.(type) {
+	case float64, string, bool:
+	default:
+		return fmt.Errorf("variables should be a number, a string or a boolean")
+	}
+
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	values := maps.Clone(r.values)
+	values[name] = value
+	return r.save(values)
+}
+
+func (r *VariableRepository) Delete(name string) error {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if _, ok := r.values[name]; !ok {
+		return fmt.Errorf("variable not found")
+	}
+	values := maps.Clone(r.values)
+	delete(values, name)
+	return r.save(values)
+}
+
+// save writes the new variables to file, and only then makes them the current
+// variables. The caller should hold the lock.
+func (r *VariableRepository) save(values map[string]any) error {
+	if err := writeJSONFile(r.path, values); err != nil {
+		log.Println("Could not write to file "+r.path, err)
+		return err
+	}
+	r.values = values
+	return nil
+}
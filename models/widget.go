@@ -0,0 +1,171 @@
+package models
+
+// Widgets turn numbers that get pushed to the server into 16x16 images. Each
+// widget keeps a short history of its values, for the charts. Widgets only
+// live in memory; they are recreated by pushing values to them again.
+
+import (
+	"fmt"
+	"image"
+	"slices"
+	"sync"
+
+	"github.com/timendus/pixelbox/graphics"
+)
+
+const widgetHistory = 64
+
+type Widget struct {
+	Name       string    `json:"name"`
+	WType      string    `json:"type"`
+	Color      string    `json:"color"`
+	Background string    `json:"background"`
+	Min        *float64  `json:"min"`
+	Max        *float64  `json:"max"`
+	History    []float64 `json:"history"`
+}
+
+var widgetTypes = []string{"counter", "progress", "radial", "sparkline", "bars", "trend"}
+
+var widgets = map[string]*Widget{}
+var widgetsMu sync.Mutex
+
+// AllWidgets returns a copy of every widget
+func AllWidgets() []Widget {
+	widgetsMu.Lock()
+	defer widgetsMu.Unlock()
+	result := make([]Widget, 0, len(widgets))
+	for _, widget := range widgets {
+		result = append(result, widget.copy())
+	}
+	return result
+}
+
+// FindWidget returns a copy of the widget with the given name
+func FindWidget(name string) (Widget, error) {
+	widgetsMu.Lock()
+	defer widgetsMu.Unlock()
+	widget, ok := widgets[name]
+	if !ok {
+		return Widget{}, fmt.Errorf("widget not found")
+	}
+	return widget.copy(), nil
+}
+
+// ConfigureWidget creates the widget or changes its settings, keeping the
+// history of values it already had
+func ConfigureWidget(name string, config Widget) (Widget, error) {
+	if config.WType == "" {
+		config.WType = "counter"
+	}
+	if !slices.Contains(widgetTypes, config.WType) {
+		return Widget{}, fmt.Errorf("unknown widget type %q, expected one of %v", config.WType, widgetTypes)
+	}
+
+	widgetsMu.Lock()
+	defer widgetsMu.Unlock()
+	config.Name = name
+	config.History = nil
+	if existing, ok := widgets[name]; ok {
+		config.History = existing.History
+	}
+	widgets[name] = &config
+	return config.copy(), nil
+}
+
+// PushWidgetValue adds a value to the widget's history. If the widget doesn't
+// exist yet, it is created with the given type. Returns the updated widget and
+// whether the value is different from the previous one.
+func PushWidgetValue(name string, value float64, wtype string) (Widget, bool, error) {
+	widgetsMu.Lock()
+	defer widgetsMu.Unlock()
+
+	widget, ok := widgets[name]
+	if !ok {
+		if wtype == "" {
+			wtype = "counter"
+		}
+		if !slices.Contains(widgetTypes, wtype) {
+			return Widget{}, false, fmt.Errorf("unknown widget type %q, expected one of %v", wtype, widgetTypes)
+		}
+		widget = &Widget{Name: name, WType: wtype}
+		widgets[name] = widget
+	}
+
+	changed := len(widget.History) == 0 || widget.History[len(widget.History)-1] != value
+	widget.History = append(widget.History, value)
+	if len(widget.History) > widgetHistory {
+		widget.History = widget.History[len(widget.History)-widgetHistory:]
+	}
+	return widget.copy(), changed, nil
+}
+
+// DeleteWidget forgets about the widget and its history
+func DeleteWidget(name string) error {
+	widgetsMu.Lock()
+	defer widgetsMu.Unlock()
+	if _, ok := widgets[name]; !ok {
+		return fmt.Errorf("widget not found")
+	}
+	delete(widgets, name)
+	return nil
+}
+
+// Render draws the widget with its current value
+func (widget *Widget) Render() *image.RGBA {
+	defaults := map[string]string{
+		"counter":   "#FFFFFF",
+		"progress":  "#00FF00",
+		"radial":    "#00AAFF",
+		"sparkline": "#FFAA00",
+		"bars":      "#AA00FF",
+		"trend":     "#00FF00",
+	}
+	foreground := hexColor(widget.Color, defaults[widget.WType])
+	img := graphics.NewFrame(hexColor(widget.Background, "#000000"))
+
+	value, previous := 0.0, 0.0
+	if length := len(widget.History); length > 0 {
+		value, previous = widget.History[length-1], widget.History[length-1]
+		if length > 1 {
+			previous = widget.History[length-2]
+		}
+	}
+
+	low, high := graphics.SeriesRange(widget.History)
+	if widget.WType == "progress" || widget.WType == "radial" {
+		low, high = 0, 100
+	}
+	if widget.Min != nil {
+		low = *widget.Min
+	}
+	if widget.Max != nil {
+		high = *widget.Max
+	}
+	fraction := 0.0
+	if high > low {
+		fraction = (value - low) / (high - low)
+	}
+
+	switch widget.WType {
+	case "counter":
+		graphics.DrawCounter(img, value, foreground)
+	case "progress":
+		graphics.DrawProgressBar(img, fraction, foreground, graphics.Dim(foreground))
+	case "radial":
+		graphics.DrawRadialProgress(img, fraction, foreground, graphics.Dim(foreground))
+	case "sparkline":
+		graphics.DrawSparkline(img, widget.History, low, high, foreground)
+	case "bars":
+		graphics.DrawBarChart(img, widget.History, low, high, foreground)
+	case "trend":
+		graphics.DrawTrend(img, previous, value, foreground, hexColor("#FF0000", ""), hexColor("#FFAA00", ""))
+	}
+	return img
+}
+
+func (widget *Widget) copy() Widget {
+	result := *widget
+	result.History = append([]float64{}, widget.History...)
+	return result
+}
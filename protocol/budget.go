@@ -0,0 +1,183 @@
+package protocol
+
+// This file makes sure animations fit within the limits of the device and the
+// Bluetooth link. Frames with out of range durations are clamped, and if there
+// are too many frames or the message gets too large, the frames that differ the
+// least from the frame before them are merged into that frame. Merging keeps
+// the total duration of the animation intact: frames are only merged if their
+// durations together still fit within MaxDuration.
+
+import (
+	"fmt"
+	"image"
+	"slices"
+)
+
+type AnimationBudget struct {
+	MaxFrames    int `json:"maxFrames"`
+	MaxBytes     int `json:"maxBytes"`
+	MinDuration  int `json:"minDuration"`
+	MaxDuration  int `json:"maxDuration"`
+	ZeroDuration int `json:"zeroDuration"`
+}
+
+// DefaultAnimationBudget is the budget for animations when config.json doesn't
+// set one
+var DefaultAnimationBudget = AnimationBudget{
+	MaxFrames:    60,
+	MaxBytes:     64 << 10,
+	MinDuration:  20,
+	MaxDuration:  MaxFrameDuration,
+	ZeroDuration: 100,
+}
+
+// The report tells the user what we had to change to make the animation fit
+type BudgetReport struct {
+	Budget           AnimationBudget `json:"budget"`
+	OriginalFrames   int             `json:"originalFrames"`
+	Frames           int             `json:"frames"`
+	MergedFrames     int             `json:"mergedFrames"`
+	OriginalDuration int             `json:"originalDuration"`
+	Duration         int             `json:"duration"`
+	ZeroDurations    int             `json:"zeroDurations"`
+	ClampedDurations int             `json:"clampedDurations"`
+	Bytes            int             `json:"bytes"`
+}
+
+// FitAnimation applies the budget to the frames and durations, and returns the
+// encoded message together with a report of what was changed.
+func FitAnimation(frames []*image.RGBA, durations []int, budget AnimationBudget) ([]byte, *BudgetReport, error) {
+	if len(frames) != len(durations) {
+		return nil, nil, fmt.Errorf("expected a duration for each of the %d frames, got %d", len(frames), len(durations))
+	}
+
+	// Never go outside of what the protocol can encode
+	budget.MinDuration = max(budget.MinDuration, 0)
+	budget.MaxDuration = min(budget.MaxDuration, MaxFrameDuration)
+
+	report := &BudgetReport{
+		Budget:         budget,
+		OriginalFrames: len(frames),
+	}
+
+	// Normalise the durations. Browsers show frames without a delay for 100ms,
+	// so we do something similar.
+	durations = slices.Clone(durations)
+	for i, duration := range durations {
+		report.OriginalDuration += duration
+		if duration <= 0 {
+			duration = budget.ZeroDuration
+			report.ZeroDurations++
+		}
+		durations[i] = min(max(duration, budget.MinDuration), budget.MaxDuration)
+		if durations[i] != duration {
+			report.ClampedDurations++
+		}
+	}
+
+	// Get under the frame and byte budgets. Merging a frame doesn't change the
+	// frames around it, so we can keep track of the size of the message
+	// without encoding it every time.
+	fit, err := newAnimationFit(frames, durations)
+	if err != nil {
+		return nil, nil, err
+	}
+	for len(fit.frames) > 1 && (len(fit.frames) > budget.MaxFrames ||
+		fit.dataSize > maxAnimationData ||
+		animationMessageSize(fit.dataSize) > budget.MaxBytes) {
+		if !fit.mergeLeastVisibleFrame(budget.MaxDuration) {
+			return nil, nil, fmt.Errorf("can't make the animation fit without making it shorter, its frames are too long to merge")
+		}
+	}
+
+	message, err := ShowAnimation(fit.frames, fit.durations)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	report.Frames = len(fit.frames)
+	report.MergedFrames = report.OriginalFrames - report.Frames
+	for _, duration := range fit.durations {
+		report.Duration += duration
+	}
+	report.Bytes = len(message)
+	return message, report, nil
+}
+
+// animationFit keeps track of the frames of an animation while they are being
+// merged, with the size of each frame and how much it differs from the frame
+// before it
+type animationFit struct {
+	frames      []*image.RGBA
+	durations   []int
+	sizes       []int
+	differences []int // The first frame has no frame before it
+	dataSize    int
+}
+
+func newAnimationFit(frames []*image.RGBA, durations []int) (*animationFit, error) {
+	fit := animationFit{
+		frames:      slices.Clone(frames),
+		durations:   durations,
+		sizes:       make([]int, len(frames)),
+		differences: make([]int, len(frames)),
+	}
+	for i, frame := range frames {
+		size, err := animationFrameSize(frame)
+		if err != nil {
+			return nil, err
+		}
+		fit.sizes[i] = size
+		fit.dataSize += size
+		if i > 0 {
+			fit.differences[i] = frameDifference(frames[i-1], frame)
+		}
+	}
+	return &fit, nil
+}
+
+// mergeLeastVisibleFrame finds the frame that is most similar to the frame
+// before it, and removes it. Its duration gets added to the previous frame, so
+// the animation keeps the same length. Frames are only merged if their
+// durations together are at most maxDuration, so no time gets lost. The first
+// frame is never removed. It returns false if no frame could be merged.
+func (fit *animationFit) mergeLeastVisibleFrame(maxDuration int) bool {
+	best := -1
+	for i := 1; i < len(fit.frames); i++ {
+		if fit.durations[i-1]+fit.durations[i] > maxDuration {
+			continue
+		}
+		if best < 0 || fit.differences[i] < fit.differences[best] {
+			best = i
+		}
+	}
+	if best < 0 {
+		return false
+	}
+
+	fit.durations[best-1] += fit.durations[best]
+	fit.dataSize -= fit.sizes[best]
+	fit.frames = slices.Delete(fit.frames, best, best+1)
+	fit.durations = slices.Delete(fit.durations, best, best+1)
+	fit.sizes = slices.Delete(fit.sizes, best, best+1)
+	fit.differences = slices.Delete(fit.differences, best, best+1)
+	if best < len(fit.frames) {
+		fit.differences[best] = frameDifference(fit.frames[best-1], fit.frames[best])
+	}
+	return true
+}
+
+func frameDifference(a, b *image.RGBA) int {
+	difference := 0
+	for i := range a.Pix {
+		if i >= len(b.Pix) {
+			break
+		}
+		delta := int(a.Pix[i]) - int(b.Pix[i])
+		if delta < 0 {
+			delta = -delta
+		}
+		difference += delta
+	}
+	return difference
+}
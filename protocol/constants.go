@@ -1,6 +1,9 @@
 package protocol
 
-import "maps"
+import (
+	"errors"
+	"maps"
+)
 
 // These are the valid strings for the weather, clock and light types
 
@@ -33,6 +36,42 @@ var lightTypes = map[LightType]byte{
 	"RED_BLUE_STRIPED": 2,
 }
 
+// Valid reports whether the weather type is one the device knows
+func (t WeatherType) Valid() bool {
+	_, ok := weatherTypes[t]
+	return ok
+}
+
+// Valid reports whether the clock type is one the device knows
+func (t ClockType) Valid() bool {
+	_, ok := clockTypes[t]
+	return ok
+}
+
+// Valid reports whether the light type is one the device knows
+func (t LightType) Valid() bool {
+	_, ok := lightTypes[t]
+	return ok
+}
+
+// The ranges of the numeric values that the device accepts. They all start at
+// zero, except for the temperature, which goes from -MaxTemperature up.
+const (
+	MaxVolume        = 16
+	MaxBrightness    = 100
+	MaxTemperature   = 99
+	MaxVJEffect      = 15
+	MaxVisualisation = 11
+	MaxScore         = 999
+	MaxFrameDuration = 0xFFFF // Milliseconds
+)
+
+// Animations are sent in numbered packets of 200 bytes, with a one byte packet
+// number and the total size in two bytes
+const maxAnimationData = 256 * 200
+
+var ErrAnimationTooLarge = errors.New("the animation is too large to send to the device")
+
 var channels = map[string]byte{
 	"CLOCK":         0,
 	"LIGHT":         1,
@@ -14,6 +14,9 @@ import (
 	"fmt"
 )
 
+// envelopeSize is the number of bytes wrap adds to a command
+const envelopeSize = 6
+
 func wrap(command []byte) []byte {
 	envelope := []byte{prefix, 0, 0}
 	envelope = append(envelope, command...)
@@ -16,6 +16,17 @@ func (c1 *Color) equals(c2 Color) bool {
 		c1[2] == c2[2]
 }
 
+// ValidHexColor reports whether the color is written like "#FF0000". The hash
+// is optional.
+func ValidHexColor(hex string) bool {
+	hex = strings.TrimPrefix(hex, "#")
+	if len(hex) != 6 {
+		return false
+	}
+	_, err := strconv.ParseUint(hex, 16, 32)
+	return err == nil
+}
+
 func ColorFromHex(hex string) Color {
 	color := Color{}
 	hex = strings.TrimPrefix(hex, "#")
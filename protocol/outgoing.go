@@ -44,16 +44,16 @@ func SetTime(moment time.Time) []byte {
 }
 
 func SetVolume(volume int) ([]byte, error) {
-	if volume < 0 || volume > 16 {
-		return nil, fmt.Errorf("volume should be between 0 and 16")
+	if volume < 0 || volume > MaxVolume {
+		return nil, fmt.Errorf("volume should be between 0 and %d", MaxVolume)
 	}
 
 	return wrap([]byte{setVolume, byte(volume)}), nil
 }
 
 func SetBrightness(brightness int) ([]byte, error) {
-	if brightness < 0 || brightness > 100 {
-		return nil, fmt.Errorf("brightness should be between 0 and 100")
+	if brightness < 0 || brightness > MaxBrightness {
+		return nil, fmt.Errorf("brightness should be between 0 and %d", MaxBrightness)
 	}
 
 	return wrap([]byte{setBrightness, byte(brightness)}), nil
@@ -65,7 +65,7 @@ func SetWeather(temperature int, wtype WeatherType) ([]byte, error) {
 		return nil, fmt.Errorf("invalid weather type")
 	}
 
-	if temperature <= -100 || temperature >= 100 {
+	if temperature < -MaxTemperature || temperature > MaxTemperature {
 		return nil, fmt.Errorf("temperature out of bounds")
 	}
 
@@ -94,8 +94,8 @@ func ShowClock(ctype ClockType, showTime, showWeather, showTemp, showCal bool, c
 }
 
 func ShowLight(ltype LightType, color Color, brightness int) ([]byte, error) {
-	if brightness < 0 || brightness > 100 {
-		return nil, fmt.Errorf("brightness should be between 0 and 100")
+	if brightness < 0 || brightness > MaxBrightness {
+		return nil, fmt.Errorf("brightness should be between 0 and %d", MaxBrightness)
 	}
 
 	lightType, ok := lightTypes[ltype]
@@ -124,8 +124,8 @@ func ShowVJEffect(effect int) ([]byte, error) {
 	// This one doesn't seem to work for me. But it could be that I disabled it
 	// at some point through the app, or maybe it needs music to be playing..?
 
-	if effect < 0 || effect > 15 {
-		return nil, fmt.Errorf("effect should be a value between 0 and 15")
+	if effect < 0 || effect > MaxVJEffect {
+		return nil, fmt.Errorf("effect should be a value between 0 and %d", MaxVJEffect)
 	}
 
 	return wrap([]byte{
@@ -136,8 +136,8 @@ func ShowVJEffect(effect int) ([]byte, error) {
 }
 
 func ShowVisualisation(visualisation int) ([]byte, error) {
-	if visualisation < 0 || visualisation > 11 {
-		return nil, fmt.Errorf("visualisation should be a value between 0 and 11")
+	if visualisation < 0 || visualisation > MaxVisualisation {
+		return nil, fmt.Errorf("visualisation should be a value between 0 and %d", MaxVisualisation)
 	}
 
 	return wrap([]byte{
@@ -148,8 +148,8 @@ func ShowVisualisation(visualisation int) ([]byte, error) {
 }
 
 func ShowScoreBoard(redPlayer, bluePlayer int) ([]byte, error) {
-	if redPlayer < 0 || redPlayer > 999 || bluePlayer < 0 || bluePlayer > 999 {
-		return nil, fmt.Errorf("player scores should be between 0 and 999")
+	if redPlayer < 0 || redPlayer > MaxScore || bluePlayer < 0 || bluePlayer > MaxScore {
+		return nil, fmt.Errorf("player scores should be between 0 and %d", MaxScore)
 	}
 
 	return wrap([]byte{
@@ -194,6 +194,15 @@ func ShowImage(image *image.RGBA) ([]byte, error) {
 }
 
 func ShowAnimation(frames []*image.RGBA, durationsMs []int) ([]byte, error) {
+	if len(frames) != len(durationsMs) {
+		return nil, fmt.Errorf("expected a duration for each of the %d frames, got %d", len(frames), len(durationsMs))
+	}
+	for _, duration := range durationsMs {
+		if duration < 0 || duration > MaxFrameDuration {
+			return nil, fmt.Errorf("frame durations should be between 0 and %d milliseconds", MaxFrameDuration)
+		}
+	}
+
 	// Convert frames to frame data as device expects it
 	frameData := make([]byte, 0)
 	for i, frame := range frames {
@@ -225,7 +234,12 @@ func ShowAnimation(frames []*image.RGBA, durationsMs []int) ([]byte, error) {
 		frameData = append(frameData, frame...)
 	}
 
-	// Create packets to stream to the Divoom
+	if len(frameData) > maxAnimationData {
+		return nil, ErrAnimationTooLarge
+	}
+
+	// Create packets to stream to the Divoom. Keep animationMessageSize in sync
+	// with this.
 	packetNum := 0
 	totalSize := len(frameData)
 	commands := make([]byte, 0)
@@ -245,6 +259,26 @@ func ShowAnimation(frames []*image.RGBA, durationsMs []int) ([]byte, error) {
 	return commands, nil
 }
 
+// animationFrameSize returns the number of bytes the frame takes in the frame
+// data of ShowAnimation
+func animationFrameSize(frame *image.RGBA) (int, error) {
+	paletteData, imageData, err := convertImage(frame)
+	if err != nil {
+		return 0, err
+	}
+	return 7 + len(paletteData) + len(imageData), nil
+}
+
+// animationMessageSize returns the size of the message ShowAnimation creates
+// for frame data of the given size
+func animationMessageSize(frameDataSize int) int {
+	size := 0
+	for i := 0; i < frameDataSize; i += 200 {
+		size += envelopeSize + 4 + min(i+400, frameDataSize) - i
+	}
+	return size
+}
+
 func conditional(input bool) byte {
 	if input {
 		return 1
@@ -6,6 +6,7 @@ import (
 	"log"
 	"os"
 	"strings"
+	"sync"
 
 	"golang.org/x/sys/unix"
 )
@@ -17,6 +18,7 @@ type Connection struct {
 	fileDescriptor int
 	file           *os.File
 	active         bool
+	writeMu        sync.Mutex
 }
 
 func NewConnection(mac string, channel int, callback func([]byte)) *Connection {
@@ -72,6 +74,10 @@ func (c *Connection) Disconnect() {
 }
 
 func (c *Connection) Send(message []byte) error {
+	// Make sure messages from different goroutines don't get interleaved
+	c.writeMu.Lock()
+	defer c.writeMu.Unlock()
+
 	if !c.active {
 		return fmt.Errorf("device not connected")
 	}
@@ -2,14 +2,23 @@ package server
 
 import (
 	"encoding/json"
-	"io"
+	"fmt"
 	"log"
 	"os"
+	"reflect"
+	"slices"
+	"sync"
+	"time"
+
+	"github.com/timendus/pixelbox/internal/filestamp"
 )
 
 type Config struct {
-	Server  ConfigServer `json:"server"`
-	Devices []Device     `json:"devices"`
+	Server    ConfigServer    `json:"server"`
+	Devices   []Device        `json:"devices"`
+	Animation ConfigAnimation `json:"animation"`
+	Schedule  ConfigSchedule  `json:"schedule"`
+	Scenes    ConfigScenes    `json:"scenes"`
 }
 
 type ConfigServer struct {
@@ -17,25 +26,64 @@ type ConfigServer struct {
 	Port int    `json:"port"`
 }
 
+// Limits for animations that we send to the device. Durations are in
+// milliseconds, MaxBytes is the size of the complete message over the link.
+type ConfigAnimation struct {
+	MaxFrames    int `json:"maxFrames"`
+	MaxBytes     int `json:"maxBytes"`
+	MinDuration  int `json:"minDuration"`
+	MaxDuration  int `json:"maxDuration"`
+	ZeroDuration int `json:"zeroDuration"`
+}
+
+type ConfigScenes struct {
+	Revisions       int `json:"revisions"`       // Old versions to keep of each scene, negative for none
+	UnusedAssetDays int `json:"unusedAssetDays"` // How long to keep uploads that no scene uses
+}
+
+type ConfigSchedule struct {
+	Timezone string          `json:"timezone"` // Like "Europe/Amsterdam", empty for the system time zone
+	Location *ConfigLocation `json:"location"` // For sunrise and sunset triggers, nil if not configured
+}
+
+type ConfigLocation struct {
+	Latitude  float64 `json:"latitude"`
+	Longitude float64 `json:"longitude"`
+}
+
 type Device struct {
 	Name    string `json:"name"`
 	Mac     string `json:"mac"`
 	Channel int    `json:"channel"`
 }
 
-var config Config
+const configFile = "config.json"
+
+var (
+	configMu        sync.RWMutex
+	config          Config
+	configStamp     filestamp.Stamp
+	configListeners []func(Config)
+)
 
 func init() {
-	configFile, err := os.Open("config.json")
+	configStamp = filestamp.Of(configFile)
+	loaded, err := readConfig()
 	if err != nil {
-		log.Println("Could not open config.json file")
+		log.Println("Could not load config:", err)
 		return
 	}
-	configBytes, _ := io.ReadAll(configFile)
-	err = json.Unmarshal(configBytes, &config)
+	config = loaded
+}
+
+func readConfig() (Config, error) {
+	configBytes, err := os.ReadFile(configFile)
 	if err != nil {
-		log.Println("Could not parse config.json file as valid JSON")
-		return
+		return Config{}, fmt.Errorf("could not open config.json file: %w", err)
+	}
+	var config Config
+	if err := json.Unmarshal(configBytes, &config); err != nil {
+		return Config{}, fmt.Errorf("could not parse config.json file as valid JSON: %w", err)
 	}
 	if config.Server.Port == 0 {
 		config.Server.Port = 3000
@@ -43,8 +91,103 @@ func init() {
 	if config.Server.Host == "" {
 		config.Server.Host = "127.0.0.1"
 	}
+	if config.Animation.MaxFrames == 0 {
+		config.Animation.MaxFrames = 60
+	}
+	if config.Animation.MaxBytes == 0 {
+		config.Animation.MaxBytes = 64 << 10
+	}
+	if config.Animation.MinDuration == 0 {
+		config.Animation.MinDuration = 20
+	}
+	if config.Animation.MaxDuration == 0 {
+		config.Animation.MaxDuration = 0xFFFF
+	}
+	if config.Animation.ZeroDuration == 0 {
+		config.Animation.ZeroDuration = 100
+	}
+	if config.Scenes.Revisions == 0 {
+		config.Scenes.Revisions = 20
+	}
+	if config.Scenes.UnusedAssetDays == 0 {
+		config.Scenes.UnusedAssetDays = 7
+	}
+	return config, nil
+}
+
+// validate checks the settings that can change while PixelBox is running, so
+// a mistake in config.json doesn't get applied
+func (config Config) validate() error {
+	animation := config.Animation
+	if animation.MaxFrames < 1 || animation.MaxBytes < 1 {
+		return fmt.Errorf("animation: maxFrames and maxBytes should be more than 0")
+	}
+	if animation.MinDuration < 1 || animation.MinDuration > animation.MaxDuration || animation.MaxDuration > 0xFFFF {
+		return fmt.Errorf("animation: minDuration and maxDuration should be between 1 and 65535, with minDuration the smallest")
+	}
+	if animation.ZeroDuration < 1 || animation.ZeroDuration > 0xFFFF {
+		return fmt.Errorf("animation: zeroDuration should be between 1 and 65535")
+	}
+	if config.Schedule.Timezone != "" {
+		if _, err := time.LoadLocation(config.Schedule.Timezone); err != nil {
+			return fmt.Errorf("schedule: unknown time zone %q", config.Schedule.Timezone)
+		}
+	}
+	if location := config.Schedule.Location; location != nil {
+		if location.Latitude < -90 || location.Latitude > 90 || location.Longitude < -180 || location.Longitude > 180 {
+			return fmt.Errorf("schedule: the location should have a latitude between -90 and 90 and a longitude between -180 and 180")
+		}
+	}
+	return nil
 }
 
 func GetConfig() Config {
+	configMu.RLock()
+	defer configMu.RUnlock()
 	return config
 }
+
+// RegisterConfigListener registers a function to call with the new config
+// after config.json was reloaded
+func RegisterConfigListener(listener func(Config)) {
+	configListeners = append(configListeners, listener)
+}
+
+// ReloadConfig reads config.json again if it changed since it was last read,
+// and returns whether there were changes to apply. Invalid files are refused
+// with an error. The server and the devices are only set up when PixelBox
+// starts, so changes to those are ignored until it restarts.
+func ReloadConfig() (bool, error) {
+	stamp := filestamp.Of(configFile)
+	configMu.Lock()
+	if stamp == configStamp {
+		configMu.Unlock()
+		return false, nil
+	}
+	configStamp = stamp
+
+	loaded, err := readConfig()
+	if err == nil {
+		err = loaded.validate()
+	}
+	if err != nil {
+		configMu.Unlock()
+		return false, err
+	}
+	if loaded.Server != config.Server || !slices.Equal(loaded.Devices, config.Devices) {
+		log.Println("Changes to the server and the devices in config.json are applied after a restart")
+		loaded.Server = config.Server
+		loaded.Devices = config.Devices
+	}
+	if reflect.DeepEqual(loaded, config) {
+		configMu.Unlock()
+		return false, nil
+	}
+	config = loaded
+	configMu.Unlock()
+
+	for _, listener := range configListeners {
+		listener(loaded)
+	}
+	return true, nil
+}
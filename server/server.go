@@ -12,31 +12,13 @@ type Server struct {
 	router           *http.ServeMux
 	connection       *Connection
 	messageListeners []func([]byte)
+	connectListeners []func()
 }
 
 var server Server
 
 func init() {
 	config := GetConfig()
-	if len(config.Devices) == 0 {
-		log.Fatal("No devices configured in config.json")
-	}
-	device := config.Devices[0]
-
-	go func() {
-		server.connection = NewConnection(device.Mac, device.Channel, func(msg []byte) {
-			for _, listener := range server.messageListeners {
-				listener(msg)
-			}
-		})
-		err := server.connection.Connect()
-		if err != nil {
-			log.Println("Could not connect to the Divoom Timebox Evo:", err)
-		} else {
-			log.Println("Connected to Divoom Timebox Evo")
-		}
-	}()
-
 	server = Server{
 		bind:   config.Server.Host + ":" + strconv.Itoa(config.Server.Port),
 		router: http.NewServeMux(),
@@ -47,6 +29,12 @@ func RegisterMessageListener(listener func([]byte)) {
 	server.messageListeners = append(server.messageListeners, listener)
 }
 
+// RegisterConnectListener registers a function to call once the connection to
+// the device has been made
+func RegisterConnectListener(listener func()) {
+	server.connectListeners = append(server.connectListeners, listener)
+}
+
 func RegisterRouter(path string, router *http.ServeMux) {
 	log.Println("Registering router for " + path)
 	server.router.Handle(path+"/", http.StripPrefix(path, router))
@@ -66,7 +54,32 @@ func Root(path string) {
 	})
 }
 
+// Start connects to the device in the background and serves HTTP requests
+// until something goes wrong
 func Start() {
+	config := GetConfig()
+	if len(config.Devices) == 0 {
+		log.Fatal("No devices configured in config.json")
+	}
+	device := config.Devices[0]
+
+	go func() {
+		server.connection = NewConnection(device.Mac, device.Channel, func(msg []byte) {
+			for _, listener := range server.messageListeners {
+				listener(msg)
+			}
+		})
+		err := server.connection.Connect()
+		if err != nil {
+			log.Println("Could not connect to the Divoom Timebox Evo:", err)
+		} else {
+			log.Println("Connected to Divoom Timebox Evo")
+			for _, listener := range server.connectListeners {
+				listener()
+			}
+		}
+	}()
+
 	log.Println("Starting server on http://" + server.bind)
 	log.Fatal(http.ListenAndServe(server.bind, server.router))
 }
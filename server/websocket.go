@@ -0,0 +1,271 @@
+package server
+
+// A minimal WebSocket implementation (RFC 6455), just enough to exchange
+// messages with a browser or a script. It handles the opening handshake,
+// fragmented messages, pings and closing the connection. Extensions and
+// subprotocols are not supported.
+//
+// Browsers let any web page open a WebSocket to any host, so connections from
+// a page on another origin are refused. Scripts don't send an Origin header,
+// and can always connect.
+
+import (
+	"bufio"
+	"crypto/sha1"
+	"encoding/base64"
+	"encoding/binary"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"net/url"
+	"strings"
+	"sync"
+)
+
+const (
+	WebSocketText   = 0x1
+	WebSocketBinary = 0x2
+
+	wsContinuation = 0x0
+	wsClose        = 0x8
+	wsPing         = 0x9
+	wsPong         = 0xA
+
+	wsGUID              = "258EAFA5-E914-47DA-95CA-C5AB0DC85B11"
+	wsMaxMessageSize    = 1 << 20 // 1 MB, unless SetReadLimit says otherwise
+	wsMaxControlPayload = 125
+	wsReservedBits      = 0x70
+)
+
+type WebSocket struct {
+	conn      net.Conn
+	reader    *bufio.Reader
+	writeMu   sync.Mutex
+	closed    bool
+	readLimit int
+}
+
+// UpgradeWebSocket performs the opening handshake. If the request is not a
+// valid WebSocket request, an error is written to the response and returned.
+func UpgradeWebSocket(res http.ResponseWriter, req *http.Request) (*WebSocket, error) {
+	if !headerContains(req.Header, "Connection", "upgrade") || !headerContains(req.Header, "Upgrade", "websocket") {
+		http.Error(res, "expected a WebSocket upgrade request", http.StatusBadRequest)
+		return nil, fmt.Errorf("not a WebSocket upgrade request")
+	}
+	if req.Header.Get("Sec-WebSocket-Version") != "13" {
+		res.Header().Set("Sec-WebSocket-Version", "13")
+		http.Error(res, "unsupported WebSocket version", http.StatusUpgradeRequired)
+		return nil, fmt.Errorf("unsupported WebSocket version")
+	}
+	key := req.Header.Get("Sec-WebSocket-Key")
+	if key == "" {
+		http.Error(res, "missing Sec-WebSocket-Key", http.StatusBadRequest)
+		return nil, fmt.Errorf("missing Sec-WebSocket-Key")
+	}
+	if !sameOrigin(req) {
+		http.Error(res, "WebSocket connections from other origins are not allowed", http.StatusForbidden)
+		return nil, fmt.Errorf("WebSocket request from origin %q", req.Header.Get("Origin"))
+	}
+
+	hijacker, ok := res.(http.Hijacker)
+	if !ok {
+		http.Error(res, "WebSockets unsupported", http.StatusInternalServerError)
+		return nil, fmt.Errorf("response can't be hijacked")
+	}
+	conn, buffer, err := hijacker.Hijack()
+	if err != nil {
+		return nil, err
+	}
+
+	hash := sha1.Sum([]byte(key + wsGUID))
+	_, err = fmt.Fprintf(buffer,
+		"HTTP/1.1 101 Switching Protocols\r\n"+
+			"Upgrade: websocket\r\n"+
+			"Connection: Upgrade\r\n"+
+			"Sec-WebSocket-Accept: %s\r\n\r\n",
+		base64.StdEncoding.EncodeToString(hash[:]),
+	)
+	if err == nil {
+		err = buffer.Flush()
+	}
+	if err != nil {
+		conn.Close()
+		return nil, err
+	}
+
+	return &WebSocket{conn: conn, reader: buffer.Reader, readLimit: wsMaxMessageSize}, nil
+}
+
+// SetReadLimit sets the maximum size of the messages we accept, in bytes
+func (ws *WebSocket) SetReadLimit(limit int) {
+	ws.readLimit = limit
+}
+
+// ReadMessage blocks until a complete text or binary message has been
+// received. Pings are answered along the way. When the other side closes the
+// connection, `io.EOF` is returned.
+func (ws *WebSocket) ReadMessage() (int, []byte, error) {
+	messageType := 0
+	message := make([]byte, 0)
+
+	for {
+		fin, opcode, payload, err := ws.readFrame()
+		if err != nil {
+			return 0, nil, err
+		}
+
+		switch opcode {
+		case wsPing:
+			if err := ws.writeFrame(wsPong, payload); err != nil {
+				return 0, nil, err
+			}
+			continue
+		case wsPong:
+			continue
+		case wsClose:
+			ws.writeFrame(wsClose, payload)
+			ws.Close()
+			return 0, nil, io.EOF
+		case WebSocketText, WebSocketBinary:
+			if messageType != 0 {
+				return 0, nil, fmt.Errorf("expected a continuation frame")
+			}
+			messageType = int(opcode)
+		case wsContinuation:
+			if messageType == 0 {
+				return 0, nil, fmt.Errorf("unexpected continuation frame")
+			}
+		default:
+			return 0, nil, fmt.Errorf("unknown opcode %d", opcode)
+		}
+
+		if len(message)+len(payload) > ws.readLimit {
+			return 0, nil, fmt.Errorf("message too large")
+		}
+		message = append(message, payload...)
+		if fin {
+			return messageType, message, nil
+		}
+	}
+}
+
+// WriteMessage sends a complete text or binary message. It is safe to call
+// from multiple goroutines.
+func (ws *WebSocket) WriteMessage(messageType int, data []byte) error {
+	return ws.writeFrame(byte(messageType), data)
+}
+
+func (ws *WebSocket) Close() error {
+	ws.writeMu.Lock()
+	defer ws.writeMu.Unlock()
+	if ws.closed {
+		return nil
+	}
+	ws.closed = true
+	return ws.conn.Close()
+}
+
+func (ws *WebSocket) readFrame() (bool, byte, []byte, error) {
+	var header [2]byte
+	if _, err := io.ReadFull(ws.reader, header[:]); err != nil {
+		return false, 0, nil, err
+	}
+	fin := header[0]&0x80 != 0
+	opcode := header[0] & 0x0F
+	masked := header[1]&0x80 != 0
+	if header[0]&wsReservedBits != 0 {
+		return false, 0, nil, fmt.Errorf("received frame with reserved bits set")
+	}
+
+	length := uint64(header[1] & 0x7F)
+	switch length {
+	case 126:
+		var extended [2]byte
+		if _, err := io.ReadFull(ws.reader, extended[:]); err != nil {
+			return false, 0, nil, err
+		}
+		length = uint64(binary.BigEndian.Uint16(extended[:]))
+	case 127:
+		var extended [8]byte
+		if _, err := io.ReadFull(ws.reader, extended[:]); err != nil {
+			return false, 0, nil, err
+		}
+		length = binary.BigEndian.Uint64(extended[:])
+	}
+	if length > uint64(ws.readLimit) {
+		return false, 0, nil, fmt.Errorf("frame too large")
+	}
+	// Control frames (close, ping and pong) can't be fragmented and have a
+	// small payload
+	if opcode >= wsClose && (!fin || length > wsMaxControlPayload) {
+		return false, 0, nil, fmt.Errorf("received invalid control frame")
+	}
+
+	// Clients are required to mask everything they send
+	if !masked {
+		return false, 0, nil, fmt.Errorf("received unmasked frame")
+	}
+	var mask [4]byte
+	if _, err := io.ReadFull(ws.reader, mask[:]); err != nil {
+		return false, 0, nil, err
+	}
+
+	payload := make([]byte, length)
+	if _, err := io.ReadFull(ws.reader, payload); err != nil {
+		return false, 0, nil, err
+	}
+	for i := range payload {
+		payload[i] ^= mask[i%4]
+	}
+	return fin, opcode, payload, nil
+}
+
+func (ws *WebSocket) writeFrame(opcode byte, payload []byte) error {
+	ws.writeMu.Lock()
+	defer ws.writeMu.Unlock()
+	if ws.closed {
+		return net.ErrClosed
+	}
+
+	frame := []byte{0x80 | opcode}
+	switch {
+	case len(payload) < 126:
+		frame = append(frame, byte(len(payload)))
+	case len(payload) <= 0xFFFF:
+		frame = append(frame, 126, 0, 0)
+		binary.BigEndian.PutUint16(frame[2:], uint16(len(payload)))
+	default:
+		frame = append(frame, 127, 0, 0, 0, 0, 0, 0, 0, 0)
+		binary.BigEndian.PutUint64(frame[2:], uint64(len(payload)))
+	}
+	frame = append(frame, payload...)
+
+	_, err := ws.conn.Write(frame)
+	return err
+}
+
+// sameOrigin returns whether the request comes from a page on this server, or
+// from something that isn't a browser
+func sameOrigin(req *http.Request) bool {
+	origin := req.Header.Get("Origin")
+	if origin == "" {
+		return true
+	}
+	parsed, err := url.Parse(origin)
+	if err != nil {
+		return false
+	}
+	return strings.EqualFold(parsed.Host, req.Host)
+}
+
+func headerContains(header http.Header, name, value string) bool {
+	for _, field := range header.Values(name) {
+		for _, part := range strings.Split(field, ",") {
+			if strings.EqualFold(strings.TrimSpace(part), value) {
+				return true
+			}
+		}
+	}
+	return false
+}